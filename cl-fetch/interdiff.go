@@ -0,0 +1,145 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"golang.org/x/build/gerrit"
+)
+
+// patchSet returns the commit of patch set ps of cl, or "".
+func patchSet(cl *gerrit.ChangeInfo, ps int) string {
+	for commitID, rev := range cl.Revisions {
+		if rev.PatchSetNumber == ps {
+			return commitID
+		}
+	}
+	return ""
+}
+
+// interdiff shows the difference between patch sets ps1 and ps2 of
+// cl.
+func interdiff(cl *gerrit.ChangeInfo, ps1, ps2 int) {
+	old, new := patchSet(cl, ps1), patchSet(cl, ps2)
+	if old == "" {
+		log.Fatalf("CL %d has no patch set %d", cl.ChangeNumber, ps1)
+	}
+	if new == "" {
+		log.Fatalf("CL %d has no patch set %d", cl.ChangeNumber, ps2)
+	}
+	base := old
+	if !*flagDry {
+		var err error
+		base, err = rebasedTree(old, new)
+		if err != nil {
+			log.Printf("patch set %d does not apply to the parent of patch set %d (%s); showing the full difference", ps1, ps2, err)
+			base = old
+		}
+	}
+	git("diff", base, new)
+}
+
+// rebasedTree returns a tree with the changes of commit old applied
+// to the parent of commit new. Diffing this tree against new shows
+// the difference between old and new without any changes made by
+// rebasing new. If old and new have the same parent, it returns old.
+func rebasedTree(old, new string) (string, error) {
+	oldParent, err := gitPlumbing(nil, nil, "rev-parse", old+"^")
+	if err != nil {
+		return "", err
+	}
+	newParent, err := gitPlumbing(nil, nil, "rev-parse", new+"^")
+	if err != nil {
+		return "", err
+	}
+	if oldParent == newParent {
+		return old, nil
+	}
+
+	// Apply old to newParent in a temporary index.
+	f, err := ioutil.TempFile("", "cl-fetch-index-")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	env := []string{"GIT_INDEX_FILE=" + f.Name()}
+	if _, err := gitPlumbing(env, nil, "read-tree", newParent); err != nil {
+		return "", err
+	}
+	patch, err := gitPlumbing(nil, nil, "diff", "--binary", oldParent, old)
+	if err != nil {
+		return "", err
+	}
+	if patch != "" {
+		if _, err := gitPlumbing(env, []byte(patch+"\n"), "apply", "--cached", "--3way"); err != nil {
+			return "", err
+		}
+	}
+	return gitPlumbing(env, nil, "write-tree")
+}
+
+// gitPlumbing runs git with args and input, with env added to the
+// environment, and returns its output. Unlike git, it runs even in
+// dry-run mode.
+func gitPlumbing(env []string, input []byte, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), env...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %s", args[0], err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// printFiles prints to w the files that changed between each pair of
+// consecutive patch sets of cl.
+func printFiles(w io.Writer, cl *gerrit.ChangeInfo) {
+	var pss []int
+	for _, rev := range cl.Revisions {
+		pss = append(pss, rev.PatchSetNumber)
+	}
+	sort.Ints(pss)
+	for i := 1; i < len(pss); i++ {
+		old, new := patchSet(cl, pss[i-1]), patchSet(cl, pss[i])
+		note := ""
+		base, err := rebasedTree(old, new)
+		if err != nil {
+			// Fall back to the full difference.
+			base, note = old, " (includes rebase)"
+		}
+		files, err := gitPlumbing(nil, nil, "diff", "--name-only", base, new)
+		if err != nil {
+			// The patch sets may not have been fetched.
+			continue
+		}
+		if files == "" {
+			files = "no changes"
+			if base != old {
+				files = "rebase only"
+			}
+		} else {
+			files = strings.Replace(files, "\n", " ", -1)
+		}
+		fmt.Fprintf(w, "  %d→%d: %s%s\n", pss[i-1], pss[i], files, note)
+	}
+}
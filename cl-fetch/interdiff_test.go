@@ -0,0 +1,166 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/build/gerrit"
+)
+
+// testRepo is a temporary git repository. While it exists, it is the
+// current directory.
+type testRepo struct {
+	t        *testing.T
+	dir, old string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "cl-fetch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	r := &testRepo{t, dir, old}
+	r.git("init", "-q")
+	r.git("config", "user.name", "Gopher")
+	r.git("config", "user.email", "gopher@example.com")
+	return r
+}
+
+func (r *testRepo) close() {
+	os.Chdir(r.old)
+	os.RemoveAll(r.dir)
+}
+
+func (r *testRepo) git(args ...string) string {
+	r.t.Helper()
+	out, err := gitPlumbing(nil, nil, args...)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return out
+}
+
+// commit commits files on top of parent, or as a root commit if
+// parent is "", and returns the new commit. files maps from file
+// names to their new contents.
+func (r *testRepo) commit(parent string, files map[string]string) string {
+	r.t.Helper()
+	if parent != "" {
+		r.git("checkout", "-q", "--detach", parent)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(r.dir, name), []byte(data), 0666); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.git("add", "-A")
+	r.git("commit", "-q", "-m", "commit")
+	return r.git("rev-parse", "HEAD")
+}
+
+// lines returns a file of ten numbered lines, with the lines in
+// changes replaced.
+func lines(changes map[int]string) string {
+	var buf strings.Builder
+	for i := 1; i <= 10; i++ {
+		if l, ok := changes[i]; ok {
+			buf.WriteString(l + "\n")
+		} else {
+			buf.WriteString(strings.Repeat("x", i) + "\n")
+		}
+	}
+	return buf.String()
+}
+
+func TestRebasedTree(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.close()
+
+	// Upstream history is b0 ← b1 ← b2 ← b3. Patch sets 1 and 2
+	// make the same change to a on top of b0 and b1; patch set 2
+	// also changes line 9.
+	b0 := r.commit("", map[string]string{"a": lines(nil), "b": "b0\n", "c": "c0\n"})
+	b1 := r.commit(b0, map[string]string{"b": "b1\n"})
+	ps1 := r.commit(b0, map[string]string{"a": lines(map[int]string{2: "two"})})
+	ps2 := r.commit(b1, map[string]string{"a": lines(map[int]string{2: "two", 9: "nine"})})
+	ps3 := r.commit(b1, map[string]string{"a": lines(map[int]string{2: "two", 9: "nine", 10: "ten"})})
+
+	// Rebasing patch set 1 removes the upstream change to b from
+	// the difference.
+	base, err := rebasedTree(ps1, ps2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := r.git("diff", "--name-only", ps1, ps2); files != "a\nb" {
+		t.Fatalf("full difference changes %q, want a and b", files)
+	}
+	if diff := r.git("diff", "-U0", base, ps2); strings.Contains(diff, "b1") || !strings.Contains(diff, "+nine") || strings.Contains(diff, "+two") {
+		t.Errorf("interdiff includes more than the change to line 9:\n%s", diff)
+	}
+
+	// Patch sets with the same parent need no rebasing.
+	if base, err := rebasedTree(ps2, ps3); err != nil || base != ps2 {
+		t.Errorf("rebasedTree with same parent = %s, %v, want %s", base, err, ps2)
+	}
+
+	// Patch set 1 conflicts with upstream changes to line 2.
+	b2 := r.commit(b1, map[string]string{"a": lines(map[int]string{2: "deux"})})
+	ps4 := r.commit(b2, map[string]string{"a": lines(map[int]string{2: "deux", 5: "five"})})
+	if base, err := rebasedTree(ps1, ps4); err == nil {
+		t.Errorf("rebasedTree with conflict = %s, want error", base)
+	}
+}
+
+func TestPrintFiles(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.close()
+
+	b0 := r.commit("", map[string]string{"a": lines(nil), "b": "b0\n", "c": "c0\n"})
+	b1 := r.commit(b0, map[string]string{"b": "b1\n"})
+	b2 := r.commit(b1, map[string]string{"a": lines(map[int]string{2: "deux"}), "c": "c2\n"})
+	b3 := r.commit(b2, map[string]string{"b": "b3\n"})
+	pss := []string{
+		1: r.commit(b0, map[string]string{"a": lines(map[int]string{2: "two"})}),
+		2: r.commit(b1, map[string]string{"a": lines(map[int]string{2: "two", 9: "nine"})}),
+		3: r.commit(b1, map[string]string{"a": lines(map[int]string{2: "two", 9: "nine"}), "d": "new\n"}),
+		4: r.commit(b2, map[string]string{"a": lines(map[int]string{2: "deux", 5: "five"})}),
+		5: r.commit(b3, map[string]string{"a": lines(map[int]string{2: "deux", 5: "five"})}),
+	}
+	cl := &gerrit.ChangeInfo{Revisions: make(map[string]gerrit.RevisionInfo)}
+	for ps, commit := range pss[1:] {
+		cl.Revisions[commit] = gerrit.RevisionInfo{PatchSetNumber: ps + 1}
+	}
+	// Patch set 6 hasn't been fetched, so it's skipped.
+	cl.Revisions[strings.Repeat("0", 40)] = gerrit.RevisionInfo{PatchSetNumber: 6}
+
+	var buf bytes.Buffer
+	printFiles(&buf, cl)
+	want := `  1→2: a
+  2→3: d
+  3→4: a c d (includes rebase)
+  4→5: rebase only
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -3,6 +3,29 @@
 // license that can be found in the LICENSE file.
 
 // cl-fetch fetches and tags CLs from Gerrit.
+//
+// Each fetched patch set is tagged cl/<CL number>/<patch set>.
+//
+// By default, cl-fetch uses the Gerrit server in git config
+// cl-fetch.server. If that isn't set, it uses the review server of
+// the origin remote if origin is on googlesource.com, and otherwise
+// go-review.googlesource.com.
+//
+// With -worktree, cl-fetch also checks out each fetched chain of CLs
+// into its own git worktree next to the main worktree, named after
+// the top CL of the chain.
+//
+// With -files, cl-fetch fetches every patch set of each CL and
+// annotates each printed CL with the files that changed between each
+// pair of consecutive patch sets.
+//
+// cl-fetch -interdiff CL PS1 PS2 shows the difference between two
+// patch sets of a CL. If the patch sets have different parents, PS1 is
+// first rebased onto the parent of PS2, so the difference only shows
+// changes to the CL itself.
+//
+// With -prune, cl-fetch deletes the tags of CLs that have been merged
+// or abandoned, and removes their worktrees if they are clean.
 package main
 
 import (
@@ -13,18 +36,26 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"golang.org/x/build/gerrit"
 )
 
 var (
-	flagOutgoing = flag.Bool("outgoing", false, "fetch outgoing CLs")
-	flagIncoming = flag.Bool("incoming", false, "fetch incoming CLs")
-	flagQuery    = flag.String("q", "", "fetch CLs matching `query`")
-	flagVerbose  = flag.Bool("v", false, "verbose output")
-	flagDry      = flag.Bool("dry-run", false, "print but do not execute commands")
+	flagOutgoing  = flag.Bool("outgoing", false, "fetch outgoing CLs")
+	flagIncoming  = flag.Bool("incoming", false, "fetch incoming CLs")
+	flagQuery     = flag.String("q", "", "fetch CLs matching `query`")
+	flagVerbose   = flag.Bool("v", false, "verbose output")
+	flagDry       = flag.Bool("dry-run", false, "print but do not execute commands")
+	flagServer    = flag.String("server", "", "Gerrit server `url` (default from git config cl-fetch.server or origin)")
+	flagWorktree  = flag.Bool("worktree", false, "check out each fetched CL chain in its own worktree")
+	flagPrune     = flag.Bool("prune", false, "delete tags and worktrees of merged and abandoned CLs")
+	flagFiles     = flag.Bool("files", false, "annotate CLs with the files changed between patch sets")
+	flagInterdiff = flag.Bool("interdiff", false, "show the difference between two patch sets of a CL")
 )
 
 var clRe = regexp.MustCompile("[0-9]+|I[0-9a-f]{40}")
@@ -32,11 +63,13 @@ var clRe = regexp.MustCompile("[0-9]+|I[0-9a-f]{40}")
 type Tag struct {
 	tag    string
 	commit *gerrit.CommitInfo
+	cl     *gerrit.ChangeInfo
 }
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [CLs...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -interdiff CL PS1 PS2\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -51,22 +84,31 @@ func main() {
 	if *flagQuery != "" {
 		queryParts = append(queryParts, *flagQuery)
 	}
-	for _, arg := range flag.Args() {
+	args := flag.Args()
+	var ps1, ps2 int
+	if *flagInterdiff {
+		var err1, err2 error
+		if len(args) == 3 {
+			ps1, err1 = strconv.Atoi(args[1])
+			ps2, err2 = strconv.Atoi(args[2])
+		}
+		if len(args) != 3 || err1 != nil || err2 != nil || len(queryParts) != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		args = args[:1]
+	}
+	for _, arg := range args {
 		if !clRe.MatchString(arg) {
 			fmt.Fprintf(os.Stderr, "CL must be a CL number or Change-Id")
 			os.Exit(2)
 		}
 		queryParts = append(queryParts, "change:"+arg)
 	}
-	if len(queryParts) == 0 {
+	if len(queryParts) == 0 && !*flagPrune {
 		fmt.Fprintf(os.Stderr, "must specify something to fetch\n")
 		os.Exit(2)
 	}
-	query := "(" + strings.Join(queryParts, ") OR (") + ")"
-
-	if *flagVerbose {
-		log.Printf("query: %s", query)
-	}
 
 	// Get the origin so we don't pull CLs for other repositories
 	// in to this one.
@@ -78,10 +120,34 @@ func main() {
 		haveTags[tag] = true
 	}
 
-	c := gerrit.NewClient("https://go-review.googlesource.com", gerrit.GitCookiesAuth())
+	server := *flagServer
+	if server == "" {
+		server = defaultServer(origin)
+	}
+	if *flagVerbose {
+		log.Printf("server: %s", server)
+	}
+	c := gerrit.NewClient(server, gerrit.GitCookiesAuth())
+
+	if *flagPrune {
+		prune(c, haveTags)
+	}
+	if len(queryParts) == 0 {
+		return
+	}
+	query := "(" + strings.Join(queryParts, ") OR (") + ")"
 
+	if *flagVerbose {
+		log.Printf("query: %s", query)
+	}
+
+	fields := []string{"CURRENT_REVISION", "CURRENT_COMMIT"}
+	if *flagFiles || *flagInterdiff {
+		// We need every patch set.
+		fields = []string{"ALL_REVISIONS", "ALL_COMMITS"}
+	}
 	cls, err := c.QueryChanges(context.Background(), query, gerrit.QueryChangesOpt{
-		Fields: []string{"CURRENT_REVISION", "CURRENT_COMMIT"},
+		Fields: fields,
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -95,6 +161,7 @@ func main() {
 	// Collect git fetch and tag commands.
 	fetchCmd := []string{"fetch", "--", origin}
 	tags := make(map[string]*Tag)
+	oldTags := make(map[string]*Tag) // Tags of old patch sets
 	hashOrder := []string{}
 	for _, cl := range cls {
 		for commitID, rev := range cl.Revisions {
@@ -113,10 +180,16 @@ func main() {
 				}
 			}
 
-			tags[commitID] = &Tag{
+			t := &Tag{
 				tag:    tag,
 				commit: rev.Commit,
+				cl:     cl,
 			}
+			if commitID != cl.CurrentRevision {
+				oldTags[commitID] = t
+				continue
+			}
+			tags[commitID] = t
 
 			hashOrder = append(hashOrder, commitID)
 		}
@@ -127,9 +200,11 @@ func main() {
 		git(fetchCmd...)
 		fmt.Println()
 	}
-	for commitID, tag := range tags {
-		if !haveTags[tag.tag] {
-			git("tag", tag.tag, commitID)
+	for _, m := range []map[string]*Tag{tags, oldTags} {
+		for commitID, tag := range m {
+			if !haveTags[tag.tag] {
+				git("tag", tag.tag, commitID)
+			}
 		}
 	}
 	if *flagDry {
@@ -137,6 +212,14 @@ func main() {
 		fmt.Println()
 	}
 
+	if *flagInterdiff {
+		if len(cls) != 1 {
+			log.Fatalf("found %d CLs matching %s", len(cls), args[0])
+		}
+		interdiff(cls[0], ps1, ps2)
+		return
+	}
+
 	// Print tags.
 	leafs := make(map[string]bool)
 	for commitID, _ := range tags {
@@ -159,9 +242,124 @@ func main() {
 			fmt.Println()
 		}
 		needBlank = printChain(tags, commitID, printed)
+		if needBlank && *flagWorktree {
+			worktree(tags[commitID], commitID)
+		}
 	}
 }
 
+// defaultServer returns the Gerrit server for a repository with the
+// given origin URL.
+func defaultServer(origin string) string {
+	// Use git config if it's set. This fails if it isn't.
+	if out, err := exec.Command("git", "config", "cl-fetch.server").Output(); err == nil {
+		return strings.TrimSpace(string(out))
+	}
+	// Repositories on googlesource.com have a matching review
+	// server.
+	const gs = ".googlesource.com/"
+	if i := strings.Index(origin, gs); i >= 0 && strings.HasPrefix(origin, "https://") {
+		return origin[:i] + "-review" + gs[:len(gs)-1]
+	}
+	return "https://go-review.googlesource.com"
+}
+
+// worktreeDir returns the directory of the worktree for a CL chain
+// ending in CL n.
+func worktreeDir(n int) string {
+	top := gitOutput("rev-parse", "--show-toplevel")
+	return filepath.Join(filepath.Dir(top), fmt.Sprintf("%s.cl-%d", filepath.Base(top), n))
+}
+
+// worktree checks out the CL chain ending in tag in its own worktree.
+func worktree(tag *Tag, commitID string) {
+	n, _ := clNumber(tag.tag)
+	dir := worktreeDir(n)
+	if exists(dir) {
+		// Update the existing worktree. This fails if it has
+		// local changes that would be overwritten.
+		git("-C", dir, "checkout", "-q", "--detach", commitID)
+	} else {
+		git("worktree", "add", "-q", "--detach", dir, commitID)
+	}
+	fmt.Printf("worktree %s\n", dir)
+}
+
+// clNumber returns the CL number of a cl/N/PS tag.
+func clNumber(tag string) (int, bool) {
+	parts := strings.Split(tag, "/")
+	if len(parts) != 3 || parts[0] != "cl" {
+		return 0, false
+	}
+	if _, err := strconv.Atoi(parts[2]); err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(parts[1])
+	return n, err == nil
+}
+
+// prune deletes the tags of merged and abandoned CLs, along with their
+// worktrees.
+func prune(c *gerrit.Client, haveTags map[string]bool) {
+	clTags := make(map[int][]string)
+	var cls []int
+	for tag := range haveTags {
+		if n, ok := clNumber(tag); ok {
+			if clTags[n] == nil {
+				cls = append(cls, n)
+			}
+			clTags[n] = append(clTags[n], tag)
+		}
+	}
+	sort.Ints(cls)
+
+	// Query CL states in batches to keep the query short.
+	const batch = 100
+	for len(cls) > 0 {
+		var parts []string
+		for _, n := range cls[:min(batch, len(cls))] {
+			parts = append(parts, fmt.Sprintf("change:%d", n))
+		}
+		cls = cls[min(batch, len(cls)):]
+		query := "(" + strings.Join(parts, " OR ") + ") is:closed"
+		if *flagVerbose {
+			log.Printf("prune query: %s", query)
+		}
+		closed, err := c.QueryChanges(context.Background(), query)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, cl := range closed {
+			tags := clTags[cl.ChangeNumber]
+			if len(tags) == 0 {
+				continue
+			}
+			sort.Strings(tags)
+			git(append([]string{"tag", "-d"}, tags...)...)
+			delete(clTags, cl.ChangeNumber)
+			if dir := worktreeDir(cl.ChangeNumber); exists(dir) {
+				// This fails if the worktree has local
+				// changes, which we don't want to lose.
+				if err := tryGit("worktree", "remove", dir); err != nil {
+					log.Printf("not removing worktree %s: %s", dir, err)
+				}
+			}
+		}
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func git(args ...string) {
 	if *flagDry {
 		fmt.Printf("git %s\n", strings.Join(args, " "))
@@ -176,6 +374,20 @@ func git(args ...string) {
 	}
 }
 
+// tryGit is like git, but returns an error instead of exiting if the
+// command fails.
+func tryGit(args ...string) error {
+	if *flagDry {
+		fmt.Printf("git %s\n", strings.Join(args, " "))
+		return nil
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
 func gitOutput(args ...string) string {
 	if *flagDry {
 		fmt.Printf("git %s\n", strings.Join(args, " "))
@@ -203,5 +415,8 @@ func printChain(tags map[string]*Tag, commitID string, printed map[string]bool)
 		}
 	}
 	fmt.Printf("%s %s\n", tag.tag, tag.commit.Subject)
+	if *flagFiles && !*flagDry {
+		printFiles(os.Stdout, tag.cl)
+	}
 	return true
 }
@@ -0,0 +1,75 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultServer(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.close()
+
+	for _, test := range []struct {
+		origin, want string
+	}{
+		{"https://go.googlesource.com/go", "https://go-review.googlesource.com"},
+		{"https://go.googlesource.com/tools", "https://go-review.googlesource.com"},
+		{"https://code.googlesource.com/gocloud", "https://code-review.googlesource.com"},
+		{"sso://code.googlesource.com/gocloud", "https://go-review.googlesource.com"},
+		{"https://github.com/golang/go", "https://go-review.googlesource.com"},
+		{"git@github.com:aclements/go-misc.git", "https://go-review.googlesource.com"},
+		{"", "https://go-review.googlesource.com"},
+	} {
+		if got := defaultServer(test.origin); got != test.want {
+			t.Errorf("defaultServer(%q) = %q, want %q", test.origin, got, test.want)
+		}
+	}
+
+	// git config overrides the origin.
+	r.git("config", "cl-fetch.server", "https://review.example.com")
+	if got, want := defaultServer("https://go.googlesource.com/go"), "https://review.example.com"; got != want {
+		t.Errorf("with cl-fetch.server, got %q, want %q", got, want)
+	}
+}
+
+func TestWorktreeDir(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.close()
+
+	top, err := filepath.EvalSymlinks(r.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(filepath.Dir(top), filepath.Base(top)+".cl-12345")
+	if got := worktreeDir(12345); got != want {
+		t.Errorf("worktreeDir(12345) = %s, want %s", got, want)
+	}
+}
+
+func TestCLNumber(t *testing.T) {
+	for _, test := range []struct {
+		tag string
+		n   int
+		ok  bool
+	}{
+		{"cl/12345/1", 12345, true},
+		{"cl/1/23", 1, true},
+		{"cl/12345", 0, false},
+		{"cl/12345/1/2", 0, false},
+		{"cl/12345/x", 0, false},
+		{"cl/x/1", 0, false},
+		{"cl//1", 0, false},
+		{"go1.12", 0, false},
+		{"release/12345/1", 0, false},
+		{"", 0, false},
+	} {
+		n, ok := clNumber(test.tag)
+		if n != test.n || ok != test.ok {
+			t.Errorf("clNumber(%q) = %d, %v, want %d, %v", test.tag, n, ok, test.n, test.ok)
+		}
+	}
+}
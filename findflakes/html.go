@@ -128,6 +128,12 @@ a.hash {
           {{else}}
             <tr><th>No known past failures</th></tr>
           {{end}}
+          {{with .Merges}}
+            <tr><th>Combined from {{len .}} similar failure(s)</th><td><a href="#" class="toggleRows">show</a></td></tr>
+            {{range .}}
+              <tr class="toggleRow"><th></th><td>{{.A.String}}<br>{{.B.String}}<br>{{pct .Similarity}} similar{{range .Edits}}; {{.}}{{end}}</td></tr>
+            {{end}}
+          {{end}}
         </table>
       </td></tr>
       {{end}}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -24,6 +25,7 @@ var (
 	flagBranch = flag.String("branch", "master", "analyze commits to `branch`")
 	flagHTML   = flag.Bool("html", false, "print an HTML report")
 	flagLimit  = flag.Int("limit", 0, "process only most recent `N` revisions")
+	flagFuzzy  = flag.Float64("fuzzy", 0, "also group failures whose messages and stacks are at least `similarity` (0 to 1) alike; 0 disables")
 
 	// TODO: Is this really just a separate mode? Should we have
 	// subcommands?
@@ -92,6 +94,10 @@ func main() {
 		flag.Usage()
 		os.Exit(2)
 	}
+	if *flagFuzzy < 0 || *flagFuzzy > 1 {
+		fmt.Fprintf(os.Stderr, "-fuzzy must be between 0 and 1\n")
+		os.Exit(2)
+	}
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -161,7 +167,17 @@ func main() {
 	for i, f := range failures {
 		lfailures[i] = f.Failure
 	}
-	failureClasses := loganal.Classify(lfailures)
+	var failureClasses map[loganal.Failure][]int
+	mergesByClass := map[loganal.Failure][]loganal.Merge{}
+	if *flagFuzzy > 0 {
+		var merges []loganal.Merge
+		failureClasses, merges = loganal.FuzzyClassify(lfailures, *flagFuzzy)
+		for _, m := range merges {
+			mergesByClass[m.Class] = append(mergesByClass[m.Class], m)
+		}
+	} else {
+		failureClasses = loganal.Classify(lfailures)
+	}
 
 	// Gather failures from each class and perform flakiness
 	// tests.
@@ -173,6 +189,7 @@ func main() {
 		}
 		fc := newFailureClass(revs, classFailures)
 		fc.Class = class
+		fc.Merges = mergesByClass[class]
 
 		// Trim failure classes below thresholds. We leave out
 		// classes with extremely low failure probabilities
@@ -316,6 +333,10 @@ type failureClass struct {
 	// Class gives the common features of this failure class.
 	Class loganal.Failure
 
+	// Merges explains how this class was combined from similar
+	// failure classes, if fuzzy classification is enabled.
+	Merges []loganal.Merge
+
 	// Revs is the sequence of all revisions indexed by time (both
 	// success and failure).
 	Revs []*Revision
@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
 func round(x float64) int {
@@ -27,6 +28,12 @@ func pct(x float64) string {
 func printTextReport(w io.Writer, classes []*failureClass) {
 	for _, fc := range classes {
 		fmt.Fprintf(w, "%s\n", fc.Class)
+		if len(fc.Merges) > 0 {
+			fmt.Fprintf(w, "Combined from similar failures:\n")
+			for _, m := range fc.Merges {
+				fmt.Fprintf(w, "  %s\n", strings.Replace(m.String(), "\n", "\n  ", -1))
+			}
+		}
 		printTextFlakeReport(w, fc)
 		fmt.Fprintln(w)
 	}
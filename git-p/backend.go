@@ -0,0 +1,166 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A Backend looks up the code review state of local commits.
+//
+// Results are reported as GerritChanges, so all backends share the
+// same status checks and rendering. Backends for other review systems
+// translate their state into the equivalent Gerrit state.
+type Backend interface {
+	// Query starts looking up the reviews of commits, which are
+	// the unsubmitted commits on branch, newest first. upstream is
+	// the full name of the remote branch they are destined for.
+	// Query returns a query for each commit, or nil if a commit
+	// can't have a review.
+	Query(branch, upstream string, commits []string) []*GerritChanges
+
+	// Keys returns a key identifying the review of each of
+	// commits, or "" if a commit can't have a review. Keys must
+	// not require contacting the review server.
+	Keys(branch, upstream string, commits []string) []string
+
+	// Link returns a short link to change.
+	Link(change *GerritChange) string
+
+	// ReviewBranches returns whether branches are pushed to the
+	// remote for review. If so, the remote copy of a branch
+	// doesn't mean its commits are submitted.
+	ReviewBranches() bool
+}
+
+// Config is the configuration of the review backend.
+type Config struct {
+	Backend string // "gerrit" or "github"
+	Remote  string // URL of the git remote
+	Project string // Project name on the review server
+	Server  string // URL of the review server or API
+	Token   string // API token, if any
+}
+
+// Default configuration for the main Go repository.
+const (
+	defaultRemote = "https://go.googlesource.com/go"
+	defaultServer = "https://go-review.googlesource.com"
+)
+
+// NewBackend returns the review backend for cfg, filling in any
+// defaults.
+func NewBackend(cfg *Config) (Backend, error) {
+	switch cfg.Backend {
+	case "", "gerrit":
+		if cfg.Remote == "" {
+			cfg.Remote = defaultRemote
+		}
+		if cfg.Server == "" {
+			if cfg.Remote != defaultRemote {
+				return nil, fmt.Errorf("no review server configured for %s; set git config p.server", cfg.Remote)
+			}
+			cfg.Server = defaultServer
+		}
+		if cfg.Project == "" {
+			// Gerrit project names are usually the path
+			// of the repository.
+			cfg.Project = remoteProject(cfg.Remote)
+		}
+		return &gerritBackend{NewGerrit(cfg.Server), cfg.Server, cfg.Project}, nil
+
+	case "github":
+		if cfg.Remote == "" {
+			return nil, fmt.Errorf("no remote configured for github backend; set git config p.remote")
+		}
+		if cfg.Server == "" {
+			cfg.Server = "https://api.github.com"
+		}
+		if cfg.Project == "" {
+			cfg.Project = remoteProject(cfg.Remote)
+		}
+		if cfg.Token == "" {
+			cfg.Token = os.Getenv("GITHUB_TOKEN")
+		}
+		if strings.Count(cfg.Project, "/") != 1 {
+			return nil, fmt.Errorf("github project must be owner/repo, not %q; set git config p.project", cfg.Project)
+		}
+		return NewGitHub(cfg.Server, cfg.Project, cfg.Token), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+}
+
+// remoteProject guesses the project name from a remote URL, such as
+// "go" for https://go.googlesource.com/go or "owner/repo" for
+// git@github.com:owner/repo.git.
+func remoteProject(remote string) string {
+	path := remote
+	if u, err := url.Parse(remote); err == nil && u.Scheme != "" {
+		path = u.Path
+	} else if i := strings.Index(remote, ":"); i >= 0 {
+		// scp-like syntax.
+		path = remote[i+1:]
+	}
+	path = strings.Trim(path, "/")
+	return strings.TrimSuffix(path, ".git")
+}
+
+// gerritBackend looks up commits on Gerrit by their Change-Id.
+type gerritBackend struct {
+	gerrit  *Gerrit
+	server  string
+	project string
+}
+
+func (b *gerritBackend) Keys(branch, upstream string, commits []string) []string {
+	// Get Change-Ids from these commits.
+	return changeIds(b.project, upstream, commits)
+}
+
+func (b *gerritBackend) Query(branch, upstream string, commits []string) []*GerritChanges {
+	cids := b.Keys(branch, upstream, commits)
+
+	// Fetch information on all of these changes.
+	//
+	// We need DETAILED_LABELS to get numeric values of labels.
+	changes := make([]*GerritChanges, len(cids))
+	for i, cid := range cids {
+		// TODO: Would this be simpler with a single big OR query?
+		if cid != "" {
+			changes[i] = b.gerrit.QueryChanges("change:"+cid, printChangeOptions...)
+		}
+	}
+	return changes
+}
+
+// QueryUpdated is like Query, but only fetches the basic information
+// about each change, including when it was last updated.
+func (b *gerritBackend) QueryUpdated(branch, upstream string, commits []string) []*GerritChanges {
+	cids := b.Keys(branch, upstream, commits)
+	changes := make([]*GerritChanges, len(cids))
+	for i, cid := range cids {
+		if cid != "" {
+			changes[i] = b.gerrit.QueryChanges("change:" + cid)
+		}
+	}
+	return changes
+}
+
+func (b *gerritBackend) Link(change *GerritChange) string {
+	if b.server == defaultServer {
+		return "golang.org/cl/" + strconv.Itoa(change.Number)
+	}
+	// Gerrit redirects /<number> to the change.
+	host := strings.TrimPrefix(strings.TrimPrefix(b.server, "https://"), "http://")
+	return strings.TrimSuffix(host, "/") + "/" + strconv.Itoa(change.Number)
+}
+
+func (b *gerritBackend) ReviewBranches() bool {
+	return false
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A changeCache stores the review state of changes on disk so it can
+// be shown without contacting the review server.
+type changeCache struct {
+	dir string
+}
+
+// cacheEntry is the on-disk form of a cached review.
+type cacheEntry struct {
+	Key     string
+	Fetched time.Time
+	Change  *GerritChange
+}
+
+// openCache returns the review cache of the current repository.
+func openCache() *changeCache {
+	gitDir := git("rev-parse", "--git-common-dir")
+	return &changeCache{filepath.Join(gitDir, "git-p", "changes")}
+}
+
+func (c *changeCache) path(key string) string {
+	return filepath.Join(c.dir, url.PathEscape(key)+".json")
+}
+
+// load returns the cached review for key, or nil if there is none.
+func (c *changeCache) load(key string) *cacheEntry {
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(data, &e); err != nil || e.Change == nil {
+		return nil
+	}
+	return &e
+}
+
+// store saves change as the review for key.
+func (c *changeCache) store(key string, change *GerritChange) error {
+	data, err := json.MarshalIndent(&cacheEntry{key, time.Now(), change}, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0777); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it so concurrent
+	// readers never see a partial entry.
+	f, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// startRefresh updates the cache in the background by running git-p
+// -refresh with args, unless a refresh started recently.
+func (c *changeCache) startRefresh(args []string) {
+	stamp := filepath.Join(c.dir, ".refresh")
+	if st, err := os.Stat(stamp); err == nil && time.Since(st.ModTime()) < time.Minute {
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0777); err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(stamp, nil, 0666); err != nil {
+		return
+	}
+
+	me, err := os.Executable()
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(me, append([]string{"-refresh"}, args...)...)
+	// Put the refresh in its own process group so it isn't
+	// interrupted along with us.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if cmd.Start() == nil {
+		cmd.Process.Release()
+	}
+}
+
+// cachedBackend wraps a Backend to save reviews in a changeCache. If
+// offline is set, it only reports cached reviews. Otherwise, it
+// queries the wrapped Backend and falls back to cached reviews if that
+// fails.
+type cachedBackend struct {
+	Backend
+	cache   *changeCache
+	offline bool
+	warn    sync.Once
+}
+
+// An updatedQuerier is a Backend that can cheaply look up when
+// reviews were last updated, so that unchanged reviews can be taken
+// from the cache.
+type updatedQuerier interface {
+	QueryUpdated(branch, upstream string, commits []string) []*GerritChanges
+}
+
+func (b *cachedBackend) Query(branch, upstream string, commits []string) []*GerritChanges {
+	keys := b.Keys(branch, upstream, commits)
+	out := make([]*GerritChanges, len(commits))
+	for i, key := range keys {
+		if key != "" {
+			out[i] = &GerritChanges{query: key, done: make(chan struct{})}
+		}
+	}
+	if b.offline {
+		for i, key := range keys {
+			if key == "" {
+				continue
+			}
+			if e := b.cache.load(key); e != nil {
+				out[i].result = []*GerritChange{e.Change}
+			}
+			close(out[i].done)
+		}
+		return out
+	}
+	go b.refresh(branch, upstream, commits, keys, out)
+	return out
+}
+
+// refresh completes the queries in out, using cached reviews that are
+// up to date and fetching the rest.
+func (b *cachedBackend) refresh(branch, upstream string, commits, keys []string, out []*GerritChanges) {
+	cached := make([]*cacheEntry, len(keys))
+	anyCached := false
+	for i, key := range keys {
+		if key != "" {
+			cached[i] = b.cache.load(key)
+			anyCached = anyCached || cached[i] != nil
+		}
+	}
+
+	// Find the reviews that need to be fetched. stale[j] is the
+	// index in commits of query[j].
+	query, stale := commits, make([]int, len(commits))
+	for i := range stale {
+		stale[i] = i
+	}
+	if uq, ok := b.Backend.(updatedQuerier); ok && anyCached {
+		query, stale = nil, nil
+		for i, req := range uq.QueryUpdated(branch, upstream, commits) {
+			if out[i] == nil {
+				continue
+			}
+			if req != nil && cached[i] != nil {
+				results, err := req.Wait()
+				if err == nil && len(results) == 1 && results[0].Updated == cached[i].Change.Updated {
+					out[i].result = []*GerritChange{cached[i].Change}
+					close(out[i].done)
+					continue
+				}
+			}
+			query = append(query, commits[i])
+			stale = append(stale, i)
+		}
+		if len(query) == 0 {
+			return
+		}
+	}
+
+	reqs := b.Backend.Query(branch, upstream, query)
+	for j, i := range stale {
+		if out[i] == nil {
+			continue
+		}
+		var results []*GerritChange
+		var err error
+		if reqs[j] != nil {
+			results, err = reqs[j].Wait()
+		}
+		if err != nil && cached[i] != nil {
+			b.warn.Do(func() { log.Printf("using cached reviews: %s", err) })
+			results, err = []*GerritChange{cached[i].Change}, nil
+		} else if err == nil && len(results) == 1 {
+			if err := b.cache.store(keys[i], results[0]); err != nil {
+				log.Printf("failed to cache review: %s", err)
+			}
+		}
+		out[i].result, out[i].err = results, err
+		close(out[i].done)
+	}
+}
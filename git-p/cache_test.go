@@ -0,0 +1,108 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// fakeBackend serves changes from a map keyed by commit.
+type fakeBackend struct {
+	changes map[string]*GerritChange
+	err     error
+	queries int // Number of commits fully queried
+}
+
+func (b *fakeBackend) answer(commits []string, full bool) []*GerritChanges {
+	out := make([]*GerritChanges, len(commits))
+	for i, commit := range commits {
+		out[i] = &GerritChanges{query: commit, err: b.err, done: make(chan struct{})}
+		if c := b.changes[commit]; c != nil && b.err == nil {
+			if !full {
+				c = &GerritChange{ID: c.ID, Updated: c.Updated}
+			}
+			out[i].result = []*GerritChange{c}
+		}
+		close(out[i].done)
+	}
+	return out
+}
+
+func (b *fakeBackend) Query(branch, upstream string, commits []string) []*GerritChanges {
+	b.queries += len(commits)
+	return b.answer(commits, true)
+}
+
+func (b *fakeBackend) QueryUpdated(branch, upstream string, commits []string) []*GerritChanges {
+	return b.answer(commits, false)
+}
+
+func (b *fakeBackend) Keys(branch, upstream string, commits []string) []string {
+	return commits
+}
+
+func (b *fakeBackend) Link(change *GerritChange) string { return change.ID }
+
+func (b *fakeBackend) ReviewBranches() bool { return false }
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-p-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &changeCache{dir}
+
+	fake := &fakeBackend{changes: map[string]*GerritChange{
+		"c1": {ID: "1", Updated: "t1", Subject: "one"},
+		"c2": {ID: "2", Updated: "t1", Subject: "two"},
+	}}
+	commits := []string{"c1", "c2"}
+	query := func(b *cachedBackend) []*GerritChange {
+		t.Helper()
+		var out []*GerritChange
+		for _, q := range b.Query("b", "u", commits) {
+			results, err := q.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 {
+				t.Fatalf("got %d results for %s, want 1", len(results), q.query)
+			}
+			out = append(out, results[0])
+		}
+		return out
+	}
+
+	// Fill the cache.
+	query(&cachedBackend{Backend: fake, cache: cache})
+	if fake.queries != 2 {
+		t.Errorf("made %d queries to fill cache, want 2", fake.queries)
+	}
+
+	// Only changes that were updated are fetched again.
+	fake.changes["c2"] = &GerritChange{ID: "2", Updated: "t2", Subject: "two v2"}
+	fake.queries = 0
+	got := query(&cachedBackend{Backend: fake, cache: cache})
+	if fake.queries != 1 {
+		t.Errorf("made %d queries with warm cache, want 1", fake.queries)
+	}
+	if got[0].Subject != "one" || got[1].Subject != "two v2" {
+		t.Errorf("got subjects %q, %q, want one, two v2", got[0].Subject, got[1].Subject)
+	}
+
+	// Offline and when the server fails, changes come from the
+	// cache.
+	fake.err = errors.New("server down")
+	for _, offline := range []bool{true, false} {
+		got = query(&cachedBackend{Backend: fake, cache: cache, offline: offline})
+		if got[0].Subject != "one" || got[1].Subject != "two v2" {
+			t.Errorf("offline=%v: got subjects %q, %q, want one, two v2", offline, got[0].Subject, got[1].Subject)
+		}
+	}
+}
@@ -44,6 +44,7 @@ type GerritMessage struct {
 	Message  string
 	PatchSet int `json:"_revision_number"`
 	Tag      string
+	Date     string
 }
 
 // GerritLabel is the JSON struct for a Gerrit LabelInfo.
@@ -74,6 +75,14 @@ type GerritApproval struct {
 type GerritRevision struct {
 	Number int `json:"_number"`
 	Ref    string
+	Commit *GerritCommit
+}
+
+// GerritCommit is the JSON struct for a Gerrit CommitInfo.
+type GerritCommit struct {
+	Commit  string
+	Parents []*GerritCommit
+	Subject string
 }
 
 type Gerrit struct {
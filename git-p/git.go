@@ -88,7 +88,7 @@ func gitPatchID(commit string) (string, error) {
 	}
 	patchID.Stdin, diffTree.Stdout = r, w
 	if err := diffTree.Start(); err != nil {
-		log.Fatal("failed to start %s: ", shellEscapeList(diffTree.Args), err)
+		log.Fatalf("failed to start %s: %s", shellEscapeList(diffTree.Args), err)
 	}
 	w.Close()
 	out, err := patchID.Output()
@@ -104,7 +104,7 @@ func gitPatchID(commit string) (string, error) {
 	}
 	fs := bytes.Fields(out)
 	if len(fs) != 2 {
-		log.Fatal("unexpected output from %s: %s", shellEscapeList(patchID.Args), out)
+		log.Fatalf("unexpected output from %s: %s", shellEscapeList(patchID.Args), out)
 	}
 	return string(fs[0]), nil
 }
@@ -188,7 +188,7 @@ func changeIds(project, forBranch string, commits []string) []string {
 			continue
 		}
 		if fs[1] != "commit" {
-			log.Fatal("unexpected object type %q for %s", fs[1], fs[0])
+			log.Fatalf("unexpected object type %q for %s", fs[1], fs[0])
 		}
 
 		// Get commit object.
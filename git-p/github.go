@@ -0,0 +1,367 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GitHub is a review backend for GitHub-compatible APIs, including
+// Gitea. Each branch is a pull request, found by the name of its head
+// branch. Local commits are matched with the pull request's commits by
+// hash or, if they were amended, by patch ID. Local commits that don't
+// match any commit of the pull request haven't been mailed.
+//
+// Pull request state is translated into Gerrit terms: reviews that
+// approve or request changes become Code-Review votes, review comments
+// on the head commit become messages on the latest patch set, and the
+// combined commit status of the head commit becomes the TryBot result.
+type GitHub struct {
+	api     string // API base URL
+	project string // owner/repo
+	token   string
+	client  *http.Client
+}
+
+// NewGitHub returns a GitHub backend for project ("owner/repo") using
+// the API at api. If token is non-empty, it is used to authenticate.
+func NewGitHub(api, project, token string) *GitHub {
+	return &GitHub{strings.TrimSuffix(api, "/"), project, token, http.DefaultClient}
+}
+
+// githubPull is the JSON struct for a GitHub pull request.
+type githubPull struct {
+	Number    int
+	Title     string
+	State     string // "open" or "closed"
+	Draft     bool
+	Merged    bool
+	MergedAt  *string `json:"merged_at"`
+	Mergeable *bool
+	HTMLURL   string `json:"html_url"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	User      *githubUser
+	Head      struct {
+		Ref string
+		SHA string
+	}
+	Base struct {
+		Ref string
+	}
+}
+
+// githubUser is the JSON struct for a GitHub user.
+type githubUser struct {
+	Login string
+	Name  string
+	Email string
+}
+
+// githubCommit is the JSON struct for a commit in a pull request.
+type githubCommit struct {
+	SHA string
+}
+
+// githubReview is the JSON struct for a pull request review.
+type githubReview struct {
+	User        *githubUser
+	State       string // APPROVED, CHANGES_REQUESTED, COMMENTED, ...
+	Body        string
+	CommitID    string `json:"commit_id"`
+	SubmittedAt string `json:"submitted_at"`
+}
+
+// githubStatus is the JSON struct for a combined commit status.
+type githubStatus struct {
+	State      string // success, failure, error, or pending
+	TotalCount int    `json:"total_count"`
+	Statuses   []struct {
+		Context     string
+		State       string
+		Description string
+	}
+}
+
+func (g *GitHub) get(path string, v interface{}) error {
+	u := g.api + path
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "token "+g.token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: malformed json response: %s", u, err)
+	}
+	return nil
+}
+
+func (g *GitHub) Query(branch, upstream string, commits []string) []*GerritChanges {
+	reqs := make([]*GerritChanges, len(commits))
+	for i := range reqs {
+		reqs[i] = &GerritChanges{query: branch, done: make(chan struct{})}
+	}
+	go func() {
+		changes, err := g.branchChanges(strings.TrimPrefix(branch, "refs/heads/"), commits)
+		for i, req := range reqs {
+			if err != nil {
+				req.err = err
+			} else if changes[i] != nil {
+				req.result = []*GerritChange{changes[i]}
+			}
+			close(req.done)
+		}
+	}()
+	return reqs
+}
+
+func (g *GitHub) Keys(branch, upstream string, commits []string) []string {
+	keys := make([]string, len(commits))
+	for i, commit := range commits {
+		keys[i] = fmt.Sprintf("%s %s %s", g.project, strings.TrimPrefix(branch, "refs/heads/"), commit)
+	}
+	return keys
+}
+
+// findPull returns the most recently updated pull request from branch,
+// or nil if there is none.
+func (g *GitHub) findPull(branch string) (*githubPull, error) {
+	// The head filter only matches branches in a particular
+	// owner's repository, and Gitea doesn't support it, so filter
+	// locally. This only considers the most recently updated
+	// pull requests.
+	var pulls []*githubPull
+	if err := g.get("/repos/"+g.project+"/pulls?state=all&sort=updated&direction=desc&per_page=100", &pulls); err != nil {
+		return nil, err
+	}
+	for _, pull := range pulls {
+		if pull.Head.Ref == branch {
+			return pull, nil
+		}
+	}
+	return nil, nil
+}
+
+// branchChanges returns the state of the pull request for branch as a
+// GerritChange for each of local, which are commits of branch. Commits
+// that aren't in the pull request have a nil change.
+func (g *GitHub) branchChanges(branch string, local []string) ([]*GerritChange, error) {
+	out := make([]*GerritChange, len(local))
+	pull, err := g.findPull(branch)
+	if pull == nil || err != nil {
+		return out, err
+	}
+
+	// The pull request list doesn't include mergeability.
+	pullPath := fmt.Sprintf("/repos/%s/pulls/%d", g.project, pull.Number)
+	if err := g.get(pullPath, pull); err != nil {
+		return nil, err
+	}
+	var commits []*githubCommit
+	if err := g.get(pullPath+"/commits?per_page=100", &commits); err != nil {
+		return nil, err
+	}
+	var reviews []*githubReview
+	if err := g.get(pullPath+"/reviews?per_page=100", &reviews); err != nil {
+		return nil, err
+	}
+	var status githubStatus
+	if err := g.get("/repos/"+g.project+"/commits/"+pull.Head.SHA+"/status", &status); err != nil {
+		return nil, err
+	}
+
+	change := pullChange(pull, reviews, &status)
+	for i, sha := range matchCommits(local, commits) {
+		if sha == "" {
+			continue
+		}
+		c := *change
+		c.CurrentRevision = sha
+		c.Revisions = map[string]*GerritRevision{c.CurrentRevision: {Number: 1}}
+		if sha != pull.Head.SHA {
+			// Only report review comments once, on the
+			// head commit. CI results apply to them all.
+			c.Messages = nil
+			for _, msg := range change.Messages {
+				if msg.Author.Email == botEmail {
+					c.Messages = append(c.Messages, msg)
+				}
+			}
+		}
+		out[i] = &c
+	}
+	return out, nil
+}
+
+// matchCommits returns the hash of the commit in pull that matches
+// each of local, or "" if there is none. A local commit matches a
+// commit with the same hash or, failing that, with the same patch ID.
+// Each commit in pull matches at most one local commit.
+func matchCommits(local []string, pull []*githubCommit) []string {
+	out := make([]string, len(local))
+	unused := make(map[string]bool)
+	for _, c := range pull {
+		unused[c.SHA] = true
+	}
+	for i, commit := range local {
+		if unused[commit] {
+			out[i] = commit
+			delete(unused, commit)
+		}
+	}
+
+	// Match the remaining commits by patch ID. This only works
+	// for pull request commits that have been fetched.
+	var byPatchID map[string]string
+	for i, commit := range local {
+		if out[i] != "" || len(unused) == 0 {
+			continue
+		}
+		if byPatchID == nil {
+			byPatchID = make(map[string]string)
+			for _, c := range pull {
+				if !unused[c.SHA] {
+					continue
+				}
+				if pid, err := gitPatchID(c.SHA); err == nil {
+					byPatchID[pid] = c.SHA
+				}
+			}
+		}
+		pid, err := gitPatchID(commit)
+		if err != nil {
+			continue
+		}
+		if sha := byPatchID[pid]; sha != "" && unused[sha] {
+			out[i] = sha
+			delete(unused, sha)
+		}
+	}
+	return out
+}
+
+// pullChange translates the state of a pull request into a
+// GerritChange. The result has no revisions.
+func pullChange(pull *githubPull, reviews []*githubReview, status *githubStatus) *GerritChange {
+	change := &GerritChange{
+		ID:        pull.HTMLURL,
+		Subject:   pull.Title,
+		Branch:    pull.Base.Ref,
+		Created:   pull.CreatedAt,
+		Updated:   pull.UpdatedAt,
+		Number:    pull.Number,
+		Labels:    make(map[string]*GerritLabel),
+		Mergeable: pull.Mergeable != nil && *pull.Mergeable,
+	}
+	if pull.User != nil {
+		change.Owner = githubAccount(pull.User)
+	}
+	switch {
+	case pull.Merged || pull.MergedAt != nil:
+		change.Status = "MERGED"
+	case pull.State == "closed":
+		change.Status = "ABANDONED"
+	case pull.Draft:
+		change.Status = "DRAFT"
+	default:
+		change.Status = "NEW"
+	}
+
+	// Each reviewer's latest approval or change request is their
+	// vote.
+	votes := make(map[string]*githubReview)
+	var voters []string
+	for _, r := range reviews {
+		if r.User == nil {
+			continue
+		}
+		switch r.State {
+		case "APPROVED", "CHANGES_REQUESTED", "DISMISSED":
+			if votes[r.User.Login] == nil {
+				voters = append(voters, r.User.Login)
+			}
+			votes[r.User.Login] = r
+		}
+		if r.CommitID == pull.Head.SHA && r.Body != "" {
+			change.Messages = append(change.Messages, &GerritMessage{
+				Author:   githubAccount(r.User),
+				Message:  r.Body,
+				PatchSet: 1,
+				Date:     r.SubmittedAt,
+			})
+		}
+	}
+	cr := &GerritLabel{}
+	for _, login := range voters {
+		r := votes[login]
+		switch r.State {
+		case "APPROVED":
+			cr.Approved = githubAccount(r.User)
+		case "CHANGES_REQUESTED":
+			cr.Rejected = githubAccount(r.User)
+		}
+	}
+	change.Labels["Code-Review"] = cr
+
+	// Commit statuses play the role of TryBots. Like on Gerrit,
+	// these labels don't make a change "Rejected".
+	if status.TotalCount > 0 {
+		ci := &GerritAccount{Name: "CI", Email: botEmail}
+		switch status.State {
+		case "success":
+			change.Labels["TryBot-Result"] = &GerritLabel{Approved: ci, Optional: true}
+		case "failure", "error":
+			change.Labels["TryBot-Result"] = &GerritLabel{Rejected: ci, Optional: true}
+			var msg strings.Builder
+			for _, s := range status.Statuses {
+				if s.State == "failure" || s.State == "error" {
+					fmt.Fprintf(&msg, "Failed on %s: %s\n", s.Context, s.Description)
+				}
+			}
+			change.Messages = append(change.Messages, &GerritMessage{
+				Author:   ci,
+				Message:  msg.String(),
+				PatchSet: 1,
+			})
+		case "pending":
+			change.Labels["Run-TryBot"] = &GerritLabel{Approved: ci, Optional: true}
+		}
+	}
+
+	ciOK := status.TotalCount == 0 || status.State == "success"
+	change.Submittable = change.Status == "NEW" && change.Mergeable && cr.Approved != nil && cr.Rejected == nil && ciOK
+	return change
+}
+
+func githubAccount(u *githubUser) *GerritAccount {
+	name := u.Name
+	if name == "" {
+		name = u.Login
+	}
+	return &GerritAccount{Name: name, Email: u.Email, Username: u.Login}
+}
+
+func (g *GitHub) Link(change *GerritChange) string {
+	// The ID is the pull request's web URL.
+	return strings.TrimPrefix(strings.TrimPrefix(change.ID, "https://"), "http://")
+}
+
+func (g *GitHub) ReviewBranches() bool {
+	return true
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// fakeGitHub serves a GitHub API with one pull request from branch
+// "feature" with commits c1 and c2.
+func fakeGitHub(t *testing.T, status string) *httptest.Server {
+	responses := map[string]string{
+		"/repos/owner/repo/pulls": `[
+			{"number": 3, "head": {"ref": "other", "sha": "x1"}},
+			{"number": 7, "title": "add feature", "state": "open", "html_url": "https://github.com/owner/repo/pull/7",
+			 "head": {"ref": "feature", "sha": "c2"}, "base": {"ref": "master"}}
+		]`,
+		"/repos/owner/repo/pulls/7": `{"number": 7, "title": "add feature", "state": "open", "mergeable": true,
+			"html_url": "https://github.com/owner/repo/pull/7",
+			"head": {"ref": "feature", "sha": "c2"}, "base": {"ref": "master"}}`,
+		"/repos/owner/repo/pulls/7/commits": `[{"sha": "c1"}, {"sha": "c2"}]`,
+		"/repos/owner/repo/pulls/7/reviews": `[
+			{"user": {"login": "alice"}, "state": "APPROVED", "commit_id": "c1"},
+			{"user": {"login": "bob"}, "state": "CHANGES_REQUESTED", "commit_id": "c1", "body": "no"},
+			{"user": {"login": "bob"}, "state": "APPROVED", "commit_id": "c2"},
+			{"user": {"login": "carol"}, "state": "COMMENTED", "commit_id": "c2", "body": "nit"}
+		]`,
+		"/repos/owner/repo/commits/c2/status": status,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "token secret" {
+			t.Errorf("%s: got Authorization %q", r.URL.Path, got)
+		}
+		resp, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(resp))
+	}))
+}
+
+func TestGitHub(t *testing.T) {
+	srv := fakeGitHub(t, `{"state": "failure", "total_count": 2, "statuses": [
+		{"context": "ci/linux", "state": "failure", "description": "tests failed"},
+		{"context": "ci/mac", "state": "success"}
+	]}`)
+	defer srv.Close()
+	g := NewGitHub(srv.URL, "owner/repo", "secret")
+
+	// c3 is a local commit that hasn't been pushed, and c0 is
+	// from upstream.
+	changes, err := g.branchChanges("feature", []string{"c3", "c2", "c1", "c0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[0] != nil || changes[1] == nil || changes[2] == nil || changes[3] != nil {
+		t.Fatalf("got changes %v, want changes for c2 and c1", changes)
+	}
+	for i, want := range []string{"", "c2", "c1", ""} {
+		if changes[i] == nil {
+			continue
+		}
+		if got := changes[i].CurrentRevision; got != want {
+			t.Errorf("commit %d: got revision %s, want %s", i, got, want)
+		}
+	}
+	if got, want := g.Link(changes[1]), "github.com/owner/repo/pull/7"; got != want {
+		t.Errorf("got link %s, want %s", got, want)
+	}
+
+	status, warnings := changeStatus("c2", changes[1])
+	wantWarnings := []string{"1 comment on latest PS from carol", "TryBots failed on ci/linux"}
+	if status != "Pending" || !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("got %s %q, want Pending %q", status, warnings, wantWarnings)
+	}
+	// Comments are only reported on the head commit.
+	status, warnings = changeStatus("c1", changes[2])
+	wantWarnings = []string{"TryBots failed on ci/linux"}
+	if status != "Pending" || !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("got %s %q, want Pending %q", status, warnings, wantWarnings)
+	}
+
+	// Branches without pull requests aren't mailed.
+	changes, err = g.branchChanges("unknown", []string{"c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[0] != nil {
+		t.Errorf("got change %+v for unknown branch, want nil", changes[0])
+	}
+}
+
+func TestGitHubReady(t *testing.T) {
+	srv := fakeGitHub(t, `{"state": "success", "total_count": 1, "statuses": [{"context": "ci", "state": "success"}]}`)
+	defer srv.Close()
+	g := NewGitHub(srv.URL, "owner/repo", "secret")
+
+	reqs := g.Query("refs/heads/feature", "refs/remotes/origin/master", []string{"c2"})
+	results, err := reqs[0].Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	status, warnings := changeStatus("c2", results[0])
+	if status != "Ready" || len(warnings) != 1 {
+		t.Errorf("got %s %q, want Ready with one comment", status, warnings)
+	}
+}
+
+func TestMatchCommits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-p-match-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// Make commits a, b, and c, and b2, which is b with a
+	// different message.
+	commit := func(file, msg string) string {
+		t.Helper()
+		if err := ioutil.WriteFile(file, []byte(file), 0666); err != nil {
+			t.Fatal(err)
+		}
+		git("add", file)
+		git("-c", "user.name=x", "-c", "user.email=x@x", "commit", "-q", "-m", msg)
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "-q")
+	a := commit("a", "a")
+	b := commit("b", "b")
+	c := commit("c", "c")
+	git("reset", "-q", "--hard", a)
+	b2 := commit("b", "b, amended")
+
+	pull := []*githubCommit{{SHA: a}, {SHA: b}, {SHA: c}}
+	got := matchCommits([]string{"x", b2, a}, pull)
+	want := []string{"", b, a}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRemoteProject(t *testing.T) {
+	for remote, want := range map[string]string{
+		"https://go.googlesource.com/go":    "go",
+		"https://github.com/owner/repo.git": "owner/repo",
+		"git@github.com:owner/repo.git":     "owner/repo",
+		"ssh://git@gitea.example/owner/r":   "owner/r",
+	} {
+		if got := remoteProject(remote); got != want {
+			t.Errorf("remoteProject(%q) = %q, want %q", remote, got, want)
+		}
+	}
+}
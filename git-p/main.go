@@ -22,6 +22,13 @@
 //
 // * It checks if the trybots are sad or weren't run.
 //
+// git-p also understands stacks of branches. If a branch builds on
+// another local branch, it only shows the branch's own commits and
+// notes which branch it is stacked on. If the lower branch has been
+// amended, or lower CLs have been submitted or amended on the review
+// server, git-p warns that the branch needs to be restacked and
+// prints the git rebase --onto command that does it.
+//
 // The output is color-coded by status: green indicates a CL is
 // submittable and has no warnings, yellow indicates a CL has
 // warnings, and red indicates a CL has been rejected. Submitted CLs
@@ -29,7 +36,36 @@
 //
 // git-p uses the git pager if one is configured.
 //
-// Currently git-p only supports the main Go repository.
+// git-p caches the review state of each change in the git directory.
+// Changes that haven't been updated since they were cached aren't
+// fetched again, and if the review server can't be reached, git-p
+// shows the cached state. With -l, git-p doesn't wait for the review
+// server: it shows the cached state and refreshes the cache in the
+// background for next time. With -comments, git-p shows the cached
+// review messages of each commit.
+//
+// With -json, git-p prints the status of each branch as a JSON object
+// on its own line, for use by other tools. With -watch, git-p prints
+// the status once and then polls for changes, printing a line
+// whenever a commit's status changes or it gains or loses warnings,
+// such as when TryBots finish or a reviewer comments. Combined with
+// -json, these transitions are also printed as JSON objects, which
+// have a Commit field instead of a Commits field.
+//
+// By default, git-p reviews the main Go repository on Gerrit. To use
+// it with another repository, set the review remote URL in git config
+// p.remote. For Gerrit, also set the review server URL in p.server,
+// and the Gerrit project name in p.project if it isn't the path of
+// the remote URL.
+//
+// git-p also supports GitHub-style pull requests, including on
+// Gitea, with git config p.backend set to "github". Each branch is
+// matched with the pull request from the branch of the same name, and
+// the pull request's reviews and commit statuses are shown like
+// Gerrit votes and TryBot results. p.server is the API URL, which
+// defaults to https://api.github.com, and p.project is "owner/repo",
+// which defaults to the path of the remote URL. If git config p.token
+// or $GITHUB_TOKEN is set, it is used to authenticate to the API.
 //
 // Example output
 //
@@ -61,6 +97,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -69,13 +106,8 @@ import (
 	"regexp"
 	"strings"
 	"unicode/utf8"
-)
 
-const (
-	// TODO: Support other repos.
-	remoteUrl = "https://go.googlesource.com/go"
-	project   = "go"
-	gerritUrl = "https://go-review.googlesource.com"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 func main() {
@@ -86,7 +118,21 @@ func main() {
 	}
 	defIgnore, _ := tryGit("config", "p.ignore")
 	flagIgnore := flag.String("ignore", defIgnore, "ignore branches matching shell `pattern` [git config p.ignore]")
-	flagLocal := flag.Bool("l", false, "local state only; don't query Gerrit")
+	flagLocal := flag.Bool("l", false, "local state only; show cached reviews and refresh them in the background")
+	flagComments := flag.Bool("comments", false, "show cached review comments")
+	flagRefresh := flag.Bool("refresh", false, "update the review cache and exit")
+	flagJSON := flag.Bool("json", false, "print status as JSON")
+	flagWatch := flag.Duration("watch", 0, "poll for changes every `interval` and print status transitions")
+	var cfg Config
+	cfg.Backend, _ = tryGit("config", "p.backend")
+	cfg.Remote, _ = tryGit("config", "p.remote")
+	cfg.Project, _ = tryGit("config", "p.project")
+	cfg.Server, _ = tryGit("config", "p.server")
+	cfg.Token, _ = tryGit("config", "p.token")
+	flag.StringVar(&cfg.Backend, "backend", cfg.Backend, "review `system`: gerrit or github [git config p.backend]")
+	flag.StringVar(&cfg.Remote, "remote", cfg.Remote, "`url` of the reviewed git remote [git config p.remote]")
+	flag.StringVar(&cfg.Project, "project", cfg.Project, "`name` of the project on the review server [git config p.project]")
+	flag.StringVar(&cfg.Server, "server", cfg.Server, "`url` of the review server or API [git config p.server]")
 	flag.Parse()
 	branches := flag.Args()
 	ignores := strings.Fields(*flagIgnore)
@@ -107,27 +153,79 @@ func main() {
 		}
 	}
 
-	if !setupPager() {
+	if *flagJSON || *flagWatch != 0 || *flagRefresh {
+		// Output is consumed as it's produced, so don't page
+		// it.
+		if *flagJSON || !terminal.IsTerminal(1) {
+			style = nil
+		}
+	} else if !setupPager() {
 		// We're in a dumb terminal. Turn off control codes.
 		style = nil
 	}
 
-	// Find the Gerrit remote name.
-	remote, err := getRemote(remoteUrl)
+	review, err := NewBackend(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	cache := openCache()
+	offline := (*flagLocal || *flagComments) && !*flagRefresh
+	backend := &cachedBackend{Backend: review, cache: cache, offline: offline}
 
-	// Get commits that are available from the Gerrit remote.
-	upstreams := lines(git("for-each-ref", "--format", "%(objectname)", "refs/remotes/"+remote+"/"))
+	// Find the review remote name.
+	remote, err := getRemote(cfg.Remote)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagRefresh {
+		listBranches(backend, false, remote, branches, ignores, func(*branchStatus) {})
+		return
+	}
+
+	show := printBranch
+	if *flagComments {
+		show = printComments
+	} else if *flagJSON {
+		enc := json.NewEncoder(os.Stdout)
+		show = func(b *branchStatus) {
+			if err := enc.Encode(b); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	list := func(show func(*branchStatus)) {
+		listBranches(backend, offline, remote, branches, ignores, show)
+	}
+	if *flagWatch != 0 {
+		watch(*flagWatch, list, show, *flagJSON)
+	}
+	list(show)
+	if *flagLocal {
+		cache.startRefresh(os.Args[1:])
+	}
+}
+
+// listBranches gets the status of branches, or all local branches not
+// matching ignores if branches is empty, and passes each to show in
+// order.
+func listBranches(backend Backend, local bool, remote string, branches, ignores []string, show func(*branchStatus)) {
+	// Get commits that are available from the review remote.
+	upstreams := make(map[string]string)
+	for _, line := range lines(git("for-each-ref", "--format", "%(refname) %(objectname)", "refs/remotes/"+remote+"/")) {
+		fs := strings.Fields(line)
+		upstreams[fs[0]] = fs[1]
+	}
 	if len(upstreams) == 0 {
 		log.Fatalf("no refs for remote %s", remote)
 	}
 
-	var gerrit *Gerrit
-	if !*flagLocal {
-		gerrit = NewGerrit(gerritUrl)
+	// Find how branches are stacked on each other.
+	reviewPrefix := ""
+	if backend.ReviewBranches() {
+		reviewPrefix = "refs/remotes/" + remote + "/"
 	}
+	stacks := loadStacks(upstreams, reviewPrefix)
 
 	// Pass a token through each showBranch so we can pipeline
 	// fetching branch information, while displaying it in order.
@@ -144,7 +242,7 @@ func main() {
 		// Resolve HEAD and show it first regardless of age.
 		head, _ = tryGit("symbolic-ref", "HEAD")
 		if head != "" {
-			token = showBranch(gerrit, head, "HEAD", remote, upstreams, token, limit)
+			token = showBranch(backend, stacks, local, head, true, remote, upstreams, show, token, limit)
 		}
 
 		// Get all local branches, sorted by most recent commit date.
@@ -172,13 +270,44 @@ func main() {
 		if branch == head {
 			continue
 		}
-		token = showBranch(gerrit, branch, "", remote, upstreams, token, limit)
+		token = showBranch(backend, stacks, local, branch, false, remote, upstreams, show, token, limit)
 	}
 
 	<-token
 }
 
-func showBranch(gerrit *Gerrit, branch, extra string, remote string, upstreams []string, token, limit chan struct{}) chan struct{} {
+// branchStatus is the status of a branch and its pending commits.
+type branchStatus struct {
+	Branch    string
+	Head      bool   `json:",omitempty"` // Branch is checked out
+	Upstream  string `json:",omitempty"` // Configured upstream branch
+	StackedOn string `json:",omitempty"` // Local branch this builds on
+	StaleBase bool   `json:",omitempty"` // StackedOn has been amended
+	Commits   []*commitStatus
+	Restacks  []*restack `json:",omitempty"`
+}
+
+// commitStatus is the status of a pending commit.
+type commitStatus struct {
+	Commit   string
+	Subject  string
+	Status   string                  `json:",omitempty"` // "" in local mode
+	Warnings []string                `json:",omitempty"`
+	CL       int                     `json:",omitempty"`
+	Link     string                  `json:",omitempty"`
+	Labels   map[string]*labelStatus `json:",omitempty"`
+
+	oneline string        // Abbreviated hash and subject
+	change  *GerritChange // Review, or nil
+}
+
+// labelStatus is the state of a review label.
+type labelStatus struct {
+	Approved string `json:",omitempty"` // Name of approver
+	Rejected string `json:",omitempty"` // Name of rejecter
+}
+
+func showBranch(backend Backend, stacks *stacks, local bool, branch string, head bool, remote string, upstreams map[string]string, show func(*branchStatus), token, limit chan struct{}) chan struct{} {
 	// Don't start too many showBranches.
 	limit <- struct{}{}
 
@@ -201,55 +330,97 @@ func showBranch(gerrit *Gerrit, branch, extra string, remote string, upstreams [
 	// just once, do limited rev-lists, and cut them off at the
 	// exclusion set.
 	args := []string{"rev-list", branch}
-	for _, u := range upstreams {
+	for ref, u := range upstreams {
+		if backend.ReviewBranches() && ref == "refs/remotes/"+remote+"/"+strings.TrimPrefix(branch, "refs/heads/") {
+			// This is the branch under review, not
+			// upstream.
+			continue
+		}
 		args = append(args, "^"+u)
 	}
 	args = append(args, "--")
 	commits := lines(git(args...))
 
-	// Get Change-Ids from these commits.
-	cids := changeIds(project, upstream, commits)
-
-	// Fetch information on all of these changes.
-	//
-	// We need DETAILED_LABELS to get numeric values of labels.
-	changes := make([]*GerritChanges, len(cids))
-	if gerrit != nil {
-		for i, cid := range cids {
-			// TODO: Would this be simpler with a single big OR query?
-			if cid != "" {
-				changes[i] = gerrit.QueryChanges("change:"+cid, printChangeOptions...)
-			}
-		}
-	}
+	// Fetch review information on all of these commits.
+	changes := backend.Query(branch, upstream, commits)
 
 	if len(changes) == 0 {
 		<-limit
 		return token
 	}
 
+	// If this branch is stacked on another branch, only show its
+	// own commits.
+	base := stacks.base(git("rev-parse", branch))
+	shown := commits
+	if base != nil {
+		for i, commit := range commits {
+			if commit == base.commit {
+				shown = commits[:i]
+				break
+			}
+		}
+	}
+
 	done := make(chan struct{})
 	go func() {
-		<-token
-		// Print changes.
-		fmt.Printf("%s%s%s", style["branch"], strings.TrimPrefix(branch, "refs/heads/"), style["reset"])
-		if extra != "" {
-			fmt.Printf(" (%s%s%s)", style["symbolic-ref"], extra, style["reset"])
-		}
+		b := &branchStatus{Branch: strings.TrimPrefix(branch, "refs/heads/"), Head: head}
 		if haveUpstream {
-			fmt.Printf(" for %s", strings.TrimPrefix(upstream, "refs/remotes/"+remote+"/"))
+			b.Upstream = strings.TrimPrefix(upstream, "refs/remotes/"+remote+"/")
 		}
-		fmt.Printf("\n")
+		if base != nil {
+			b.StackedOn = strings.TrimPrefix(base.branch, "refs/heads/")
+			b.StaleBase = base.stale
+		}
+		results := make([]*GerritChange, len(changes))
 		for i, change := range changes {
-			printChange(commits[i], change, gerrit == nil)
+			results[i] = waitChange(commits[i], change)
+			if i < len(shown) {
+				b.Commits = append(b.Commits, commitInfo(backend, commits[i], results[i], local))
+			}
+		}
+		if r := baseRestack(branch, base); r != nil {
+			b.Restacks = append(b.Restacks, r)
 		}
-		fmt.Println()
+		b.Restacks = append(b.Restacks, changeRestacks(backend, branch, upstream, remote, commits, results)...)
+
+		<-token
+		show(b)
 		<-limit
 		done <- struct{}{}
 	}()
 	return done
 }
 
+// printBranch prints the status of a branch and its commits.
+func printBranch(b *branchStatus) {
+	fmt.Printf("%s%s%s", style["branch"], b.Branch, style["reset"])
+	if b.Head {
+		fmt.Printf(" (%sHEAD%s)", style["symbolic-ref"], style["reset"])
+	}
+	if b.Upstream != "" {
+		fmt.Printf(" for %s", b.Upstream)
+	}
+	if b.StackedOn != "" {
+		old := ""
+		if b.StaleBase {
+			old = "old "
+		}
+		fmt.Printf(", stacked on %s%s", old, b.StackedOn)
+	}
+	fmt.Printf("\n")
+	for _, c := range b.Commits {
+		printCommit(c)
+	}
+	for _, r := range b.Restacks {
+		printRestack(r)
+	}
+	fmt.Println()
+}
+
+// botEmail is the account that posts TryBot results.
+const botEmail = "gobot@golang.org"
+
 var labelMsg = regexp.MustCompile(`^Patch Set [0-9]+: [-a-zA-Z]+\+[0-9]$`)
 var trybotFailures = regexp.MustCompile(`(?m)^Failed on ([^:]+):`)
 
@@ -310,7 +481,7 @@ func changeStatus(commit string, info *GerritChange) (status string, warnings []
 		}
 		// Ignore TryBot comments (Requires
 		// DETAILED_ACCOUNTS option.)
-		if msg.Author.Email == "gobot@golang.org" {
+		if msg.Author.Email == botEmail {
 			continue
 		}
 		nComments++
@@ -336,7 +507,7 @@ func changeStatus(commit string, info *GerritChange) (status string, warnings []
 			if msg.PatchSet != curPatchSet {
 				continue
 			}
-			if msg.Author == nil || msg.Author.Email != "gobot@golang.org" {
+			if msg.Author == nil || msg.Author.Email != botEmail {
 				continue
 			}
 			for _, f := range trybotFailures.FindAllStringSubmatch(msg.Message, -1) {
@@ -382,30 +553,93 @@ func changeStatus(commit string, info *GerritChange) (status string, warnings []
 	return status, warnings
 }
 
-var printChangeOptions = []string{"SUBMITTABLE", "LABELS", "CURRENT_REVISION", "MESSAGES", "DETAILED_ACCOUNTS"}
+var printChangeOptions = []string{"SUBMITTABLE", "LABELS", "CURRENT_REVISION", "CURRENT_COMMIT", "MESSAGES", "DETAILED_ACCOUNTS"}
+
+// waitChange waits for the result of query, the review of commit. It
+// returns nil if commit hasn't been mailed.
+func waitChange(commit string, query *GerritChanges) *GerritChange {
+	if query == nil {
+		return nil
+	}
+	results, err := query.Wait()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(results) > 1 {
+		log.Fatalf("multiple changes found for commit %s", commit)
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return results[0]
+}
 
-// printChange prints a summary of change's status and warnings.
+// commitInfo returns the status of commit, where change is its
+// review, or nil if it hasn't been mailed.
 //
 // change must be retrieved with options printChangeOptions.
-func printChange(commit string, change *GerritChanges, local bool) {
-	logMsg := git("log", "-n1", "--oneline", commit)
-
-	status, warnings, link := "Not mailed", []string(nil), ""
+func commitInfo(backend Backend, commit string, change *GerritChange, local bool) *commitStatus {
+	logMsg := git("log", "-n1", "--format=%h %s", commit)
+	c := &commitStatus{Commit: commit, Status: "Not mailed", oneline: logMsg, change: change}
+	if i := strings.IndexByte(logMsg, ' '); i >= 0 {
+		c.Subject = logMsg[i+1:]
+	}
 	if change != nil {
-		results, err := change.Wait()
-		if err != nil {
-			log.Fatal(err)
+		c.Status, c.Warnings = changeStatus(commit, change)
+		c.CL = change.Number
+		c.Link = backend.Link(change)
+		c.Labels = make(map[string]*labelStatus)
+		for name, label := range change.Labels {
+			l := &labelStatus{}
+			if label.Approved != nil {
+				l.Approved = label.Approved.Name
+			}
+			if label.Rejected != nil {
+				l.Rejected = label.Rejected.Name
+			}
+			c.Labels[name] = l
 		}
-		if len(results) > 1 {
-			log.Fatal("multiple changes found for commit %s", commit)
+	} else if local {
+		c.Status = ""
+	}
+	return c
+}
+
+// printComments prints the review messages of each commit on a branch.
+func printComments(b *branchStatus) {
+	fmt.Printf("%s%s%s\n", style["branch"], b.Branch, style["reset"])
+	for _, c := range b.Commits {
+		if c.change == nil {
+			continue
 		}
-		if len(results) == 1 {
-			status, warnings = changeStatus(commit, results[0])
-			//link = fmt.Sprintf("[%s/c/%d]", gerritUrl, results[0].Number)
-			link = fmt.Sprintf(" [golang.org/cl/%d]", results[0].Number)
+		fmt.Printf("  %s [%s]\n", c.oneline, c.Link)
+		for _, msg := range c.change.Messages {
+			if msg.Author == nil || strings.HasPrefix(msg.Tag, "autogenerated:gerrit:") {
+				continue
+			}
+			date := msg.Date
+			if len(date) > 16 {
+				// Trim seconds.
+				date = date[:16]
+			}
+			fmt.Printf("    %s%s%s, patch set %d, %s\n", style["author"], msg.Author.Name, style["reset"], msg.PatchSet, date)
+			for _, line := range strings.Split(strings.TrimRight(msg.Message, "\n"), "\n") {
+				if line == "" {
+					fmt.Println()
+				} else {
+					fmt.Printf("      %s\n", line)
+				}
+			}
 		}
-	} else if local {
-		status = ""
+	}
+	fmt.Println()
+}
+
+// printCommit prints a summary of a commit's status and warnings.
+func printCommit(c *commitStatus) {
+	status, warnings, link := c.Status, c.Warnings, ""
+	if c.Link != "" {
+		link = fmt.Sprintf(" [%s]", c.Link)
 	}
 
 	var control, eControl string
@@ -423,9 +657,9 @@ func printChange(commit string, change *GerritChanges, local bool) {
 		eControl = style["reset"]
 	}
 
-	hdr := logMsg
+	hdr := c.oneline
 	if status != "" {
-		hdr = fmt.Sprintf("%-10s %s", status, logMsg)
+		hdr = fmt.Sprintf("%-10s %s", status, c.oneline)
 	}
 	hdrMax := 80 - len(link) - 2
 	if utf8.RuneCountInString(hdr) > hdrMax {
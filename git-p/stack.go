@@ -0,0 +1,254 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stacks records how local branches build on each other.
+type stacks struct {
+	branches []string               // Local branch refs, sorted
+	tips     map[string]string      // Branch ref → tip commit
+	commits  map[string]*pendCommit // Pending commits of all branches
+	byKey    map[string][]string    // pendCommit.key → commits
+	onBranch map[string][]string    // Commit → branches with it on their chain
+}
+
+// pendCommit is a commit on some local branch that isn't upstream.
+type pendCommit struct {
+	parent string // First parent
+	key    string // Change-Id, or subject if there is none
+}
+
+// A stackBase is the branch another branch is stacked on.
+type stackBase struct {
+	branch string // Full ref of the base branch
+	commit string // Newest commit of the stacked branch from the base
+	stale  bool   // commit is an old version of a commit on branch
+}
+
+// A restack is a warning that a branch needs to be rebased, along
+// with the commands that fix it.
+type restack struct {
+	Message  string
+	Commands [][]string
+}
+
+// loadStacks reads the pending commits of all local branches, which
+// are those not in upstreams. If reviewPrefix is not "", refs named
+// reviewPrefix plus the name of a local branch are copies of that
+// branch under review, so they are not upstream.
+func loadStacks(upstreams map[string]string, reviewPrefix string) *stacks {
+	s := &stacks{
+		tips:     make(map[string]string),
+		commits:  make(map[string]*pendCommit),
+		byKey:    make(map[string][]string),
+		onBranch: make(map[string][]string),
+	}
+	args := []string{"log", "-z", "--format=%H %P%n%B"}
+	for _, line := range lines(git("for-each-ref", "--format", "%(refname) %(objectname)", "refs/heads/")) {
+		fs := strings.Fields(line)
+		s.branches = append(s.branches, fs[0])
+		s.tips[fs[0]] = fs[1]
+		args = append(args, fs[1])
+	}
+	if len(s.branches) == 0 {
+		return s
+	}
+	for ref, u := range upstreams {
+		if reviewPrefix != "" && strings.HasPrefix(ref, reviewPrefix) {
+			if _, ok := s.tips["refs/heads/"+strings.TrimPrefix(ref, reviewPrefix)]; ok {
+				continue
+			}
+		}
+		args = append(args, "^"+u)
+	}
+	args = append(args, "--")
+	for _, rec := range strings.Split(git(args...), "\x00") {
+		hdr, msg := rec, ""
+		if i := strings.IndexByte(rec, '\n'); i >= 0 {
+			hdr, msg = rec[:i], rec[i+1:]
+		}
+		fs := strings.Fields(hdr)
+		if len(fs) == 0 {
+			continue
+		}
+		c := &pendCommit{key: commitKey(msg)}
+		if len(fs) > 1 {
+			c.parent = fs[1]
+		}
+		s.commits[fs[0]] = c
+		s.byKey[c.key] = append(s.byKey[c.key], fs[0])
+	}
+	for _, b := range s.branches {
+		for _, c := range s.chain(s.tips[b]) {
+			s.onBranch[c] = append(s.onBranch[c], b)
+		}
+	}
+	return s
+}
+
+// commitKey returns the key identifying different versions of the
+// same commit with message msg.
+func commitKey(msg string) string {
+	for _, line := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(line, "Change-Id: ") {
+			if fs := strings.Fields(line); len(fs) == 2 {
+				return "Change-Id " + fs[1]
+			}
+		}
+	}
+	subject := msg
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		subject = msg[:i]
+	}
+	return "subject " + subject
+}
+
+// chain returns the pending first-parent ancestors of tip, starting
+// with tip.
+func (s *stacks) chain(tip string) []string {
+	var chain []string
+	for c := tip; s.commits[c] != nil; c = s.commits[c].parent {
+		chain = append(chain, c)
+	}
+	return chain
+}
+
+// on returns whether commit is on branch.
+func (s *stacks) on(branch, commit string) bool {
+	for _, b := range s.onBranch[commit] {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+// hasKey returns whether branch has a commit with key.
+func (s *stacks) hasKey(branch, key string) bool {
+	for _, c := range s.byKey[key] {
+		if s.on(branch, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// base returns the branch that the branch at tip is stacked on, or
+// nil if it isn't stacked on another branch. This is the nearest
+// other branch whose tip is below tip, or whose commits have older
+// versions below tip.
+func (s *stacks) base(tip string) *stackBase {
+	chain := s.chain(tip)
+	for i, c := range chain {
+		if i == 0 {
+			continue
+		}
+		for _, b := range s.branches {
+			if s.tips[b] == c {
+				return &stackBase{b, c, false}
+			}
+		}
+		// Is c an old version of a commit on another branch?
+		for _, d := range s.byKey[s.commits[c].key] {
+			if d == c {
+				continue
+			}
+			for _, b := range s.onBranch[d] {
+				// Ignore branches that contain c and
+				// branches that are just newer
+				// versions of this one.
+				if s.tips[b] == tip || s.on(b, c) || s.hasKey(b, s.commits[tip].key) {
+					continue
+				}
+				return &stackBase{b, c, true}
+			}
+		}
+	}
+	return nil
+}
+
+// baseRestack returns the restack needed because branch is stacked on
+// an old version of base, or nil.
+func baseRestack(branch string, base *stackBase) *restack {
+	if base == nil || !base.stale {
+		return nil
+	}
+	baseName := strings.TrimPrefix(base.branch, "refs/heads/")
+	return &restack{
+		Message:  fmt.Sprintf("%s was amended; rebase with", baseName),
+		Commands: [][]string{{"git", "rebase", "--onto", baseName, base.commit, strings.TrimPrefix(branch, "refs/heads/")}},
+	}
+}
+
+// changeRestacks returns the restacks needed by branch because of the
+// review state of its commits. commits are the pending commits of
+// branch, newest first, and changes are their reviews, or nil for
+// commits that haven't been mailed.
+//
+// changes must be retrieved with options printChangeOptions.
+func changeRestacks(backend Backend, branch, upstream, remote string, commits []string, changes []*GerritChange) []*restack {
+	var out []*restack
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+
+	// Were the lowest CLs submitted?
+	m := 0
+	for i := len(changes) - 1; i >= 0 && changes[i] != nil && changes[i].Status == "MERGED"; i-- {
+		m++
+	}
+	if m > 0 && m < len(changes) {
+		msg := "1 lower CL was submitted; rebase with"
+		if m > 1 {
+			msg = fmt.Sprintf("%d lower CLs were submitted; rebase with", m)
+		}
+		out = append(out, &restack{
+			Message:  msg,
+			Commands: [][]string{{"git", "rebase", "--onto", strings.TrimPrefix(upstream, "refs/remotes/"), commits[len(commits)-m], branch}},
+		})
+	}
+
+	// Were CLs mailed on old patch sets of lower CLs? (Requires
+	// CURRENT_COMMIT option.)
+	for i := 0; i+1 < len(changes); i++ {
+		up, lo := changes[i], changes[i+1]
+		if up == nil || lo == nil || up.ID == lo.ID || up.Status != "NEW" || lo.Status != "NEW" {
+			continue
+		}
+		rev := up.Revisions[up.CurrentRevision]
+		if rev == nil || rev.Commit == nil || len(rev.Commit.Parents) == 0 {
+			continue
+		}
+		parent := rev.Commit.Parents[0].Commit
+		if parent == lo.CurrentRevision {
+			continue
+		}
+		r := &restack{Message: fmt.Sprintf("%s was mailed on an old patch set of %s", backend.Link(up), backend.Link(lo))}
+		loRev := lo.Revisions[lo.CurrentRevision]
+		if parent == commits[i+1] && loRev != nil && loRev.Ref != "" {
+			// The local commit is that old patch set, so
+			// the lower CL was amended elsewhere.
+			r.Message += "; rebase with"
+			r.Commands = [][]string{
+				{"git", "fetch", remote, loRev.Ref},
+				{"git", "rebase", "--onto", "FETCH_HEAD", commits[i+1], branch},
+			}
+		} else {
+			r.Message += "; mail it again"
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// printRestack prints a restack warning and its commands.
+func printRestack(r *restack) {
+	fmt.Printf("  %s%s%s\n", style["restack"], r.Message, style["reset"])
+	for _, cmd := range r.Commands {
+		fmt.Printf("    %s\n", shellEscapeList(cmd))
+	}
+}
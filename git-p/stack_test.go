@@ -0,0 +1,112 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testStacks returns stacks for branches, each of which lists its
+// pending commits oldest first as "commit:key" pairs.
+func testStacks(branches map[string][]string) *stacks {
+	s := &stacks{
+		tips:     make(map[string]string),
+		commits:  make(map[string]*pendCommit),
+		byKey:    make(map[string][]string),
+		onBranch: make(map[string][]string),
+	}
+	for _, b := range []string{"a", "b", "c", "d"} {
+		parent := ""
+		for _, ck := range branches[b] {
+			commit, key := ck[:2], ck[3:]
+			if s.commits[commit] == nil {
+				s.commits[commit] = &pendCommit{parent, key}
+				s.byKey[key] = append(s.byKey[key], commit)
+			}
+			s.onBranch[commit] = append(s.onBranch[commit], b)
+			parent = commit
+		}
+		if parent != "" {
+			s.branches = append(s.branches, b)
+			s.tips[b] = parent
+		}
+	}
+	return s
+}
+
+func TestStackBase(t *testing.T) {
+	s := testStacks(map[string][]string{
+		"a": {"a1:A1", "a2:A2"},
+		// b is stacked on a.
+		"b": {"a1:A1", "a2:A2", "b1:B1"},
+		// c is stacked on an old version of a.
+		"c": {"a1:A1", "x2:A2", "c1:C1", "c2:C2"},
+		// d is an old version of a.
+		"d": {"a1:A1", "y2:A2"},
+	})
+	for _, test := range []struct {
+		branch string
+		want   *stackBase
+	}{
+		{"a", nil},
+		{"b", &stackBase{"a", "a2", false}},
+		{"c", &stackBase{"a", "x2", true}},
+		{"d", nil},
+	} {
+		if got := s.base(s.tips[test.branch]); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("base of %s: got %+v, want %+v", test.branch, got, test.want)
+		}
+	}
+}
+
+func TestChangeRestacks(t *testing.T) {
+	change := func(n int, status, rev, parent string) *GerritChange {
+		return &GerritChange{
+			ID:              string(rune('0' + n)),
+			Number:          n,
+			Status:          status,
+			CurrentRevision: rev,
+			Revisions: map[string]*GerritRevision{rev: {
+				Number: 2,
+				Ref:    "refs/changes/0" + string(rune('0'+n)) + "/2",
+				Commit: &GerritCommit{Parents: []*GerritCommit{{Commit: parent}}},
+			}},
+		}
+	}
+	backend := &gerritBackend{server: defaultServer}
+	commits := []string{"c3", "c2", "c1"}
+
+	// The bottom CL was submitted.
+	changes := []*GerritChange{
+		change(3, "NEW", "c3", "c2"),
+		change(2, "NEW", "c2", "c1"),
+		change(1, "MERGED", "m1", "base"),
+	}
+	got := changeRestacks(backend, "refs/heads/b", "refs/remotes/origin/master", "origin", commits, changes)
+	want := []*restack{{
+		Message:  "1 lower CL was submitted; rebase with",
+		Commands: [][]string{{"git", "rebase", "--onto", "origin/master", "c1", "b"}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("submitted: got %+v, want %+v", got, want)
+	}
+
+	// CL 2 was amended on the server after CL 3 was mailed on
+	// the local version of it.
+	changes[1] = change(2, "NEW", "n2", "c1")
+	changes[2] = change(1, "NEW", "c1", "base")
+	got = changeRestacks(backend, "refs/heads/b", "refs/remotes/origin/master", "origin", commits, changes)
+	want = []*restack{{
+		Message: "golang.org/cl/3 was mailed on an old patch set of golang.org/cl/2; rebase with",
+		Commands: [][]string{
+			{"git", "fetch", "origin", "refs/changes/02/2"},
+			{"git", "rebase", "--onto", "FETCH_HEAD", "c2", "b"},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("amended: got %+v, want %+v", got, want)
+	}
+}
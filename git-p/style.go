@@ -9,6 +9,8 @@ var style = map[string]string{
 
 	"branch":       "\x1b[1;32m", // Bright green
 	"symbolic-ref": "\x1b[1;36m", // Bright cyan
+	"restack":      "\x1b[33m",   // Yellow
+	"author":       "\x1b[1m",    // Bold
 
 	// CL status styles
 
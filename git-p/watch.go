@@ -0,0 +1,142 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// A transition is a change in the status of a commit between polls.
+type transition struct {
+	Time      time.Time
+	Branch    string
+	Commit    string
+	Subject   string
+	Link      string   `json:",omitempty"`
+	OldStatus string   `json:",omitempty"` // "" if the commit is new
+	Status    string   `json:",omitempty"`
+	Added     []string `json:",omitempty"` // New warnings
+	Removed   []string `json:",omitempty"` // Resolved warnings
+
+	oneline string
+}
+
+// watch calls list every interval and reports the transitions of each
+// commit's status. The first time, it passes every branch to show.
+// watch never returns.
+func watch(interval time.Duration, list func(show func(*branchStatus)), show func(*branchStatus), asJSON bool) {
+	enc := json.NewEncoder(os.Stdout)
+	var prev map[string]*commitStatus
+	for {
+		cur := make(map[string]*commitStatus)
+		list(func(b *branchStatus) {
+			if prev == nil {
+				show(b)
+			}
+			seen := make(map[string]int)
+			for _, c := range b.Commits {
+				k := watchKey(b.Branch, c, seen)
+				cur[k] = c
+				if prev == nil {
+					continue
+				}
+				t := diffCommit(b.Branch, prev[k], c)
+				if t == nil {
+					continue
+				}
+				if asJSON {
+					if err := enc.Encode(t); err != nil {
+						log.Fatal(err)
+					}
+				} else {
+					printTransition(t)
+				}
+			}
+		})
+		prev = cur
+		time.Sleep(interval)
+	}
+}
+
+// watchKey returns the key identifying c across polls, so changes
+// remain the same commit when they're amended. seen counts the keys
+// already used on branch, since one review can cover several commits.
+func watchKey(branch string, c *commitStatus, seen map[string]int) string {
+	id := c.Link
+	if id == "" {
+		id = c.Commit
+	}
+	k := fmt.Sprintf("%s %s %d", branch, id, seen[id])
+	seen[id]++
+	return k
+}
+
+// diffCommit returns the transition from old to c, or nil if nothing
+// changed. old is nil if c is a new commit.
+func diffCommit(branch string, old, c *commitStatus) *transition {
+	t := &transition{
+		Time:    time.Now(),
+		Branch:  branch,
+		Commit:  c.Commit,
+		Subject: c.Subject,
+		Link:    c.Link,
+		Status:  c.Status,
+		Added:   c.Warnings,
+		oneline: c.oneline,
+	}
+	if old != nil {
+		t.OldStatus = old.Status
+		t.Added = subtract(c.Warnings, old.Warnings)
+		t.Removed = subtract(old.Warnings, c.Warnings)
+		if t.OldStatus == t.Status && len(t.Added) == 0 && len(t.Removed) == 0 {
+			return nil
+		}
+	}
+	return t
+}
+
+// subtract returns the strings in xs that aren't in ys.
+func subtract(xs, ys []string) []string {
+	var out []string
+outer:
+	for _, x := range xs {
+		for _, y := range ys {
+			if x == y {
+				continue outer
+			}
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// printTransition prints a summary of t.
+func printTransition(t *transition) {
+	link := ""
+	if t.Link != "" {
+		link = fmt.Sprintf(" [%s]", t.Link)
+	}
+	fmt.Printf("%s %s%s%s: %s%s", t.Time.Format("15:04:05"), style["branch"], t.Branch, style["reset"], t.oneline, link)
+	switch {
+	case t.OldStatus == "" && t.Status == "":
+		fmt.Printf(": new\n")
+	case t.OldStatus == "":
+		fmt.Printf(": new, %s\n", t.Status)
+	case t.OldStatus != t.Status:
+		fmt.Printf(": %s → %s%s%s\n", t.OldStatus, style[t.Status], t.Status, style["reset"])
+	default:
+		fmt.Printf("\n")
+	}
+	for _, w := range t.Added {
+		fmt.Printf("    + %s\n", w)
+	}
+	for _, w := range t.Removed {
+		fmt.Printf("    - %s\n", w)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffCommit(t *testing.T) {
+	old := &commitStatus{Commit: "c1", Link: "golang.org/cl/1", Status: "Pending", Warnings: []string{"TryBots failed"}}
+
+	same := *old
+	same.Commit = "c2"
+	if tr := diffCommit("b", old, &same); tr != nil {
+		t.Errorf("got transition %+v for unchanged commit", tr)
+	}
+
+	ready := &commitStatus{Commit: "c1", Link: "golang.org/cl/1", Status: "Ready", Warnings: []string{"1 comment on latest PS from Rick Hudson"}}
+	tr := diffCommit("b", old, ready)
+	if tr == nil {
+		t.Fatal("got no transition")
+	}
+	if tr.OldStatus != "Pending" || tr.Status != "Ready" {
+		t.Errorf("got %s → %s, want Pending → Ready", tr.OldStatus, tr.Status)
+	}
+	if want := ready.Warnings; !reflect.DeepEqual(tr.Added, want) {
+		t.Errorf("got added warnings %q, want %q", tr.Added, want)
+	}
+	if want := old.Warnings; !reflect.DeepEqual(tr.Removed, want) {
+		t.Errorf("got removed warnings %q, want %q", tr.Removed, want)
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	// Commits of one pull request share a link, but must have
+	// different keys.
+	seen := make(map[string]int)
+	k1 := watchKey("b", &commitStatus{Commit: "c2", Link: "github.com/o/r/pull/1"}, seen)
+	k2 := watchKey("b", &commitStatus{Commit: "c1", Link: "github.com/o/r/pull/1"}, seen)
+	if k1 == k2 {
+		t.Errorf("commits of one review have the same key %q", k1)
+	}
+	// Amending a mailed commit keeps its key.
+	seen = make(map[string]int)
+	if k := watchKey("b", &commitStatus{Commit: "c3", Link: "github.com/o/r/pull/1"}, seen); k != k1 {
+		t.Errorf("amended commit has key %q, want %q", k, k1)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package amb
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// StrategyPCT explores a space of thread schedules using
+// probabilistic concurrency testing, as described in Burckhardt, et
+// al., "A Randomized Scheduler with Probabilistic Guarantees of
+// Finding Bugs", ASPLOS 2010.
+//
+// On each path, StrategyPCT assigns each thread a random priority
+// when it is first seen and always runs the highest priority
+// runnable thread. At Depth-1 randomly chosen steps, it drops the
+// priority of the running thread below that of all other threads.
+// For a program with n threads and k scheduling steps, each path
+// finds a given bug of depth Depth with probability at least
+// 1/(n·k^(Depth-1)). The paper does not bound the probability for
+// bugs of other depths, so Depth should match the bugs being sought.
+//
+// Thread choices must be made through AmbThread. Other calls to Amb
+// are resolved uniformly at random, like StrategyRandom.
+type StrategyPCT struct {
+	// Depth specifies the bug depth to target, which is the
+	// number of ordering constraints a schedule must satisfy to
+	// trigger a bug. If this is 0, it defaults to 3.
+	Depth int
+
+	// MaxDepth specifies the maximum depth of the tree. If this
+	// is 0, it defaults to DefaultMaxDepth.
+	MaxDepth int
+
+	// MaxPaths specifies the maximum number of paths to explore.
+	// If this is 0, the number of paths is unbounded.
+	MaxPaths int
+
+	step, paths int
+
+	// threadSteps is the number of AmbThread calls on this path
+	// and maxSteps is the most on any path so far. Change points
+	// are chosen from [0, maxSteps).
+	threadSteps, maxSteps int
+
+	prio    map[int]float64 // Thread ID → priority
+	changes []int           // Steps at which to lower priority, sorted
+}
+
+func (s *StrategyPCT) Reset() {
+	s.step = 0
+	s.paths = 0
+	s.maxSteps = 0
+	s.startPath()
+}
+
+func (s *StrategyPCT) depth() int {
+	if s.Depth == 0 {
+		return 3
+	}
+	return s.Depth
+}
+
+func (s *StrategyPCT) maxDepth() int {
+	if s.MaxDepth == 0 {
+		return DefaultMaxDepth
+	}
+	return s.MaxDepth
+}
+
+// startPath chooses the change points for a new path.
+func (s *StrategyPCT) startPath() {
+	s.threadSteps = 0
+	s.prio = make(map[int]float64)
+	s.changes = s.changes[:0]
+	k := s.maxSteps
+	if k == 0 {
+		// We don't know how long paths are yet.
+		k = s.maxDepth()
+	}
+	for i := 1; i < s.depth(); i++ {
+		s.changes = append(s.changes, rand.Intn(k))
+	}
+	sort.Ints(s.changes)
+}
+
+func (s *StrategyPCT) Amb(n int) (int, bool) {
+	if s.step == s.maxDepth() {
+		return 0, false
+	}
+	s.step++
+	return rand.Intn(n), true
+}
+
+func (s *StrategyPCT) AmbThread(tids []int) (int, bool) {
+	if s.step == s.maxDepth() {
+		return 0, false
+	}
+	s.step++
+
+	// Threads start with priorities in [Depth, Depth+1), so in
+	// a random order above all lowered priorities.
+	best := 0
+	for i, tid := range tids {
+		p, ok := s.prio[tid]
+		if !ok {
+			p = float64(s.depth()) + rand.Float64()
+			s.prio[tid] = p
+		}
+		if p > s.prio[tids[best]] {
+			best = i
+		}
+	}
+
+	// At the i'th of the Depth-1 change points, lower the
+	// priority of the chosen thread to Depth-i and choose again.
+	// Since change points are consumed in order, Depth-i is the
+	// number of change points remaining.
+	for len(s.changes) > 0 && s.changes[0] == s.threadSteps {
+		s.prio[tids[best]] = float64(len(s.changes))
+		s.changes = s.changes[1:]
+		for i, tid := range tids {
+			if s.prio[tid] > s.prio[tids[best]] {
+				best = i
+			}
+		}
+	}
+	s.threadSteps++
+	return best, true
+}
+
+func (s *StrategyPCT) Next() bool {
+	if s.threadSteps > s.maxSteps {
+		s.maxSteps = s.threadSteps
+	}
+	s.step = 0
+	s.startPath()
+	s.paths++
+	return s.MaxPaths == 0 || s.paths < s.MaxPaths
+}
@@ -44,15 +44,21 @@ func startProgress() {
 			log.Fatalf("failed to create stderr self-pipe: %v", err)
 		}
 
+		var feeders sync.WaitGroup
 		defer func() {
 			os.Stdout, os.Stderr = origStdout, origStderr
-			// Stop the feeder. It will close the write sides.
-			newStdoutR.Close()
-			newStderrR.Close()
+			// Stop the feeders once they've drained the
+			// pipes, so stopProgress returns only once the
+			// original streams are back in place.
+			newStdoutW.Close()
+			newStderrW.Close()
+			feeders.Wait()
+			close(progress.done)
 		}()
 		os.Stdout, os.Stderr = newStdoutW, newStderrW
-		go pipeFeeder(newStdoutR, origStdout, origStdout)
-		go pipeFeeder(newStderrR, origStderr, origStderr)
+		feeders.Add(2)
+		go pipeFeeder(newStdoutR, origStdout, origStdout, &feeders)
+		go pipeFeeder(newStderrR, origStderr, origStderr, &feeders)
 
 		report := func(final bool) {
 			progress.printLock.Lock()
@@ -75,11 +81,11 @@ func startProgress() {
 			}
 		}
 		ticker.Stop()
-		close(progress.done)
 	}()
 }
 
-func pipeFeeder(r, w, pstream *os.File) {
+func pipeFeeder(r, w, pstream *os.File, wg *sync.WaitGroup) {
+	defer wg.Done()
 	var buf [256]byte
 	bol := true
 	for {
@@ -104,7 +110,10 @@ func pipeFeeder(r, w, pstream *os.File) {
 			bol = true
 		}
 	}
-	w.Close()
+	if !bol {
+		progress.printLock.Unlock()
+	}
+	r.Close()
 }
 
 func stopProgress() {
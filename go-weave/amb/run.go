@@ -42,6 +42,17 @@ type Strategy interface {
 	Reset()
 }
 
+// A ThreadStrategy is a Strategy that can take the identity of
+// threads into account when choosing which thread to run next.
+type ThreadStrategy interface {
+	Strategy
+
+	// AmbThread is like Amb, but chooses among the threads with
+	// IDs tids. It returns an index into tids. Thread IDs must be
+	// stable over the course of a path.
+	AmbThread(tids []int) (int, bool)
+}
+
 // DefaultMaxDepth is the default maximum tree depth if it is
 // unspecified.
 var DefaultMaxDepth = 100
@@ -118,6 +129,24 @@ func (s *Scheduler) Amb(n int) int {
 	return x
 }
 
+// AmbThread returns the index in tids of the thread to run next. If
+// the Strategy is a ThreadStrategy, it can use the thread IDs in tids
+// to make this choice. Otherwise, this is equivalent to
+// Amb(len(tids)).
+//
+// Like Amb, AmbThread may panic with PathTerminated.
+func (s *Scheduler) AmbThread(tids []int) int {
+	ts, ok := s.Strategy.(ThreadStrategy)
+	if !ok {
+		return s.Amb(len(tids))
+	}
+	x, ok := ts.AmbThread(tids)
+	if !ok {
+		panic(PathTerminated)
+	}
+	return x
+}
+
 // PathTerminated is panicked by Scheduler.Amb to indicate that Run
 // should continue to the next path.
 var PathTerminated = errors.New("path terminated")
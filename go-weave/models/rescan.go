@@ -11,9 +11,13 @@
 // doesn't model concurrent write barriers (or the mark quiescence
 // necessary with concurrent write barriers). This model formed the
 // basis for the yuasa model, which is much more complete.
+//
+// Like yuasa, this samples schedules randomly rather than exploring
+// them all, and -pct selects PCT scheduling with bug depth -depth.
 package main
 
 import (
+	"flag"
 	"fmt"
 
 	"github.com/aclements/go-misc/go-weave/amb"
@@ -58,7 +62,16 @@ const verbose = false
 
 var sched = weave.Scheduler{Strategy: &amb.StrategyRandom{}}
 
+var (
+	flagPCT   = flag.Bool("pct", false, "explore schedules with PCT instead of uniformly at random")
+	flagDepth = flag.Int("depth", 3, "with -pct, the bug `depth` to target")
+)
+
 func main() {
+	flag.Parse()
+	if *flagPCT {
+		sched.Strategy = &amb.StrategyPCT{Depth: *flagDepth}
+	}
 	sched.Run(func() {
 		if verbose {
 			print("start:")
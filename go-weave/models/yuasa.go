@@ -6,10 +6,17 @@
 
 // yuasa is a model of several variants of Yuasa-style deletion
 // barriers intended to eliminate stack re-scanning.
+//
+// The state space is too large to explore exhaustively, so this
+// explores schedules randomly. With -pct, it instead uses
+// probabilistic concurrency testing (amb.StrategyPCT), which finds
+// bugs that depend on a few specific thread orderings (at most
+// -depth) more quickly.
 package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 
 	"github.com/aclements/go-misc/go-weave/amb"
@@ -93,7 +100,16 @@ const verbose = false
 
 var sched = weave.Scheduler{Strategy: &amb.StrategyRandom{}}
 
+var (
+	flagPCT   = flag.Bool("pct", false, "explore schedules with PCT instead of uniformly at random")
+	flagDepth = flag.Int("depth", 3, "with -pct, the bug `depth` to target")
+)
+
 func main() {
+	flag.Parse()
+	if *flagPCT {
+		sched.Strategy = &amb.StrategyPCT{Depth: *flagDepth}
+	}
 	sched.Run(func() {
 		if verbose {
 			print("start:")
@@ -0,0 +1,67 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package weave
+
+import (
+	"testing"
+
+	"github.com/aclements/go-misc/go-weave/amb"
+)
+
+// orderingBug runs a model with a depth 2 bug using strategy and
+// returns the number of paths it explored and the number that hit the
+// bug. The bug needs T2's read to happen after T1's first write
+// (one ordering constraint) but before its second (another).
+func orderingBug(strategy amb.Strategy) (paths, bugs int) {
+	const steps = 10
+	sched := Scheduler{Strategy: strategy}
+	sched.Run(func() {
+		paths++
+		x := 0
+		var wg WaitGroup
+		wg.Add(2)
+		sched.Go(func() {
+			defer wg.Done()
+			for i := 0; i < steps; i++ {
+				switch i {
+				case steps / 2:
+					x = 1
+				case steps/2 + 1:
+					x = 0
+				}
+				sched.Sched()
+			}
+		})
+		sched.Go(func() {
+			defer wg.Done()
+			for i := 0; i < steps; i++ {
+				if i == steps/2 && x == 1 {
+					bugs++
+				}
+				sched.Sched()
+			}
+		})
+		wg.Wait()
+	})
+	return
+}
+
+func TestPCT(t *testing.T) {
+	// Without priority change points, PCT runs the highest
+	// priority thread until it blocks or exits, so it can never
+	// interleave T2's read between T1's writes.
+	const n = 200
+	if paths, bugs := orderingBug(&amb.StrategyPCT{Depth: 1, MaxPaths: n}); paths != n || bugs != 0 {
+		t.Errorf("depth 1: got %d path(s), %d bug(s), want %d, 0", paths, bugs, n)
+	}
+
+	// With depth 2, each path finds the bug with probability at
+	// least 1/(n·k), where n is 3 threads and k is about 25
+	// scheduling steps, so missing it in 2000 paths is vanishingly
+	// unlikely.
+	if paths, bugs := orderingBug(&amb.StrategyPCT{Depth: 2, MaxPaths: 2000}); bugs == 0 {
+		t.Errorf("depth 2: no bugs found in %d paths", paths)
+	}
+}
@@ -16,8 +16,6 @@ import (
 // are equivalent (however, we can't just cut off T2, since we still
 // need [T2,T2,...]).
 
-// TODO: Implement a PCT scheduler (https://www.microsoft.com/en-us/research/publication/a-randomized-scheduler-with-probabilistic-guarantees-of-finding-bugs/)
-
 type Scheduler struct {
 	Strategy amb.Strategy
 
@@ -35,6 +33,8 @@ type Scheduler struct {
 	wakeSched chan void
 
 	trace []traceEntry
+
+	tids []int // Scratch space for scheduler
 }
 
 var globalSched *Scheduler
@@ -180,7 +180,11 @@ func (s *Scheduler) scheduler() {
 						panic(err)
 					}
 				}()
-				tid = s.as.Amb(len(s.runnable))
+				s.tids = s.tids[:0]
+				for _, thr := range s.runnable {
+					s.tids = append(s.tids, thr.id)
+				}
+				tid = s.as.AmbThread(s.tids)
 			}()
 		}
 		s.curThread = s.runnable[tid]
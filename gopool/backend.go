@@ -0,0 +1,139 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/build/buildlet"
+)
+
+// A Backend creates the instances in a pool.
+//
+// The pool server creates and destroys instances, but "gopool run"
+// executes commands on them from a separate process, so a backend
+// must also be able to find an instance by name.
+type Backend interface {
+	// Create creates a new instance.
+	Create() (Instance, error)
+
+	// Open returns the existing instance called name.
+	Open(name string) (Instance, error)
+}
+
+// An Instance is a machine that runs commands for a pool.
+type Instance interface {
+	// Name returns the name of the instance. This is passed to
+	// setup commands as $VM.
+	Name() string
+
+	// Exec runs cmd with args on the instance, writing its
+	// combined output to out. If cmd is absolute, it is run as
+	// given; otherwise it is relative to the instance's work
+	// directory.
+	//
+	// remoteErr is non-nil if the command failed. execErr is
+	// non-nil if the instance itself failed, in which case the
+	// instance should be considered broken.
+	Exec(cmd string, args []string, out io.Writer) (remoteErr, execErr error)
+
+	// PutTar extracts the gzipped tar archive r into dir, which
+	// is relative to the instance's work directory.
+	PutTar(r io.Reader, dir string) error
+
+	// GetTar returns a gzipped tar archive of dir, which is
+	// relative to the instance's work directory.
+	GetTar(dir string) (io.ReadCloser, error)
+
+	// Ping returns an error if the instance is not healthy.
+	Ping() error
+
+	// Destroy tears down the instance.
+	Destroy() error
+}
+
+// newBackend returns the backend for instances of type kind. The
+// kind "local" creates instances on this machine. Any other kind is a
+// gomote builder type.
+func newBackend(kind string) (Backend, error) {
+	if kind == "local" {
+		return &localBackend{}, nil
+	}
+
+	// TODO: Check that kind is valid.
+
+	coord, err := buildlet.NewCoordinatorClientFromFlags()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to coordinator: %v", err)
+	}
+	return &gomoteBackend{kind, coord}, nil
+}
+
+// gomoteBackend creates buildlets using the Go build coordinator.
+type gomoteBackend struct {
+	kind  string
+	coord *buildlet.CoordinatorClient
+}
+
+func (b *gomoteBackend) Create() (Instance, error) {
+	client, err := b.coord.CreateBuildlet(b.kind)
+	if err != nil {
+		return nil, fmt.Errorf("error creating buildlet: %s", err)
+	}
+	return &gomoteInstance{client}, nil
+}
+
+func (b *gomoteBackend) Open(name string) (Instance, error) {
+	client, err := b.coord.NamedBuildlet(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up buildlet %s: %v", name, err)
+	}
+	return &gomoteInstance{client}, nil
+}
+
+type gomoteInstance struct {
+	bc *buildlet.Client
+}
+
+func (g *gomoteInstance) Name() string {
+	return g.bc.RemoteName()
+}
+
+func (g *gomoteInstance) Exec(cmd string, args []string, out io.Writer) (remoteErr, execErr error) {
+	return g.bc.Exec(cmd, buildlet.ExecOpts{
+		Args:        args,
+		Output:      out,
+		SystemLevel: strings.HasPrefix(cmd, "/"),
+	})
+}
+
+func (g *gomoteInstance) PutTar(r io.Reader, dir string) error {
+	return g.bc.PutTar(r, dir)
+}
+
+func (g *gomoteInstance) GetTar(dir string) (io.ReadCloser, error) {
+	return g.bc.GetTar(context.Background(), dir)
+}
+
+func (g *gomoteInstance) Ping() error {
+	any := false
+	err := g.bc.ListDir(".", buildlet.ListDirOpts{}, func(buildlet.DirEntry) {
+		any = true
+	})
+	if err != nil {
+		return err
+	}
+	if !any {
+		return fmt.Errorf("ListDir failed: no entries returned")
+	}
+	return nil
+}
+
+func (g *gomoteInstance) Destroy() error {
+	return g.bc.Close()
+}
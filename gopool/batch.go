@@ -0,0 +1,185 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func cmdBatch(args []string) {
+	log.SetPrefix("")
+	log.SetFlags(0)
+
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	parallel := flags.Int("p", 0, "run up to `n` jobs at once (default the pool's limit)")
+	retries := flags.Int("retries", 3, "run a job up to `n` more times if its buildlet fails")
+	logDir := flags.String("logs", "gopool-logs", "write job logs to `dir`")
+	var puts, gets syncFlag
+	flags.Var(&puts, "put", "copy local file or directory `local:remote` to the buildlet before each job (may be repeated)")
+	flags.Var(&gets, "get", "copy buildlet directory `remote:local` to local/<job>/<buildlet name> after each job (may be repeated)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s batch [flags] <jobfile>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Each line of jobfile is a command to run. Blank lines and lines\n")
+		fmt.Fprintf(flags.Output(), "starting with # are ignored. If jobfile is -, read standard input.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	for _, put := range puts {
+		if _, err := os.Stat(put.src); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var jobs []*job
+	var err error
+	if flags.Arg(0) == "-" {
+		jobs, err = readJobs(os.Stdin)
+	} else {
+		var f *os.File
+		f, err = os.Open(flags.Arg(0))
+		if err == nil {
+			jobs, err = readJobs(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(jobs) == 0 {
+		log.Fatal("no jobs")
+	}
+
+	if *parallel == 0 {
+		r := request(ReqStatus{})
+		rep, ok := r.(RepStatus)
+		if !ok {
+			log.Fatalf("unexpected reply: %v", r)
+		}
+		*parallel = rep.Limit
+	}
+	if *parallel < 1 {
+		log.Fatal("-p must be at least 1")
+	}
+
+	if err := os.MkdirAll(*logDir, 0777); err != nil {
+		log.Fatal(err)
+	}
+
+	// Name jobs by their index, padded so they sort.
+	names := make([]string, len(jobs))
+	width := len(fmt.Sprint(len(jobs)))
+	for i, j := range jobs {
+		names[i] = fmt.Sprintf("%0*d", width, i+1)
+		j.puts = puts
+		for _, get := range gets {
+			j.gets = append(j.gets, syncPair{get.src, filepath.Join(get.dst, names[i])})
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan bool, *parallel)
+		mu      sync.Mutex
+		errs    = make([]error, len(jobs))
+		retried int
+	)
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- true
+		go func(i int, j *job) {
+			defer func() { <-sem; wg.Done() }()
+			name := names[i]
+			logPath := filepath.Join(*logDir, name+".log")
+			f, err := os.Create(logPath)
+			if err != nil {
+				mu.Lock()
+				errs[i] = err
+				log.Printf("job %s: %s", name, err)
+				mu.Unlock()
+				return
+			}
+			defer f.Close()
+
+			l := log.New(f, "gopool: ", 0)
+			l.Printf("job %s: %s", name, strings.Join(j.args, " "))
+			for attempt := 0; ; attempt++ {
+				if attempt > 0 {
+					l.Printf("retrying (attempt %d of %d)", attempt+1, *retries+1)
+				}
+				start := time.Now()
+				broken, err := runJob(j, f, l)
+				dur := time.Since(start).Round(time.Millisecond)
+
+				mu.Lock()
+				if err == nil {
+					l.Printf("ok (%s)", dur)
+					log.Printf("job %s: ok (%s)", name, dur)
+				} else if broken && attempt < *retries {
+					log.Printf("job %s: buildlet failed; retrying", name)
+					retried++
+					mu.Unlock()
+					continue
+				} else {
+					l.Printf("FAIL: %s (%s)", err, dur)
+					log.Printf("job %s: FAIL: %s (see %s)", name, err, logPath)
+				}
+				errs[i] = err
+				mu.Unlock()
+				return
+			}
+		}(i, j)
+	}
+	wg.Wait()
+
+	// Print a summary.
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	fmt.Printf("%d job(s): %d passed, %d failed", len(jobs), len(jobs)-failed, failed)
+	if retried > 0 {
+		fmt.Printf(", %d retried", retried)
+	}
+	fmt.Println()
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("FAIL %s: %s: %s\n", names[i], strings.Join(jobs[i].args, " "), err)
+		}
+	}
+	fmt.Printf("logs in %s\n", *logDir)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// readJobs reads a job file from r. Each line is a command and its
+// arguments, separated by spaces.
+func readJobs(r io.Reader) ([]*job, error) {
+	var jobs []*job
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		jobs = append(jobs, &job{args: strings.Fields(line)})
+	}
+	return jobs, scanner.Err()
+}
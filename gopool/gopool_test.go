@@ -4,10 +4,540 @@
 
 package main
 
-// TODO: Test reusing
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
-// TODO: Test setup command
+func newTestPool(t *testing.T, limit int) (*BuildletPool, func()) {
+	dir, err := ioutil.TempDir("", "gopool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPool("local", &localBackend{dir}, limit)
+	return p, func() {
+		p.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
 
-// TODO: Test killing client in the middle
+// testClient connects a client to s and returns its request and reply
+// channels.
+func testClient(s *poolServer) (chan<- interface{}, <-chan interface{}) {
+	req := make(chan interface{})
+	rep := make(chan interface{})
+	go s.newConn(req, rep)
+	return req, rep
+}
 
-// TODO: Test client with failed commands
+// testDisconnect disconnects a client and waits for the server to
+// clean up after it.
+func testDisconnect(req chan<- interface{}, rep <-chan interface{}) {
+	close(req)
+	for range rep {
+	}
+}
+
+func testCheckout(t *testing.T, req chan<- interface{}, rep <-chan interface{}) RepCheckout {
+	t.Helper()
+	req <- ReqCheckout{}
+	r, ok := (<-rep).(RepCheckout)
+	if !ok {
+		t.Fatalf("checkout failed: %v", r)
+	}
+	return r
+}
+
+func testCheckin(t *testing.T, req chan<- interface{}, rep <-chan interface{}, checkin ReqCheckin) {
+	t.Helper()
+	req <- checkin
+	if r, ok := (<-rep).(RepCheckin); !ok {
+		t.Fatalf("checkin failed: %v", r)
+	}
+}
+
+func TestReuse(t *testing.T) {
+	p, done := newTestPool(t, 1)
+	defer done()
+
+	g1, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g1.Fresh {
+		t.Errorf("new instance is not fresh")
+	}
+	g1.Fresh = false
+	p.Checkin(g1)
+
+	g2, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g1 != g2 {
+		t.Errorf("got new instance %s, want reused instance %s", g2.Instance.Name(), g1.Instance.Name())
+	}
+	if g2.Fresh {
+		t.Errorf("reused instance is fresh")
+	}
+	p.Checkin(g2)
+}
+
+func TestBroken(t *testing.T) {
+	p, done := newTestPool(t, 1)
+	defer done()
+
+	g1, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := g1.Instance.Name()
+	g1.Broken = true
+	p.Checkin(g1)
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("broken instance %s was not destroyed", name)
+	}
+
+	// The broken instance's slot should be free for a new one.
+	g2, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g2.Instance.Name() == name || !g2.Fresh {
+		t.Errorf("got instance %s, want fresh instance", g2.Instance.Name())
+	}
+	p.Checkin(g2)
+}
+
+func TestSetup(t *testing.T) {
+	p, done := newTestPool(t, 1)
+	defer done()
+	s := &poolServer{p: p, setup: "touch $VM/setup"}
+
+	req, rep := testClient(s)
+	r := testCheckout(t, req, rep)
+	if r.Kind != "local" || !r.Fresh || r.Setup != s.setup {
+		t.Fatalf("got %+v, want fresh local instance with setup", r)
+	}
+	testCheckin(t, req, rep, ReqCheckin{Fresh: false})
+	testDisconnect(req, rep)
+
+	// A second client should get the same instance, already set
+	// up.
+	req, rep = testClient(s)
+	r2 := testCheckout(t, req, rep)
+	if r2.Name != r.Name || r2.Fresh {
+		t.Fatalf("got %+v, want reused instance %s", r2, r.Name)
+	}
+	testCheckin(t, req, rep, ReqCheckin{Fresh: false})
+	testDisconnect(req, rep)
+}
+
+func TestClientDied(t *testing.T) {
+	p, done := newTestPool(t, 1)
+	defer done()
+	s := &poolServer{p: p, setup: "true"}
+
+	// A client that disconnects during setup leaves the instance
+	// in an unknown state, so it should be destroyed.
+	req, rep := testClient(s)
+	r := testCheckout(t, req, rep)
+	testDisconnect(req, rep)
+	if _, err := os.Stat(r.Name); !os.IsNotExist(err) {
+		t.Errorf("instance %s was not destroyed", r.Name)
+	}
+
+	// A client that disconnects after setup returns the instance
+	// to the pool.
+	req, rep = testClient(s)
+	r = testCheckout(t, req, rep)
+	testCheckin(t, req, rep, ReqCheckin{Fresh: false})
+	testCheckout(t, req, rep)
+	testDisconnect(req, rep)
+	req, rep = testClient(s)
+	if r2 := testCheckout(t, req, rep); r2.Name != r.Name {
+		t.Errorf("got instance %s, want reused instance %s", r2.Name, r.Name)
+	}
+	testDisconnect(req, rep)
+}
+
+func TestLocalExec(t *testing.T) {
+	p, done := newTestPool(t, 1)
+	defer done()
+	g, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Checkin(g)
+	inst := g.Instance
+
+	script := filepath.Join(inst.Name(), "bin", "hello")
+	os.Mkdir(filepath.Dir(script), 0777)
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho hello $1 from $WORKDIR\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	remoteErr, execErr := inst.Exec("bin/hello", []string{"world"}, &out)
+	if remoteErr != nil || execErr != nil {
+		t.Fatalf("exec failed: %v, %v", remoteErr, execErr)
+	}
+	if want := "hello world from " + inst.Name() + "\n"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+
+	// A failed command is not a broken instance.
+	remoteErr, execErr = inst.Exec("/bin/sh", []string{"-c", "exit 1"}, &out)
+	if remoteErr == nil || execErr != nil {
+		t.Errorf("failed command: got %v, %v; want remote error only", remoteErr, execErr)
+	}
+
+	// Bare command names are relative to the work directory, not
+	// looked up in $PATH.
+	if err := ioutil.WriteFile(filepath.Join(inst.Name(), "true"), []byte("#!/bin/sh\necho local\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if remoteErr, execErr := inst.Exec("true", nil, &out); remoteErr != nil || execErr != nil || out.String() != "local\n" {
+		t.Errorf("bare command: got %q, %v, %v; want command from work directory", out.String(), remoteErr, execErr)
+	}
+
+	// Opening an instance that doesn't exist fails.
+	backend := &localBackend{}
+	if _, err := backend.Open(filepath.Join(inst.Name(), "missing")); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("opening missing instance: got %v, want error", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	p, done := newTestPool(t, 2)
+	defer done()
+
+	g1, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Checkin(g2)
+
+	// Shrinking the pool destroys the idle instance right away
+	// and the checked-out instance when it's checked in.
+	p.Resize(0)
+	if _, insts := p.Status(); len(insts) != 1 || insts[0].Name != g1.Instance.Name() {
+		t.Fatalf("after resize, got instances %+v, want just %s", insts, g1.Instance.Name())
+	}
+	p.Checkin(g1)
+	if _, insts := p.Status(); len(insts) != 0 {
+		t.Fatalf("after checkin, got instances %+v, want none", insts)
+	}
+
+	// A checkout waits for the pool to grow.
+	got := make(chan *Gomote)
+	go func() {
+		g, err := p.Checkout()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- g
+	}()
+	select {
+	case <-got:
+		t.Fatal("checkout from empty pool succeeded")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.Resize(1)
+	p.Checkin(<-got)
+}
+
+func TestWaitForCheckin(t *testing.T) {
+	p, done := newTestPool(t, 1)
+	defer done()
+
+	g1, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *Gomote)
+	go func() {
+		g, err := p.Checkout()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- g
+	}()
+	// When the pool is full, a checkout should get the next
+	// instance to be checked in.
+	p.Checkin(g1)
+	if g2 := <-got; g2 != g1 {
+		t.Errorf("got instance %s, want %s", g2.Instance.Name(), g1.Instance.Name())
+	}
+	p.Checkin(g1)
+}
+
+func TestDrain(t *testing.T) {
+	p, done := newTestPool(t, 2)
+	defer done()
+	s := &poolServer{p: p}
+
+	req, rep := testClient(s)
+	r := testCheckout(t, req, rep)
+
+	// Drain in the background. It should finish once the
+	// instance is checked in.
+	dreq, drep := testClient(s)
+	dreq <- ReqDrain{}
+	select {
+	case r := <-drep:
+		t.Fatalf("drain finished with instance checked out: %v", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// New checkouts fail during the drain.
+	req2, rep2 := testClient(s)
+	req2 <- ReqCheckout{}
+	if r, ok := (<-rep2).(RepError); !ok || r.Msg != errDraining.Error() {
+		t.Errorf("checkout during drain: got %v, want %q", r, errDraining)
+	}
+	testDisconnect(req2, rep2)
+
+	testCheckin(t, req, rep, ReqCheckin{})
+	testDisconnect(req, rep)
+	if r := <-drep; r != (RepDrain{}) {
+		t.Fatalf("drain failed: %v", r)
+	}
+	testDisconnect(dreq, drep)
+	if _, err := os.Stat(r.Name); !os.IsNotExist(err) {
+		t.Errorf("instance %s was not destroyed", r.Name)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	p, done := newTestPool(t, 1)
+	defer done()
+	g, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Checkin(g)
+	inst := g.Instance
+
+	src, err := ioutil.TempDir("", "gopool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	files := map[string]string{
+		"dir/a":     "a",
+		"dir/sub/b": "b",
+		"file":      "c",
+	}
+	for name, data := range files {
+		path := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, put := range []syncPair{
+		{filepath.Join(src, "dir"), "in"},
+		{filepath.Join(src, "file"), "in/renamed"},
+		{filepath.Join(src, "file"), "in/sub/"},
+	} {
+		if err := putPath(inst, put.src, put.dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(src, "out")
+	dst, err := getPath(inst, "in", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(out, filepath.Base(inst.Name())); dst != want {
+		t.Errorf("got results in %s, want %s", dst, want)
+	}
+	for name, want := range map[string]string{
+		"a":        "a",
+		"sub/b":    "b",
+		"renamed":  "c",
+		"sub/file": "c",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Error(err)
+		} else if string(data) != want {
+			t.Errorf("%s: got %q, want %q", name, data, want)
+		}
+	}
+
+	if _, err := getPath(inst, "missing", out); err == nil {
+		t.Errorf("getting missing directory succeeded")
+	}
+}
+
+func TestExtractTarGzSymlinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gopool-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	outside := filepath.Join(tmp, "outside")
+	if err := os.Mkdir(outside, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// archive returns a tar.gz of entries, which are symlinks if
+	// they start with "->" and regular files otherwise.
+	archive := func(entries ...[2]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e[0], Mode: 0666, Typeflag: tar.TypeReg, Size: int64(len(e[1]))}
+			if strings.HasPrefix(e[1], "->") {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e[1][2:], 0
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				tw.Write([]byte(e[1]))
+			}
+		}
+		tw.Close()
+		gz.Close()
+		return &buf
+	}
+
+	for i, entries := range [][][2]string{
+		{{"a", "->" + outside}, {"a/x", "x"}},
+		{{"a", "->" + outside}, {"a/b", "->x"}},
+	} {
+		dir := filepath.Join(tmp, fmt.Sprint(i))
+		if err := extractTarGz(archive(entries...), dir); err == nil {
+			t.Errorf("%v: extracting succeeded, want error", entries)
+		}
+		if names, _ := ioutil.ReadDir(outside); len(names) != 0 {
+			t.Fatalf("%v: extracting wrote %s outside directory", entries, names[0].Name())
+		}
+	}
+
+	// Symlinks to directories still work.
+	dir := filepath.Join(tmp, "ok")
+	if err := extractTarGz(archive([2]string{"l", "->d"}, [2]string{"d/x", "x"}), dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "l", "x")); err != nil || string(data) != "x" {
+		t.Errorf("reading through symlink: got %q, %v", data, err)
+	}
+
+	// Extracting again into the same directory, as repeated -get
+	// does, must not write through symlinks left by the first
+	// extraction.
+	dir = filepath.Join(tmp, "again")
+	if err := extractTarGz(archive([2]string{"a", "->" + outside}, [2]string{"f", "->" + outside + "/f"}), dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range [][][2]string{
+		{{"a/pwned", "x"}},
+		{{"a/b/pwned", "x"}},
+		{{"a/l", "->x"}},
+		{{"f", "x"}},
+	} {
+		if err := extractTarGz(archive(entries...), dir); err != nil {
+			t.Errorf("%v: %v", entries, err)
+		}
+		if names, _ := ioutil.ReadDir(outside); len(names) != 0 {
+			t.Fatalf("%v: extracting wrote %s outside directory", entries, names[0].Name())
+		}
+		if _, err := os.Lstat(filepath.Join(dir, entries[0][0])); err != nil {
+			t.Errorf("%v: %v", entries, err)
+		}
+	}
+}
+
+func TestReadJobs(t *testing.T) {
+	jobs, err := readJobs(strings.NewReader("# comment\ngo/bin/go test  -short std\n\n  /bin/echo hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"go/bin/go", "test", "-short", "std"}, {"/bin/echo", "hi"}}
+	if len(jobs) != len(want) {
+		t.Fatalf("got %d jobs, want %d", len(jobs), len(want))
+	}
+	for i, j := range jobs {
+		if strings.Join(j.args, "|") != strings.Join(want[i], "|") {
+			t.Errorf("job %d: got %q, want %q", i, j.args, want[i])
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	p, done := newTestPool(t, 2)
+	defer done()
+
+	g1, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Checkin(g1)
+
+	// Break both instances. Only the idle one should be checked
+	// and replaced.
+	os.RemoveAll(g1.Instance.Name())
+	os.RemoveAll(g2.Instance.Name())
+	p.checkHealth()
+
+	_, insts := p.Status()
+	if len(insts) != 2 {
+		t.Fatalf("got %d instances, want 2", len(insts))
+	}
+	for _, inst := range insts {
+		if inst.Name == g1.Instance.Name() {
+			t.Errorf("unhealthy instance %s is still in the pool", inst.Name)
+		} else if inst.Name != g2.Instance.Name() && (inst.CheckedOut || !inst.Fresh) {
+			t.Errorf("replacement %+v is not idle and fresh", inst)
+		}
+	}
+	p.Checkin(g2)
+}
+
+func TestIdleReap(t *testing.T) {
+	p, done := newTestPool(t, 2)
+	defer done()
+
+	g1, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := p.Checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Checkin(g1)
+	p.Checkin(g2)
+	g1.lastUsed = time.Now().Add(-time.Hour)
+
+	p.reapIdle(time.Minute)
+	if _, insts := p.Status(); len(insts) != 1 || insts[0].Name != g2.Instance.Name() {
+		t.Errorf("got instances %+v, want just %s", insts, g2.Instance.Name())
+	}
+	if _, err := os.Stat(g1.Instance.Name()); !os.IsNotExist(err) {
+		t.Errorf("idle instance %s was not destroyed", g1.Instance.Name())
+	}
+}
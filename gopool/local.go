@@ -0,0 +1,105 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// localBackend creates instances on the local machine. Each instance
+// is a directory, and commands run as local processes with that
+// directory as their work directory. This is useful for testing and
+// for running a pool of jobs that don't need a particular builder.
+type localBackend struct {
+	// dir is the directory to create instances in. If empty, it
+	// is the system temporary directory.
+	dir string
+}
+
+func (b *localBackend) Create() (Instance, error) {
+	dir, err := ioutil.TempDir(b.dir, "gopool-local-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating local instance: %s", err)
+	}
+	return &localInstance{dir}, nil
+}
+
+func (b *localBackend) Open(name string) (Instance, error) {
+	inst := &localInstance{name}
+	if err := inst.Ping(); err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// localInstance is an instance of localBackend. Its name is the path
+// of its work directory.
+type localInstance struct {
+	dir string
+}
+
+func (l *localInstance) Name() string {
+	return l.dir
+}
+
+func (l *localInstance) Exec(cmd string, args []string, out io.Writer) (remoteErr, execErr error) {
+	if err := l.Ping(); err != nil {
+		return nil, err
+	}
+	// Like a buildlet, commands that aren't absolute are relative
+	// to the work directory, even bare command names.
+	if !filepath.IsAbs(cmd) {
+		cmd = filepath.Join(l.dir, cmd)
+	}
+	c := exec.Command(cmd, args...)
+	c.Dir = l.dir
+	c.Env = append(os.Environ(), "WORKDIR="+l.dir)
+	c.Stdout = out
+	c.Stderr = out
+	return c.Run(), nil
+}
+
+func (l *localInstance) PutTar(r io.Reader, dir string) error {
+	if err := l.Ping(); err != nil {
+		return err
+	}
+	return extractTarGz(r, filepath.Join(l.dir, dir))
+}
+
+func (l *localInstance) GetTar(dir string) (io.ReadCloser, error) {
+	src := filepath.Join(l.dir, dir)
+	st, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTarGz(pw, src, ""))
+	}()
+	return pr, nil
+}
+
+func (l *localInstance) Ping() error {
+	st, err := os.Stat(l.dir)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", l.dir)
+	}
+	return nil
+}
+
+func (l *localInstance) Destroy() error {
+	return os.RemoveAll(l.dir)
+}
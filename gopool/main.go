@@ -9,10 +9,44 @@
 // buildlet is created (for example "gomote push $VM" is useful). If a
 // buildlet fails, it is removed from the pool.
 //
+// Each pool is identified by name, given by the -pool flag or $GOPOOL,
+// so several pools of different buildlet types can run at once. The
+// status command shows the buildlets in a pool, resize changes its
+// size limit, and drain destroys its buildlets once they are no longer
+// in use and stops the pool.
+//
+// The run command's -put and -get flags copy files to the buildlet
+// before the command and copy results back afterward. Results are
+// written to a subdirectory named after the buildlet, so concurrent
+// runs on different buildlets don't collide.
+//
+// The batch command runs a file of commands, one per line, over the
+// pool. It runs as many at once as the pool allows, retries commands
+// whose buildlet fails, and writes each command's output and exit
+// status to its own log file.
+//
+// The pool pings idle buildlets periodically and replaces those that
+// fail. With -idle-timeout, it also destroys buildlets that haven't
+// been used for a while, so an idle pool doesn't tie up resources.
+//
+// The buildlet type "local" creates instances on the local machine.
+// Each local instance is a temporary directory and commands run as
+// local processes in that directory, which is useful for testing and
+// for jobs that don't need a particular builder. As on a buildlet,
+// commands that aren't absolute paths are relative to the instance's
+// directory, so system commands must be given by absolute path.
+//
 // Example usage:
 //
 //     gopool create -setup 'gomote push $VM' linux-amd64 5 &
 //     stress -p 5 gopool run go/src/all.bash
+//
+//     gopool -pool local create -setup 'cp -r $HOME/go $VM/go' local 5 &
+//     stress -p 5 gopool -pool local run go/src/all.bash
+//     gopool -pool local run -put job.sh:job.sh -get out:results ./job.sh
+//     gopool -pool local batch -logs logs jobs.txt
+//     gopool -pool local status
+//     gopool -pool local drain
 package main
 
 import (
@@ -20,13 +54,15 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"strconv"
-	"strings"
+	"text/tabwriter"
+	"time"
 
 	"golang.org/x/build/buildlet"
 )
 
+var poolName = flag.String("pool", os.Getenv("GOPOOL"), "use the pool called `name` (default $GOPOOL)")
+
 func main() {
 	buildlet.RegisterFlags()
 	flag.Usage = func() {
@@ -36,6 +72,10 @@ func main() {
 		fmt.Fprintf(w, "\nSubcommands:\n")
 		fmt.Fprintf(w, "  create   create a new buildlet pool\n")
 		fmt.Fprintf(w, "  run      run a command on a buildlet from the pool\n")
+		fmt.Fprintf(w, "  batch    run a file of commands on buildlets from the pool\n")
+		fmt.Fprintf(w, "  status   show the buildlets in the pool\n")
+		fmt.Fprintf(w, "  resize   change the size limit of the pool\n")
+		fmt.Fprintf(w, "  drain    destroy all buildlets and stop the pool\n")
 	}
 	flag.Parse()
 	if flag.NArg() < 1 {
@@ -54,6 +94,18 @@ func main() {
 
 	case "run":
 		cmdRun(args)
+
+	case "batch":
+		cmdBatch(args)
+
+	case "status":
+		cmdStatus(args)
+
+	case "resize":
+		cmdResize(args)
+
+	case "drain":
+		cmdDrain(args)
 	}
 }
 
@@ -65,6 +117,8 @@ func cmdCreate(args []string) {
 
 	flags := flag.NewFlagSet("create", flag.ExitOnError)
 	setupFlag := flags.String("setup", "", "run shell command `cmd` to set up new instances; $VM will be set to the buildlet name")
+	healthFlag := flags.Duration("health-check", time.Minute, "check the health of idle buildlets every `interval` and replace failing ones (0 to disable)")
+	idleFlag := flags.Duration("idle-timeout", 0, "destroy buildlets that are unused for `duration` (0 to never destroy)")
 	flags.Usage = func() {
 		fmt.Fprintf(flags.Output(), "Usage: %s create [flags] <type> <limit>\n", os.Args[0])
 		flags.PrintDefaults()
@@ -79,7 +133,7 @@ func cmdCreate(args []string) {
 	if err != nil {
 		log.Fatalf("limit argument must be a number: %s", err)
 	}
-	create(kind, limit, *setupFlag)
+	create(*poolName, kind, limit, *setupFlag, *healthFlag, *idleFlag)
 }
 
 func cmdRun(args []string) {
@@ -87,8 +141,11 @@ func cmdRun(args []string) {
 	log.SetFlags(0)
 
 	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	var puts, gets syncFlag
+	flags.Var(&puts, "put", "copy local file or directory `local:remote` to the buildlet before running the command (may be repeated)")
+	flags.Var(&gets, "get", "copy buildlet directory `remote:local` to local/<buildlet name> after running the command (may be repeated)")
 	flags.Usage = func() {
-		fmt.Fprintf(flags.Output(), "Usage: %s run <cmd...>\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Usage: %s run [flags] <cmd...>\n", os.Args[0])
 		flags.PrintDefaults()
 	}
 	flags.Parse(args)
@@ -96,20 +153,26 @@ func cmdRun(args []string) {
 		flags.Usage()
 		os.Exit(2)
 	}
+	for _, put := range puts {
+		// Check early, before tying up a buildlet.
+		if _, err := os.Stat(put.src); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	rc, wc := connect()
-	coord, err := buildlet.NewCoordinatorClientFromFlags()
-	if err != nil {
-		log.Fatalf("error connecting to coordinator: %v", err)
+	j := &job{args: flags.Args(), puts: puts, gets: gets}
+	if _, err := runJob(j, os.Stdout, log.New(os.Stderr, "", 0)); err != nil {
+		os.Exit(1)
 	}
+}
 
-	// Get a gomote.
-	wc <- ReqCheckout{}
-	var checkout RepCheckout
+// request sends req to the pool server and returns its reply. It
+// exits if the server returns an error.
+func request(req interface{}) interface{} {
+	rc, wc := connect(*poolName)
+	defer close(wc)
+	wc <- req
 	switch rep := (<-rc).(type) {
-	default:
-		log.Fatalf("unexpected reply: %v", rep)
-
 	case nil:
 		log.Fatalf("server disconnected")
 
@@ -119,66 +182,104 @@ func cmdRun(args []string) {
 	case RepError:
 		log.Fatal(rep.Msg)
 
-	case RepCheckout:
-		checkout = rep
+	default:
+		return rep
 	}
-	log.Printf("got buildlet %s", checkout.Name)
-	checkin := ReqCheckin{Fresh: checkout.Fresh, Broken: false}
+	panic("unreachable")
+}
 
-	bc, err := coord.NamedBuildlet(checkout.Name)
-	if err != nil {
-		log.Fatalf("failed to look up buildlet %s: %v", checkout.Name, err)
-	}
-
-	// Set up gomote if fresh.
-	if checkout.Fresh && checkout.Setup != "" {
-		log.Print("setting up fresh buildlet")
-		cmd := exec.Command("/bin/sh", "-c", checkout.Setup)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = append(os.Environ(), "VM="+checkout.Name)
-		err := cmd.Run()
-		if err != nil {
-			log.Fatalf("failed to set up fresh buildlet: %v", err)
-		}
+func cmdStatus(args []string) {
+	log.SetPrefix("")
+	log.SetFlags(0)
+
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s status\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
 	}
-	checkin.Fresh = false
 
-	// Run command.
-	cmd := flags.Arg(0)
-	remoteErr, execErr := bc.Exec(cmd, buildlet.ExecOpts{
-		Args:        flags.Args()[1:],
-		Output:      os.Stdout,
-		SystemLevel: strings.HasPrefix(cmd, "/"),
-	})
-	if execErr != nil {
-		log.Printf("buildlet error: %v", execErr)
-		checkin.Broken = true
-	} else if remoteErr != nil {
-		log.Printf("error executing command: %v", remoteErr)
+	r := request(ReqStatus{})
+	rep, ok := r.(RepStatus)
+	if !ok {
+		log.Fatalf("unexpected reply: %v", r)
+	}
+	fmt.Printf("%s pool: %d/%d buildlets\n", rep.Kind, len(rep.Instances), rep.Limit)
+	if rep.Setup != "" {
+		fmt.Printf("setup: %s\n", rep.Setup)
 	}
+	if len(rep.Instances) == 0 {
+		return
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tSTATE\tAGE\tIDLE\n")
+	for _, inst := range rep.Instances {
+		state := "idle"
+		if inst.CheckedOut {
+			state = "checked-out"
+		}
+		if inst.Fresh {
+			state += ",fresh"
+		}
+		if inst.Broken {
+			state += ",broken"
+		}
+		age := now.Sub(inst.Created).Round(time.Second)
+		idle := "-"
+		if !inst.CheckedOut {
+			idle = now.Sub(inst.LastUsed).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", inst.Name, state, age, idle)
+	}
+	w.Flush()
+}
 
-	// Check gomote back in.
-	wc <- checkin
-	switch rep := (<-rc).(type) {
-	default:
-		log.Fatalf("unexpected reply: %v", rep)
+func cmdResize(args []string) {
+	log.SetPrefix("")
+	log.SetFlags(0)
 
-	case nil:
-		// Server disconnected. That's fine.
+	flags := flag.NewFlagSet("resize", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s resize <limit>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	limit, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("limit argument must be a number: %s", err)
+	}
 
-	case PipeChanError:
-		log.Fatalf("gopool read error: %v", rep.Err)
+	if r := request(ReqResize{limit}); r != (RepResize{}) {
+		log.Fatalf("unexpected reply: %v", r)
+	}
+}
 
-	case RepError:
-		log.Fatal(rep.Msg)
+func cmdDrain(args []string) {
+	log.SetPrefix("")
+	log.SetFlags(0)
 
-	case RepCheckin:
+	flags := flag.NewFlagSet("drain", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s drain\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
 	}
 
-	close(wc)
-
-	if remoteErr != nil || execErr != nil {
-		os.Exit(1)
+	// This waits for buildlets that are in use to be checked in.
+	if r := request(ReqDrain{}); r != (RepDrain{}) {
+		log.Fatalf("unexpected reply: %v", r)
 	}
 }
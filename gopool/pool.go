@@ -5,99 +5,120 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"log"
 	"sync"
-
-	"golang.org/x/build/buildlet"
+	"time"
 )
 
 func NewBuildletPool(kind string, limit int) *BuildletPool {
-	// TODO: Check that kind is valid.
-
-	coord, err := buildlet.NewCoordinatorClientFromFlags()
+	backend, err := newBackend(kind)
 	if err != nil {
-		log.Fatalf("error connecting to coordinator: %v", err)
+		log.Fatal(err)
 	}
+	return newPool(kind, backend, limit)
+}
 
-	return &BuildletPool{
-		kind:  kind,
-		limit: make(chan struct{}, limit),
-		coord: coord,
+func newPool(kind string, backend Backend, limit int) *BuildletPool {
+	p := &BuildletPool{
+		kind:    kind,
+		limit:   limit,
+		backend: backend,
+		stop:    make(chan struct{}),
 	}
+	p.cond.L = &p.lock
+	return p
 }
 
 type BuildletPool struct {
-	kind  string
-	limit chan struct{} // One token per Gomote in pool
+	kind    string
+	backend Backend
 
-	coord *buildlet.CoordinatorClient
+	lock     sync.Mutex
+	cond     sync.Cond // Broadcast when pool, n, limit, or draining change
+	pool     []*Gomote
+	n        int // Gomotes in pool plus Gomotes being created
+	limit    int
+	draining bool
 
-	lock sync.Mutex
-	pool []*Gomote
+	stop chan struct{} // Closed to stop background maintenance
 }
 
 type Gomote struct {
-	Buildlet   *buildlet.Client
+	Instance   Instance
 	checkedOut bool
+	pinging    bool // Being health checked
 	Fresh      bool
 	Broken     bool
+	created    time.Time
+	lastUsed   time.Time
 }
 
-func (p *BuildletPool) Checkout() (*Gomote, error) {
-	get1 := func() *Gomote {
-		p.lock.Lock()
-		defer p.lock.Unlock()
+// errDraining is returned by Checkout when the pool is being drained.
+var errDraining = errors.New("pool is draining")
 
+func (p *BuildletPool) Checkout() (*Gomote, error) {
+	p.lock.Lock()
+	for {
+		if p.draining {
+			p.lock.Unlock()
+			return nil, errDraining
+		}
 		for _, g := range p.pool {
-			if !g.checkedOut {
+			if !g.checkedOut && !g.pinging {
 				g.checkedOut = true
-				return g
+				p.lock.Unlock()
+				return g, nil
 			}
 		}
-		return nil
-	}
-	create1 := func() (*Gomote, error) {
-		// Create a new builder.
-		created := false
-		p.limit <- struct{}{}
-		defer func() {
-			// Creation failed. Release limit.
-			if !created {
-				<-p.limit
-			}
-		}()
-
-		log.Printf("creating %s buildlet", p.kind)
-		client, err := p.coord.CreateBuildlet(p.kind)
-		if err != nil {
-			return nil, fmt.Errorf("error creating buildlet: %s", err)
+		if p.n < p.limit {
+			break
 		}
-		defer func() {
-			// Creation failed. Tear down buildlet.
-			if !created {
-				client.Close()
-			}
-		}()
-		log.Printf("created buildlet %s", client.RemoteName())
+		p.cond.Wait()
+	}
+	// Reserve space for a new buildlet.
+	p.n++
+	p.lock.Unlock()
 
-		g := &Gomote{client, true, true, false}
+	return p.create(true)
+}
+
+// create creates a new buildlet and adds it to the pool. The caller
+// must have already reserved space for it by incrementing p.n.
+func (p *BuildletPool) create(checkedOut bool) (*Gomote, error) {
+	log.Printf("creating %s buildlet", p.kind)
+	inst, err := p.backend.Create()
+	if err != nil {
+		// Creation failed. Release the reservation.
 		p.lock.Lock()
-		defer p.lock.Unlock()
-		p.pool = append(p.pool, g)
-		created = true
-		return g, nil
-	}
-
-	g := get1()
-	if g == nil {
-		var err error
-		g, err = create1()
-		if err != nil {
-			return nil, err
-		}
+		p.n--
+		p.cond.Broadcast()
+		p.lock.Unlock()
+		return nil, err
 	}
+	log.Printf("created buildlet %s", inst.Name())
 
+	now := time.Now()
+	g := &Gomote{Instance: inst, checkedOut: checkedOut, Fresh: true, created: now, lastUsed: now}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-p.stop:
+		// The pool was shut down while we were creating
+		// the buildlet.
+		p.n--
+		log.Printf("destroying buildlet %s", inst.Name())
+		inst.Destroy()
+		return nil, errors.New("pool is shut down")
+	default:
+	}
+	p.pool = append(p.pool, g)
+	if !checkedOut {
+		// The pool may have been drained or shrunk in the
+		// meantime.
+		p.trimLocked()
+	}
+	p.cond.Broadcast()
 	return g, nil
 }
 
@@ -110,17 +131,14 @@ func (p *BuildletPool) Checkin(g *Gomote) {
 				panic("checkin of already checked-in buildlet")
 			}
 			g.checkedOut = false
-			if g.Broken {
-				name := g.Buildlet.RemoteName()
-				log.Printf("destroying broken buildlet %s", name)
-				// Remove from the pool
-				copy(p.pool[i:], p.pool[i+1:])
-				p.pool = p.pool[:len(p.pool)-1]
-				// Destroy
-				if err := g.Buildlet.Close(); err != nil {
-					panic(fmt.Errorf("failed to destroy buildlet %s: %v", name, err))
-				}
-				<-p.limit
+			g.lastUsed = time.Now()
+			switch {
+			case g.Broken:
+				p.destroyLocked(i, "broken ")
+			case p.draining || p.n > p.limit:
+				p.destroyLocked(i, "")
+			default:
+				p.cond.Broadcast()
 			}
 			return
 		}
@@ -128,34 +146,195 @@ func (p *BuildletPool) Checkin(g *Gomote) {
 	panic("checkin of unknown buildlet")
 }
 
-func (p *BuildletPool) Shutdown() {
+// destroyLocked removes p.pool[i] from the pool and destroys it. The
+// pool lock must be held.
+func (p *BuildletPool) destroyLocked(i int, what string) {
+	g := p.pool[i]
+	name := g.Instance.Name()
+	log.Printf("destroying %sbuildlet %s", what, name)
+	// Remove from the pool
+	copy(p.pool[i:], p.pool[i+1:])
+	p.pool = p.pool[:len(p.pool)-1]
+	p.n--
+	p.cond.Broadcast()
+	// Destroy
+	if err := g.Instance.Destroy(); err != nil {
+		log.Printf("failed to destroy buildlet %s: %v", name, err)
+	}
+}
+
+// trimLocked destroys idle buildlets until the pool is within its
+// limit, or all idle buildlets if the pool is draining. The pool lock
+// must be held.
+func (p *BuildletPool) trimLocked() {
+	for i := 0; i < len(p.pool) && (p.draining || p.n > p.limit); {
+		if p.pool[i].checkedOut || p.pool[i].pinging {
+			i++
+			continue
+		}
+		p.destroyLocked(i, "idle ")
+	}
+}
+
+// Resize changes the maximum number of buildlets in the pool. If the
+// pool shrinks, idle buildlets are destroyed immediately and
+// checked-out buildlets are destroyed when they are checked in.
+func (p *BuildletPool) Resize(limit int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	log.Printf("resizing pool from %d to %d", p.limit, limit)
+	p.limit = limit
+	p.trimLocked()
+	p.cond.Broadcast()
+}
+
+// Drain stops checking out buildlets, destroys idle buildlets, and
+// waits for checked-out buildlets to be checked in and destroyed.
+func (p *BuildletPool) Drain() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	log.Printf("draining pool")
+	p.draining = true
+	p.cond.Broadcast()
+	p.trimLocked()
+	for p.n > 0 {
+		p.cond.Wait()
+	}
+}
+
+// Status returns the limit of p and the state of each buildlet in it.
+func (p *BuildletPool) Status() (limit int, insts []InstanceStatus) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	for _, g := range p.pool {
-		select {
-		case <-p.limit:
-		default:
-		}
+		insts = append(insts, InstanceStatus{
+			Name:       g.Instance.Name(),
+			CheckedOut: g.checkedOut,
+			Fresh:      g.Fresh,
+			Broken:     g.Broken,
+			Created:    g.created,
+			LastUsed:   g.lastUsed,
+		})
+	}
+	return p.limit, insts
+}
 
-		name := g.Buildlet.RemoteName()
+func (p *BuildletPool) Shutdown() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	for _, g := range p.pool {
+		name := g.Instance.Name()
 		log.Printf("destroying buildlet %s", name)
-		if err := g.Buildlet.Close(); err != nil {
+		if err := g.Instance.Destroy(); err != nil {
 			log.Printf("failed to destroy buildlet %s: %v", name, err)
 		}
 	}
+	p.n -= len(p.pool)
 	p.pool = nil
+	p.cond.Broadcast()
 }
 
-func (g *Gomote) Ping() error {
-	any := false
-	err := g.Buildlet.ListDir(".", buildlet.ListDirOpts{}, func(buildlet.DirEntry) {
-		any = true
-	})
-	if err != nil {
-		return err
+// StartHealthChecks starts pinging idle buildlets every interval.
+// Buildlets that fail are destroyed and replaced.
+func (p *BuildletPool) StartHealthChecks(interval time.Duration) {
+	go p.every(interval, p.checkHealth)
+}
+
+// StartIdleReaper starts destroying buildlets that have been idle for
+// longer than timeout.
+func (p *BuildletPool) StartIdleReaper(timeout time.Duration) {
+	go p.every(timeout/2, func() { p.reapIdle(timeout) })
+}
+
+// every calls f every d until the pool is shut down.
+func (p *BuildletPool) every(d time.Duration, f func()) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			f()
+		}
 	}
-	if !any {
-		return fmt.Errorf("ListDir failed: no entries returned")
+}
+
+// checkHealth pings every idle buildlet. Those that fail are
+// destroyed and replaced with new buildlets.
+func (p *BuildletPool) checkHealth() {
+	// Take idle buildlets out of circulation while we ping them.
+	var check []*Gomote
+	p.lock.Lock()
+	for _, g := range p.pool {
+		if !g.checkedOut && !g.pinging {
+			g.pinging = true
+			check = append(check, g)
+		}
 	}
-	return nil
+	p.lock.Unlock()
+
+	errs := make([]error, len(check))
+	for i, g := range check {
+		errs[i] = g.Ping()
+	}
+
+	replace := 0
+	p.lock.Lock()
+	for i, g := range check {
+		g.pinging = false
+		if errs[i] == nil {
+			continue
+		}
+		log.Printf("health check of buildlet %s failed: %v", g.Instance.Name(), errs[i])
+		g.Broken = true
+		for j, g2 := range p.pool {
+			if g == g2 {
+				p.destroyLocked(j, "unhealthy ")
+				break
+			}
+		}
+		if !p.draining && p.n < p.limit {
+			// Reserve space for the replacement.
+			p.n++
+			replace++
+		}
+	}
+	// The pool may have been drained or shrunk in the meantime.
+	p.trimLocked()
+	p.cond.Broadcast()
+	p.lock.Unlock()
+
+	for ; replace > 0; replace-- {
+		log.Printf("replacing unhealthy buildlet")
+		if _, err := p.create(false); err != nil {
+			log.Printf("failed to replace buildlet: %v", err)
+		}
+	}
+}
+
+// reapIdle destroys buildlets that have not been used for longer than
+// timeout.
+func (p *BuildletPool) reapIdle(timeout time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for i := 0; i < len(p.pool); {
+		g := p.pool[i]
+		if idle := now.Sub(g.lastUsed); !g.checkedOut && !g.pinging && idle > timeout {
+			log.Printf("buildlet %s unused for %s", g.Instance.Name(), idle.Round(time.Second))
+			p.destroyLocked(i, "idle ")
+			continue
+		}
+		i++
+	}
+}
+
+func (g *Gomote) Ping() error {
+	return g.Instance.Ping()
 }
@@ -0,0 +1,157 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// A job is a command to run on a buildlet from the pool.
+type job struct {
+	args []string // Command and arguments
+	puts syncFlag // Files to copy to the buildlet first
+	gets syncFlag // Directories to copy from the buildlet after
+}
+
+// runJob checks out a buildlet from the pool and runs j on it. It
+// writes the command's output to out and reports progress and errors
+// to l.
+//
+// It returns a non-nil error if the job failed for any reason. broken
+// is true if the buildlet itself failed, in which case it was checked
+// in as broken and running the job again may succeed.
+func runJob(j *job, out io.Writer, l *log.Logger) (broken bool, err error) {
+	rc, wc := connect(*poolName)
+	defer close(wc)
+
+	// Get a gomote.
+	wc <- ReqCheckout{}
+	var checkout RepCheckout
+	switch rep := (<-rc).(type) {
+	default:
+		err = fmt.Errorf("unexpected reply: %v", rep)
+
+	case nil:
+		err = errors.New("server disconnected")
+
+	case PipeChanError:
+		err = fmt.Errorf("gopool read error: %v", rep.Err)
+
+	case RepError:
+		err = errors.New(rep.Msg)
+
+	case RepCheckout:
+		checkout = rep
+	}
+	if err != nil {
+		l.Print(err)
+		return false, err
+	}
+	l.Printf("got buildlet %s", checkout.Name)
+	checkin := ReqCheckin{Fresh: checkout.Fresh, Broken: false}
+
+	backend, err := newBackend(checkout.Kind)
+	if err != nil {
+		l.Print(err)
+		return false, err
+	}
+	inst, err := backend.Open(checkout.Name)
+	if err != nil {
+		l.Print(err)
+		return false, err
+	}
+
+	// Set up gomote if fresh. If this fails, returning drops the
+	// connection, which tells the server to tear down the
+	// buildlet.
+	if checkout.Fresh && checkout.Setup != "" {
+		l.Print("setting up fresh buildlet")
+		cmd := exec.Command("/bin/sh", "-c", checkout.Setup)
+		cmd.Stdout = out
+		cmd.Stderr = l.Writer()
+		cmd.Env = append(os.Environ(), "VM="+checkout.Name)
+		err := cmd.Run()
+		if err != nil {
+			err = fmt.Errorf("failed to set up fresh buildlet: %v", err)
+			l.Print(err)
+			return false, err
+		}
+	}
+	checkin.Fresh = false
+
+	// Copy inputs.
+	var remoteErr, execErr error
+	for _, put := range j.puts {
+		if err := putPath(inst, put.src, put.dst); err != nil {
+			l.Printf("error copying inputs: %v", err)
+			remoteErr = err
+			break
+		}
+	}
+
+	// Run command.
+	if remoteErr == nil {
+		remoteErr, execErr = inst.Exec(j.args[0], j.args[1:], out)
+		if execErr != nil {
+			l.Printf("buildlet error: %v", execErr)
+			checkin.Broken = true
+		} else if remoteErr != nil {
+			l.Printf("error executing command: %v", remoteErr)
+		}
+	}
+
+	// Copy results, even if the command failed, since they may
+	// explain why.
+	var getErr error
+	for _, get := range j.gets {
+		if execErr != nil {
+			break
+		}
+		dst, err := getPath(inst, get.src, get.dst)
+		if err != nil {
+			l.Printf("error copying results: %v", err)
+			getErr = err
+			continue
+		}
+		l.Printf("copied %s to %s", get.src, dst)
+	}
+
+	// Check gomote back in.
+	wc <- checkin
+	var checkinErr error
+	switch rep := (<-rc).(type) {
+	default:
+		checkinErr = fmt.Errorf("unexpected reply: %v", rep)
+
+	case nil:
+		// Server disconnected. That's fine.
+
+	case PipeChanError:
+		checkinErr = fmt.Errorf("gopool read error: %v", rep.Err)
+
+	case RepError:
+		checkinErr = errors.New(rep.Msg)
+
+	case RepCheckin:
+	}
+	if checkinErr != nil {
+		l.Print(checkinErr)
+	}
+
+	switch {
+	case execErr != nil:
+		return true, execErr
+	case remoteErr != nil:
+		return false, remoteErr
+	case getErr != nil:
+		return false, getErr
+	}
+	return false, checkinErr
+}
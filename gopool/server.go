@@ -11,12 +11,21 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
-// TODO: Support multiple gopool instances.
+// socketName returns the name of the server socket for the pool
+// called name. This is in the abstract socket namespace, so it
+// doesn't need to be cleaned up.
+func socketName(name string) string {
+	if name == "" {
+		return "\x00gopool"
+	}
+	return "\x00gopool." + name
+}
 
-func create(kind string, limit int, setup string) {
-	lis, err := net.Listen("unix", "\x00gopool")
+func create(name, kind string, limit int, setup string, healthInterval, idleTimeout time.Duration) {
+	lis, err := net.Listen("unix", socketName(name))
 	if err != nil {
 		log.Fatalf("error creating server socket: %s", err)
 	}
@@ -30,16 +39,23 @@ func create(kind string, limit int, setup string) {
 	}()
 
 	s := poolServer{
-		NewBuildletPool(kind, limit),
-		setup,
+		p:     NewBuildletPool(kind, limit),
+		setup: setup,
+		lis:   lis,
 	}
 	defer s.shutdown()
+	if healthInterval > 0 {
+		s.p.StartHealthChecks(healthInterval)
+	}
+	if idleTimeout > 0 {
+		s.p.StartIdleReaper(idleTimeout)
+	}
 
 	Accept(lis, s.newConn)
 }
 
-func connect() (rc <-chan interface{}, wc chan<- interface{}) {
-	s, err := net.Dial("unix", "\x00gopool")
+func connect(name string) (rc <-chan interface{}, wc chan<- interface{}) {
+	s, err := net.Dial("unix", socketName(name))
 	if err != nil {
 		log.Fatalf("error connecting to gopool: %s", err)
 	}
@@ -49,6 +65,7 @@ func connect() (rc <-chan interface{}, wc chan<- interface{}) {
 type poolServer struct {
 	p     *BuildletPool
 	setup string
+	lis   net.Listener // Closed to stop the server
 }
 
 func (s *poolServer) shutdown() {
@@ -60,6 +77,7 @@ func (s *poolServer) shutdown() {
 func (s *poolServer) newConn(rc <-chan interface{}, wc chan<- interface{}) {
 	var err error
 	var gomote *Gomote
+	var drained bool
 	defer close(wc)
 loop:
 	for req := range rc {
@@ -82,7 +100,7 @@ loop:
 				if err == nil {
 					break
 				}
-				log.Printf("ping %s failed: %v", gomote.Buildlet.RemoteName(), err)
+				log.Printf("ping %s failed: %v", gomote.Instance.Name(), err)
 				gomote.Broken = true
 				s.p.Checkin(gomote)
 				gomote = nil
@@ -97,7 +115,7 @@ loop:
 				// initialized.
 				gomote.Fresh = false
 			}
-			wc <- RepCheckout{gomote.Buildlet.RemoteName(), gomote.Fresh, s.setup}
+			wc <- RepCheckout{s.p.kind, gomote.Instance.Name(), gomote.Fresh, s.setup}
 
 		case ReqCheckin:
 			if gomote == nil {
@@ -109,10 +127,37 @@ loop:
 			s.p.Checkin(gomote)
 			gomote = nil
 			wc <- RepCheckin{}
+
+		case ReqStatus:
+			limit, insts := s.p.Status()
+			wc <- RepStatus{s.p.kind, limit, s.setup, insts}
+
+		case ReqResize:
+			if req.Limit < 1 {
+				wc <- RepError{"limit must be at least 1"}
+				break
+			}
+			s.p.Resize(req.Limit)
+			wc <- RepResize{}
+
+		case ReqDrain:
+			if gomote != nil {
+				wc <- RepError{"cannot drain with a gomote checked out"}
+				break
+			}
+			s.p.Drain()
+			drained = true
+			wc <- RepDrain{}
 		}
 	}
 	log.Print("client disconnected")
 
+	if drained && s.lis != nil {
+		// Stop the server now that the client has its
+		// reply.
+		s.lis.Close()
+	}
+
 	// Clean up on client exit.
 	if gomote != nil {
 		if gomote.Fresh {
@@ -137,6 +182,7 @@ type RepError struct {
 type ReqCheckout struct{}
 
 type RepCheckout struct {
+	Kind  string // Backend kind
 	Name  string
 	Fresh bool
 	Setup string
@@ -149,10 +195,44 @@ type ReqCheckin struct {
 
 type RepCheckin struct{}
 
+type ReqStatus struct{}
+
+type RepStatus struct {
+	Kind      string
+	Limit     int
+	Setup     string
+	Instances []InstanceStatus
+}
+
+type InstanceStatus struct {
+	Name       string
+	CheckedOut bool
+	Fresh      bool
+	Broken     bool
+	Created    time.Time
+	LastUsed   time.Time
+}
+
+type ReqResize struct {
+	Limit int
+}
+
+type RepResize struct{}
+
+type ReqDrain struct{}
+
+type RepDrain struct{}
+
 func init() {
 	gob.Register(RepError{})
 	gob.Register(ReqCheckout{})
 	gob.Register(RepCheckout{})
 	gob.Register(ReqCheckin{})
 	gob.Register(RepCheckin{})
+	gob.Register(ReqStatus{})
+	gob.Register(RepStatus{})
+	gob.Register(ReqResize{})
+	gob.Register(RepResize{})
+	gob.Register(ReqDrain{})
+	gob.Register(RepDrain{})
 }
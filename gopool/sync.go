@@ -0,0 +1,260 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A syncFlag is a repeatable flag.Value of "src:dst" pairs.
+type syncFlag []syncPair
+
+type syncPair struct {
+	src, dst string
+}
+
+func (f *syncFlag) String() string {
+	var parts []string
+	for _, p := range *f {
+		parts = append(parts, p.src+":"+p.dst)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *syncFlag) Set(x string) error {
+	i := strings.Index(x, ":")
+	if i < 0 {
+		return fmt.Errorf("expected src:dst, got %q", x)
+	}
+	*f = append(*f, syncPair{x[:i], x[i+1:]})
+	return nil
+}
+
+// putPath copies the local file or directory local to the path remote
+// in inst's work directory. If local is a directory, its contents are
+// copied into remote. If local is a file and remote ends in "/", the
+// file is copied into the directory remote.
+func putPath(inst Instance, local, remote string) error {
+	st, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	dir, name := remote, ""
+	if !st.IsDir() {
+		if remote == "" || strings.HasSuffix(remote, "/") {
+			name = filepath.Base(local)
+		} else {
+			dir, name = path.Dir(remote), path.Base(remote)
+		}
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := writeTarGz(pw, local, name)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	err = inst.PutTar(pr, dir)
+	// Unblock the writer if PutTar stopped reading early.
+	pr.Close()
+	if localErr := <-errc; localErr != nil && localErr != io.ErrClosedPipe {
+		return localErr
+	}
+	if err != nil {
+		return fmt.Errorf("copying %s to %s:%s: %v", local, inst.Name(), remote, err)
+	}
+	return nil
+}
+
+// getPath copies the directory remote in inst's work directory to a
+// subdirectory of local named after inst, so results from different
+// instances don't collide. It returns the directory it wrote.
+func getPath(inst Instance, remote, local string) (string, error) {
+	dst := filepath.Join(local, filepath.Base(inst.Name()))
+	r, err := inst.GetTar(remote)
+	if err != nil {
+		return "", fmt.Errorf("copying %s:%s: %v", inst.Name(), remote, err)
+	}
+	defer r.Close()
+	if err := extractTarGz(r, dst); err != nil {
+		return "", fmt.Errorf("copying %s:%s to %s: %v", inst.Name(), remote, dst, err)
+	}
+	return dst, nil
+}
+
+// writeTarGz writes a gzipped tar archive of src to w. If src is a
+// directory, the archive contains its contents. Otherwise, the archive
+// contains just src, named name.
+func writeTarGz(w io.Writer, src, name string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := name
+		if p != src || info.IsDir() {
+			rel = filepath.ToSlash(p[len(src):])
+			rel = strings.TrimPrefix(rel, "/")
+			if rel == "" {
+				// The root directory itself.
+				return nil
+			}
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractTarGz extracts the gzipped tar archive r into dir.
+//
+// To keep the archive from writing outside dir, extractTarGz creates
+// symlinks only after writing everything else, rejects symlinks
+// inside other symlinks from the archive, and removes symlinks left
+// in dir by earlier extractions before writing through them.
+func extractTarGz(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	links := make(map[string]string) // Slash path → link target
+	var linkOrder []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		rel := path.Clean(hdr.Name)
+		if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("bad path %q in archive", hdr.Name)
+		}
+		if err := removeLinks(dir, rel); err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(rel))
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0777); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			if err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if _, ok := links[rel]; !ok {
+				linkOrder = append(linkOrder, rel)
+			}
+			links[rel] = hdr.Linkname
+		}
+	}
+
+	for _, rel := range linkOrder {
+		for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+			if _, ok := links[p]; ok {
+				return fmt.Errorf("symlink %q in archive is inside symlink %q", rel, p)
+			}
+		}
+	}
+	for _, rel := range linkOrder {
+		if err := removeLinks(dir, path.Dir(rel)); err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		os.Remove(dst)
+		if err := os.Symlink(links[rel], dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLinks removes the first symlink, if any, along the clean
+// slash-separated path rel in dir. Since extractTarGz only creates
+// symlinks after everything else, any symlink it finds was left by an
+// earlier extraction into dir and must not be written through.
+func removeLinks(dir, rel string) error {
+	if rel == "." {
+		return nil
+	}
+	p := dir
+	for _, elem := range strings.Split(rel, "/") {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// Nothing exists below p once it's removed.
+			return os.Remove(p)
+		}
+	}
+	return nil
+}
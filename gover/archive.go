@@ -0,0 +1,314 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An exported build is a gzipped tar file. The first entry is
+// archiveManifestName, which lists every file in the build along
+// with its SHA-1 hash. The remaining entries are the distinct file
+// contents, each named "objects/<hash>", so files shared within the
+// build are stored only once. Import checks every object against its
+// hash and adds it to the deduplication cache, so importing a build
+// shares files with the saved builds already present.
+
+const archiveManifestName = "manifest.json"
+
+type archiveManifest struct {
+	Name  string   // full build name
+	Names []string // labels of the build
+	Files []archiveFile
+}
+
+type archiveFile struct {
+	Path string // slash-separated path in the build
+	Hash string
+	Mode os.FileMode
+}
+
+func doExport(name, file string) {
+	savePath, ok := resolveName(name)
+	if !ok {
+		log.Fatalf("unknown name `%s'", name)
+	}
+	builds, err := listBuilds(listNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var info *buildInfo
+	for _, b := range builds {
+		if sameFile(b.path, savePath) {
+			info = b
+		}
+	}
+	if info == nil {
+		log.Fatalf("`%s' is not a saved build", name)
+	}
+	if file == "" {
+		file = info.shortName() + ".tar.gz"
+	}
+
+	// Hash the build's files.
+	m := archiveManifest{Name: info.fullName(), Names: info.names}
+	objects := make(map[string]string) // hash -> path of a file with that content
+	err = filepath.Walk(info.path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel := filepath.ToSlash(p[len(info.path)+1:])
+		if rel == usedFile || rel == manifestFile {
+			return nil
+		}
+		hash, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, archiveFile{rel, hash, fi.Mode().Perm()})
+		if _, ok := objects[hash]; !ok {
+			objects[hash] = p
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	// Write the manifest.
+	mjson, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	hdr := &tar.Header{Name: archiveManifestName, Mode: 0666, Size: int64(len(mjson)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := tw.Write(mjson); err != nil {
+		log.Fatal(err)
+	}
+
+	// Write the objects in a deterministic order.
+	hashes := make([]string, 0, len(objects))
+	for hash := range objects {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		if err := writeObject(tw, hash, objects[hash]); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "exported `%s' to %s (%d files, %d distinct)\n", info.shortName(), file, len(m.Files), len(hashes))
+}
+
+func writeObject(tw *tar.Writer, hash, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    "objects/" + hash,
+		Mode:    int64(st.Mode().Perm()),
+		Size:    st.Size(),
+		ModTime: st.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func doImport(file string) {
+	m, err := importArchive(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	savePath := filepath.Join(*verDir, m.Name)
+
+	// Add any labels that aren't already taken.
+	var names []string
+	for _, name := range m.Names {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			log.Printf("not adding bad name `%s'", name)
+			continue
+		}
+		namePath := filepath.Join(*verDir, name)
+		if _, err := os.Lstat(namePath); err == nil {
+			log.Printf("not adding name `%s': already exists", name)
+			continue
+		}
+		doLink(m.Name, namePath)
+		names = append(names, name)
+	}
+	msg := fmt.Sprintf("imported build `%s'", m.Name)
+	if len(names) > 0 {
+		msg += fmt.Sprintf(" as %s", strings.Join(names, ", "))
+	}
+	fmt.Fprintln(os.Stderr, msg)
+	enforceQuota(savePath)
+}
+
+// importArchive saves the build in archive file under its full name
+// and returns the archive's manifest. It does not add the build's
+// names. On error, it leaves no partial build behind.
+func importArchive(file string) (*archiveManifest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	tr := tar.NewReader(gz)
+
+	// Read and check the manifest.
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if hdr.Name != archiveManifestName {
+		return nil, fmt.Errorf("%s: not a gover archive", file)
+	}
+	var m archiveManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: bad manifest: %s", file, err)
+	}
+	if !hashPlusRe.MatchString(m.Name) {
+		return nil, fmt.Errorf("%s: bad build name `%s'", file, m.Name)
+	}
+	byHash := make(map[string][]archiveFile)
+	for _, af := range m.Files {
+		if p := path.Clean(af.Path); p != af.Path || path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return nil, fmt.Errorf("%s: bad path %q in manifest", file, af.Path)
+		}
+		byHash[af.Hash] = append(byHash[af.Hash], af)
+	}
+
+	savePath := filepath.Join(*verDir, m.Name)
+	if _, err := os.Stat(savePath); err == nil {
+		return nil, fmt.Errorf("saved build `%s' already exists", m.Name)
+	}
+
+	// Unpack into a temporary directory so an interrupted or
+	// failed import doesn't leave a partial build.
+	if err := os.MkdirAll(*verDir, 0777); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(*verDir, ".import-")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(format string, args ...interface{}) (*archiveManifest, error) {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf(format, args...)
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return fail("%s", err)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail("%s: %s", file, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		hash := strings.TrimPrefix(hdr.Name, "objects/")
+		afs, ok := byHash[hash]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return fail("%s: unexpected entry %s", file, hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fail("%s: %s", file, err)
+		}
+		if got := fmt.Sprintf("%x", sha1.Sum(data)); got != hash {
+			return fail("%s: %s has hash %s", file, hdr.Name, got)
+		}
+		for _, af := range afs {
+			if err := saveFile(hdr.Name, data, af.Mode, hdr.ModTime, filepath.Join(tmp, filepath.FromSlash(af.Path))); err != nil {
+				return fail("%s", err)
+			}
+		}
+		delete(byHash, hash)
+	}
+	for hash, afs := range byHash {
+		return fail("%s: missing object %s for %s", file, hash, afs[0].Path)
+	}
+
+	if err := writeManifest(tmp); err != nil {
+		return fail("%s", err)
+	}
+	if err := os.Rename(tmp, savePath); err != nil {
+		return fail("%s", err)
+	}
+	return &m, nil
+}
+
+// hashFile returns the hex SHA-1 hash of the contents of file p.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// sameFile returns whether paths a and b refer to the same file.
+func sameFile(a, b string) bool {
+	st1, err1 := os.Stat(a)
+	st2, err2 := os.Stat(b)
+	return err1 == nil && err2 == nil && os.SameFile(st1, st2)
+}
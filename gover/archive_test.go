@@ -0,0 +1,166 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testBuildName = "0123456789012345678901234567890123456789"
+
+// tempVerDir points -dir at a new temporary directory until the
+// returned function is called.
+func tempVerDir(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gover-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *verDir
+	*verDir = dir
+	return func() {
+		*verDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+// testObject is an entry in a test archive.
+type testObject struct {
+	hdr  tar.Header
+	data string
+}
+
+// object returns an archive entry for data, named by its hash.
+func object(data string) testObject {
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(data)))
+	return testObject{tar.Header{Name: "objects/" + hash, Mode: 0644, Size: int64(len(data))}, data}
+}
+
+// writeArchive writes an archive with manifest m and objects to a
+// file in dir and returns its path.
+func writeArchive(t *testing.T, dir string, m *archiveManifest, objects ...testObject) string {
+	t.Helper()
+	f, err := ioutil.TempFile(dir, "archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	mjson, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects = append([]testObject{{tar.Header{Name: archiveManifestName, Mode: 0644, Size: int64(len(mjson))}, string(mjson)}}, objects...)
+	for _, o := range objects {
+		if err := tw.WriteHeader(&o.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(o.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestImport(t *testing.T) {
+	defer tempVerDir(t)()
+
+	a, b := object("a"), object("b")
+	aHash := strings.TrimPrefix(a.hdr.Name, "objects/")
+	bHash := strings.TrimPrefix(b.hdr.Name, "objects/")
+	m := &archiveManifest{Name: testBuildName, Files: []archiveFile{
+		{"src/a", aHash, 0644},
+		{"src/sub/a", aHash, 0644},
+		{"bin/b", bHash, 0755},
+	}}
+	file := writeArchive(t, *verDir, m, a, b)
+	if _, err := importArchive(file); err != nil {
+		t.Fatal(err)
+	}
+	savePath := filepath.Join(*verDir, testBuildName)
+	for _, af := range m.Files {
+		p := filepath.Join(savePath, filepath.FromSlash(af.Path))
+		if h, err := hashFile(p); err != nil || h != af.Hash {
+			t.Errorf("%s: got hash %s, %v, want %s", af.Path, h, err, af.Hash)
+		}
+		if !isDeduped(p, af.Hash) {
+			t.Errorf("%s is not linked to the dedup cache", af.Path)
+		}
+	}
+	if !sameFile(filepath.Join(savePath, "src/a"), filepath.Join(savePath, "src/sub/a")) {
+		t.Errorf("identical files were not shared")
+	}
+	if want, err := readManifest(savePath); err != nil || len(want) != len(m.Files) {
+		t.Errorf("got manifest %v, %v, want %d files", want, err, len(m.Files))
+	}
+
+	// The same build can't be imported twice.
+	if _, err := importArchive(file); err == nil {
+		t.Errorf("importing existing build succeeded")
+	}
+}
+
+func TestImportReject(t *testing.T) {
+	defer tempVerDir(t)()
+
+	a := object("a")
+	aHash := strings.TrimPrefix(a.hdr.Name, "objects/")
+	empty := object("")
+	emptyHash := strings.TrimPrefix(empty.hdr.Name, "objects/")
+	symlink := empty
+	symlink.hdr.Typeflag, symlink.hdr.Linkname = tar.TypeSymlink, "/etc/passwd"
+	files := func(path, hash string) *archiveManifest {
+		return &archiveManifest{Name: testBuildName, Files: []archiveFile{{path, hash, 0644}}}
+	}
+
+	for _, test := range []struct {
+		name    string
+		m       *archiveManifest
+		objects []testObject
+		err     string
+	}{
+		{"parent", files("..", aHash), []testObject{a}, "bad path"},
+		{"escape", files("../x", aHash), []testObject{a}, "bad path"},
+		{"unclean", files("src/../../x", aHash), []testObject{a}, "bad path"},
+		{"absolute", files("/tmp/x", aHash), []testObject{a}, "bad path"},
+		{"dot", files(".", aHash), []testObject{a}, "bad path"},
+		{"symlink", files("src/x", emptyHash), []testObject{symlink}, "unexpected entry"},
+		{"unlisted", files("src/x", aHash), []testObject{a, object("b")}, "unexpected entry"},
+		{"hash", files("src/x", aHash), []testObject{{a.hdr, "b"}}, "has hash"},
+		{"missing", files("src/x", aHash), nil, "missing object"},
+		{"name", &archiveManifest{Name: "../x"}, nil, "bad build name"},
+	} {
+		file := writeArchive(t, *verDir, test.m, test.objects...)
+		_, err := importArchive(file)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+		os.Remove(file)
+
+		// Nothing should be left behind.
+		fis, _ := ioutil.ReadDir(*verDir)
+		for _, fi := range fis {
+			if fi.Name() != "_dedup" {
+				t.Errorf("%s: import left %s behind", test.name, fi.Name())
+			}
+		}
+	}
+}
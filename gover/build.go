@@ -0,0 +1,189 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A revBuild is a request to build and save a commit other than the
+// one checked out in GOROOT.
+type revBuild struct {
+	rev  string // revision as given by the user
+	name string // optional name for the build
+	hash string // build name (commit hash plus configuration)
+}
+
+// resolveRev returns the full commit hash of rev in the GOROOT
+// repository, or "" if rev does not name a commit.
+func resolveRev(rev string) string {
+	c := exec.Command("git", "-C", goroot(), "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	out, err := c.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// doBuildRevs builds and saves each of specs, which have the form
+// rev or rev=name, running up to jobs builds at a time. Each build
+// happens in a temporary git worktree, so the GOROOT checkout is
+// untouched.
+func doBuildRevs(specs []string, jobs int) {
+	if jobs < 1 {
+		log.Fatal("-j must be at least 1")
+	}
+
+	// Resolve everything first so mistakes are reported before
+	// starting long builds.
+	var builds []*revBuild
+	seen := make(map[string]string)
+	cfgHash := currentConfig().hash()
+	for _, spec := range specs {
+		b := &revBuild{rev: spec}
+		if i := strings.Index(spec, "="); i >= 0 {
+			b.rev, b.name = spec[:i], spec[i+1:]
+		}
+		commit := resolveRev(b.rev)
+		if commit == "" {
+			log.Fatalf("unknown revision `%s'", b.rev)
+		}
+		b.hash = commit
+		if cfgHash != "" {
+			b.hash += "@" + cfgHash
+		}
+		if prev, ok := seen[b.hash]; ok {
+			log.Fatalf("`%s' and `%s' are the same commit", prev, b.rev)
+		}
+		seen[b.hash] = b.rev
+		if b.name != "" {
+			namePath, nameExists := resolveName(b.name)
+			savePath, hashExists := resolveName(b.hash)
+			if nameExists && !(hashExists && sameFile(namePath, savePath)) {
+				log.Fatalf("name `%s' exists and refers to another build", b.name)
+			}
+		}
+		builds = append(builds, b)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		sem    = make(chan bool, jobs)
+		mu     sync.Mutex
+		failed int
+		saved  []string
+	)
+	for _, b := range builds {
+		savePath, hashExists := resolveName(b.hash)
+		if hashExists {
+			msg := fmt.Sprintf("saved build `%s' already exists", b.hash)
+			if b.name != "" {
+				if _, ok := resolveName(b.name); !ok {
+					// Other builds may be running, so
+					// don't exit on failure.
+					if err := os.Symlink(b.hash, filepath.Join(*verDir, b.name)); err != nil {
+						mu.Lock()
+						log.Print(err)
+						failed++
+						mu.Unlock()
+						continue
+					}
+					msg += fmt.Sprintf("; added name `%s'", b.name)
+				}
+			}
+			mu.Lock()
+			fmt.Fprintln(os.Stderr, msg)
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(b *revBuild) {
+			defer func() { <-sem; wg.Done() }()
+
+			// With a single job, show the build as it
+			// happens. Otherwise, only show the output of
+			// failed builds.
+			var out io.Writer = os.Stdout
+			var buf bytes.Buffer
+			if jobs > 1 {
+				out = &buf
+			}
+			err := buildRev(b, out)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				os.Stdout.Write(buf.Bytes())
+				log.Printf("building %s: %s", b.rev, err)
+				failed++
+				return
+			}
+			saved = append(saved, savePath)
+			if b.name == "" {
+				fmt.Fprintf(os.Stderr, "saved %s as `%s'\n", b.rev, b.hash)
+			} else {
+				fmt.Fprintf(os.Stderr, "saved %s as `%s' and `%s'\n", b.rev, b.hash, b.name)
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	enforceQuota(saved...)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// buildRev builds b in a temporary worktree and saves it.
+func buildRev(b *revBuild, out io.Writer) error {
+	tmp, err := ioutil.TempDir("", "gover-build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	tree := filepath.Join(tmp, "go")
+
+	commit, _, _ := splitBuildName(b.hash)
+	c := exec.Command("git", "-C", goroot(), "worktree", "add", "--detach", tree, commit)
+	if *verbose {
+		fmt.Printf("git %s\n", strings.Join(c.Args[1:], " "))
+	}
+	if msg, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("git worktree add failed: %s\n%s", err, msg)
+	}
+	defer func() {
+		c := exec.Command("git", "-C", goroot(), "worktree", "remove", "--force", tree)
+		if err := c.Run(); err != nil {
+			// Clean up after ourselves as best we can.
+			os.RemoveAll(tree)
+			exec.Command("git", "-C", goroot(), "worktree", "prune").Run()
+		}
+	}()
+
+	if err := doBuild(tree, out); err != nil {
+		return err
+	}
+	if err := saveBuild(tree, b.hash, nil); err != nil {
+		// Don't leave a partial build in the cache.
+		savePath, _ := resolveName(b.hash)
+		os.RemoveAll(savePath)
+		return err
+	}
+	if b.name != "" {
+		return os.Symlink(b.hash, filepath.Join(*verDir, b.name))
+	}
+	return nil
+}
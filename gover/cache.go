@@ -15,14 +15,33 @@ import (
 	"time"
 )
 
-var hashNameRe = regexp.MustCompile(`^[0-9a-f]{7,40}(\+[0-9a-f]{1,10})?$`)
+// Saved builds are named commit[+delta][@config], where delta is a
+// hash of the uncommitted diff and config is the fingerprint of a
+// non-default build configuration.
+var hashNameRe = regexp.MustCompile(`^[0-9a-f]{7,40}(\+[0-9a-f]{1,10})?(@[0-9a-f]{1,10})?$`)
 var fullHashRe = regexp.MustCompile("^[0-9a-f]{40}$")
-var hashPlusRe = regexp.MustCompile(`^[0-9a-f]{40}(\+[0-9a-f]{10})?$`)
+var hashPlusRe = regexp.MustCompile(`^[0-9a-f]{40}(\+[0-9a-f]{10})?(@[0-9a-f]{10})?$`)
+
+// splitBuildName splits a build name into its commit, delta, and
+// config parts.
+func splitBuildName(name string) (commit, delta, config string) {
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, config = name[:i], name[i+1:]
+	}
+	if i := strings.Index(name, "+"); i >= 0 {
+		name, delta = name[:i], name[i+1:]
+	}
+	return name, delta, config
+}
 
 // resolveName returns the path to the root of the named build and
 // whether or not that path exists. It will log an error and exit if
 // name is ambiguous. If the path does not exist, the returned path is
 // where this build should be saved.
+//
+// A hash name that omits the configuration only matches builds of the
+// current environment's configuration, so a full name as returned by
+// getHash only matches the build saved at exactly that path.
 func resolveName(name string) (path string, ok bool) {
 	// If the name exactly matches a saved version, return it.
 	savePath := filepath.Join(*verDir, name)
@@ -33,32 +52,42 @@ func resolveName(name string) (path string, ok bool) {
 
 	// Otherwise, try to resolve it as an unambiguous hash prefix.
 	if hashNameRe.MatchString(name) {
-		nameParts := strings.SplitN(name, "+", 2)
+		commit, delta, config := splitBuildName(name)
+		hasDelta := strings.Contains(name, "+")
+		hasConfig := strings.Contains(name, "@")
+		if !hasConfig {
+			config = currentConfig().hash()
+		}
 		builds, err := listBuilds(0)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		var fullName string
+		var matches []*buildInfo
 		for _, b := range builds {
-			if !strings.HasPrefix(b.commitHash, nameParts[0]) {
+			if !strings.HasPrefix(b.commitHash, commit) {
 				continue
 			}
-			if (len(nameParts) == 1) != (b.deltaHash == "") {
+			if hasDelta == (b.deltaHash == "") {
 				continue
 			}
-			if len(nameParts) > 1 && !strings.HasPrefix(b.deltaHash, nameParts[1]) {
+			if !strings.HasPrefix(b.deltaHash, delta) {
 				continue
 			}
-
-			// We found a match.
-			if fullName != "" {
-				log.Fatalf("ambiguous name `%s`", name)
+			if hasConfig && !strings.HasPrefix(b.configHash, config) || !hasConfig && b.configHash != config {
+				continue
 			}
-			fullName = b.fullName()
+			matches = append(matches, b)
 		}
-		if fullName != "" {
-			return filepath.Join(*verDir, fullName), true
+		if len(matches) > 1 {
+			var names []string
+			for _, b := range matches {
+				names = append(names, b.shortName())
+			}
+			log.Fatalf("ambiguous name `%s'; could be %s", name, strings.Join(names, ", "))
+		}
+		if len(matches) == 1 {
+			return filepath.Join(*verDir, matches[0].fullName()), true
 		}
 	}
 
@@ -69,23 +98,30 @@ type buildInfo struct {
 	path       string
 	commitHash string
 	deltaHash  string
+	configHash string
 	names      []string
 	commit     *commit
+	config     buildConfig
 }
 
 func (i buildInfo) fullName() string {
-	if i.deltaHash == "" {
-		return i.commitHash
-	}
-	return i.commitHash + "+" + i.deltaHash
+	return i.name(i.commitHash)
 }
 
 func (i buildInfo) shortName() string {
 	// TODO: Print more than 7 characters if necessary.
-	if i.deltaHash == "" {
-		return i.commitHash[:7]
+	return i.name(i.commitHash[:7])
+}
+
+func (i buildInfo) name(commitHash string) string {
+	name := commitHash
+	if i.deltaHash != "" {
+		name += "+" + i.deltaHash
+	}
+	if i.configHash != "" {
+		name += "@" + i.configHash
 	}
-	return i.commitHash[:7] + "+" + i.deltaHash
+	return name
 }
 
 type listFlags int
@@ -93,6 +129,7 @@ type listFlags int
 const (
 	listNames listFlags = 1 << iota
 	listCommit
+	listConfig
 )
 
 func listBuilds(flags listFlags) ([]*buildInfo, error) {
@@ -113,11 +150,8 @@ func listBuilds(flags listFlags) ([]*buildInfo, error) {
 		if !file.IsDir() || !hashPlusRe.MatchString(file.Name()) {
 			continue
 		}
-		nameParts := strings.SplitN(file.Name(), "+", 2)
-		info := &buildInfo{path: filepath.Join(*verDir, file.Name()), commitHash: nameParts[0]}
-		if len(nameParts) > 1 {
-			info.deltaHash = nameParts[1]
-		}
+		info := &buildInfo{path: filepath.Join(*verDir, file.Name())}
+		info.commitHash, info.deltaHash, info.configHash = splitBuildName(file.Name())
 
 		builds = append(builds, info)
 		if baseMap != nil {
@@ -132,6 +166,13 @@ func listBuilds(flags listFlags) ([]*buildInfo, error) {
 				info.commit = parseCommit(commit)
 			}
 		}
+
+		if flags&listConfig != 0 {
+			info.config, err = readConfig(info.path)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
 	// Collect the names for each build.
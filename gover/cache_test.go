@@ -0,0 +1,102 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitBuildName(t *testing.T) {
+	for _, test := range []struct {
+		name                  string
+		commit, delta, config string
+	}{
+		{"abc", "abc", "", ""},
+		{"abc+123", "abc", "123", ""},
+		{"abc@456", "abc", "", "456"},
+		{"abc+123@456", "abc", "123", "456"},
+	} {
+		commit, delta, config := splitBuildName(test.name)
+		if commit != test.commit || delta != test.delta || config != test.config {
+			t.Errorf("splitBuildName(%q) = %q, %q, %q, want %q, %q, %q", test.name, commit, delta, config, test.commit, test.delta, test.config)
+		}
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	defer tempVerDir(t)()
+	defer setConfigEnv(t)()
+
+	const (
+		other  = "fedcba9876543210fedcba9876543210fedcba98"
+		delta  = "+0123456789"
+		config = "@abcdef0123"
+	)
+	for _, dir := range []string{
+		testBuildName + config,
+		testBuildName + delta,
+		other,
+		other + config,
+	} {
+		if err := os.Mkdir(filepath.Join(*verDir, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(other, filepath.Join(*verDir, "name")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		want string // build path, relative to verDir
+		ok   bool
+	}{
+		{"name", "name", true},
+		{"missing", "missing", false},
+		{other, other, true},
+		{other[:7], other, true},
+		{other[:7] + "@abc", other + config, true},
+		{other + config, other + config, true},
+
+		// The default configuration of testBuildName isn't
+		// saved, so its name must not resolve to a variant.
+		{testBuildName, testBuildName, false},
+		{testBuildName[:7], testBuildName[:7], false},
+		{testBuildName[:7] + "@a", testBuildName + config, true},
+		{testBuildName[:7] + "+0", testBuildName + delta, true},
+		{testBuildName + "+1", testBuildName + "+1", false},
+	} {
+		path, ok := resolveName(test.name)
+		if want := filepath.Join(*verDir, test.want); path != want || ok != test.ok {
+			t.Errorf("resolveName(%q) = %s, %v, want %s, %v", test.name, path, ok, want, test.ok)
+		}
+	}
+
+	// In the variant's configuration, names without a
+	// configuration resolve to the variant.
+	defer setConfigEnv(t, "GOARCH=386", "CGO_ENABLED=0")()
+	cfg := "@" + currentConfig().hash()
+	for _, dir := range []string{testBuildName + cfg, other + cfg} {
+		if err := os.Mkdir(filepath.Join(*verDir, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{testBuildName[:7], testBuildName + cfg},
+		{testBuildName + cfg, testBuildName + cfg},
+		{other[:7], other + cfg},
+		{other, other},
+	} {
+		path, ok := resolveName(test.name)
+		if want := filepath.Join(*verDir, test.want); path != want || !ok {
+			t.Errorf("with %s: resolveName(%q) = %s, %v, want %s, true", currentConfig(), test.name, path, ok, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// configVars are the environment variables that affect the result of
+// make.bash, beyond the source tree itself.
+var configVars = []string{
+	"GOOS", "GOARCH",
+	"GO386", "GOAMD64", "GOARM",
+	"GOEXPERIMENT",
+	"CGO_ENABLED",
+	"GO_GCFLAGS", "GO_LDFLAGS",
+}
+
+// A buildConfig is a build configuration, represented as a sorted
+// list of "VAR=value" settings for configVars. Variables that are
+// unset, or that are set to the host's default, are omitted, so the
+// default configuration is empty.
+type buildConfig []string
+
+// currentConfig returns the build configuration of the environment.
+func currentConfig() buildConfig {
+	var cfg buildConfig
+	for _, v := range configVars {
+		x := os.Getenv(v)
+		if x == "" || v == "GOOS" && x == runtime.GOOS || v == "GOARCH" && x == runtime.GOARCH {
+			continue
+		}
+		cfg = append(cfg, v+"="+x)
+	}
+	return cfg
+}
+
+// hash returns the fingerprint of cfg, which distinguishes builds of
+// the same tree with different configurations. It returns "" for the
+// default configuration, so the names of those builds have no
+// configuration suffix.
+func (cfg buildConfig) hash() string {
+	if len(cfg) == 0 {
+		return ""
+	}
+	h := fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(cfg, "\n")+"\n")))
+	return h[:10]
+}
+
+func (cfg buildConfig) String() string {
+	return strings.Join(cfg, " ")
+}
+
+// env returns environ with the settings of cfg applied.
+func (cfg buildConfig) env(environ []string) []string {
+	var out []string
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i >= 0 && cfg.has(kv[:i+1]) {
+			continue
+		}
+		out = append(out, kv)
+	}
+	return append(out, cfg...)
+}
+
+// has returns whether cfg sets the variable with prefix "VAR=".
+func (cfg buildConfig) has(prefix string) bool {
+	for _, kv := range cfg {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConfig records cfg in the saved build at savePath.
+func writeConfig(savePath string, cfg buildConfig) error {
+	if len(cfg) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(savePath, "config"), []byte(strings.Join(cfg, "\n")+"\n"), 0666)
+}
+
+// readConfig returns the build configuration of the saved build at
+// savePath.
+func readConfig(savePath string) (buildConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(savePath, "config"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cfg buildConfig
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			cfg = append(cfg, line)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// setConfigEnv clears the environment variables in configVars, sets
+// the "VAR=value" settings in kvs, and returns a function that
+// restores the original environment.
+func setConfigEnv(t *testing.T, kvs ...string) func() {
+	t.Helper()
+	old := make(map[string]string)
+	for _, v := range configVars {
+		if x, ok := os.LookupEnv(v); ok {
+			old[v] = x
+		}
+		os.Unsetenv(v)
+	}
+	for _, kv := range kvs {
+		i := strings.Index(kv, "=")
+		os.Setenv(kv[:i], kv[i+1:])
+	}
+	return func() {
+		for _, v := range configVars {
+			if x, ok := old[v]; ok {
+				os.Setenv(v, x)
+			} else {
+				os.Unsetenv(v)
+			}
+		}
+	}
+}
+
+func TestCurrentConfig(t *testing.T) {
+	for _, test := range []struct {
+		env  []string
+		want buildConfig
+	}{
+		{nil, nil},
+		{[]string{"GOOS=" + runtime.GOOS, "GOARCH=" + runtime.GOARCH}, nil},
+		{[]string{"CGO_ENABLED=0"}, buildConfig{"CGO_ENABLED=0"}},
+		// Settings are in configVars order, not environment order.
+		{[]string{"GO_GCFLAGS=-N", "GOARCH=wasm"}, buildConfig{"GOARCH=wasm", "GO_GCFLAGS=-N"}},
+	} {
+		restore := setConfigEnv(t, test.env...)
+		got := currentConfig()
+		restore()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.env, got, test.want)
+		}
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	if h := buildConfig(nil).hash(); h != "" {
+		t.Errorf("default configuration has fingerprint %q, want \"\"", h)
+	}
+	a := buildConfig{"GOARCH=386"}.hash()
+	b := buildConfig{"GOARCH=386", "CGO_ENABLED=0"}.hash()
+	if len(a) != 10 || len(b) != 10 {
+		t.Errorf("fingerprints %q and %q are not 10 digits", a, b)
+	}
+	if a == b {
+		t.Errorf("different configurations have the same fingerprint %q", a)
+	}
+	if !hashPlusRe.MatchString(testBuildName + "@" + a) {
+		t.Errorf("build name with fingerprint %q is not a valid build name", a)
+	}
+	// The fingerprint is part of saved build names, so it must not
+	// change.
+	if want := "f0a5b95d2c"; a != want {
+		t.Errorf("got fingerprint %q, want %q", a, want)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	cfg := buildConfig{"GOARCH=386", "CGO_ENABLED=0"}
+	got := cfg.env([]string{"HOME=/home", "GOARCH=amd64", "GOARCH_X=1", "CGO_ENABLED=1"})
+	want := []string{"HOME=/home", "GOARCH_X=1", "GOARCH=386", "CGO_ENABLED=0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestConfigReadWrite(t *testing.T) {
+	defer tempVerDir(t)()
+
+	if err := writeConfig(*verDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(*verDir + "/config"); !os.IsNotExist(err) {
+		t.Errorf("default configuration wrote a config file")
+	}
+	for _, cfg := range []buildConfig{nil, {"GOARCH=386", "CGO_ENABLED=0"}} {
+		if err := writeConfig(*verDir, cfg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readConfig(*verDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, cfg) {
+			t.Errorf("got %v, want %v", got, cfg)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Saved builds share files through hard links to the _dedup store,
+// so the space a build uses is not simply the size of its tree. For
+// accounting, each file's disk space is owned by a build if that
+// build is the only one linking to it, and is otherwise split evenly
+// among the builds that link to it. Removing a build frees exactly
+// the space it owns (once "gc" cleans the dedup store).
+
+// usedFile is the file in a saved build whose modification time
+// records when the build was last used.
+const usedFile = "used"
+
+type fileID struct {
+	dev, ino uint64
+}
+
+type fileUsage struct {
+	size int64      // bytes on disk
+	refs int        // number of builds linking to this file
+	last *buildInfo // last build found linking to this file
+}
+
+// quota is the disk quota for verDir, or 0 for no quota.
+var quota sizeFlag
+
+// diskUsage is the disk usage of the saved builds in verDir.
+type diskUsage struct {
+	builds  []*buildInfo
+	files   map[*buildInfo][]*fileUsage // distinct files of each build
+	total   int64                       // all files, including garbage
+	garbage int64                       // dedup files no build links to
+}
+
+func getDiskUsage() *diskUsage {
+	builds, err := listBuilds(listNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	u := &diskUsage{builds: builds, files: make(map[*buildInfo][]*fileUsage)}
+
+	all := make(map[fileID]*fileUsage)
+	add := func(info os.FileInfo, b *buildInfo) {
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return
+		}
+		id := fileID{uint64(st.Dev), uint64(st.Ino)}
+		f := all[id]
+		if f == nil {
+			f = &fileUsage{size: int64(st.Blocks) * 512}
+			all[id] = f
+			u.total += f.size
+		}
+		if b == nil {
+			return
+		}
+		if f.last == b {
+			// Linked more than once from the same build.
+			return
+		}
+		f.last = b
+		f.refs++
+		u.files[b] = append(u.files[b], f)
+	}
+
+	for _, b := range builds {
+		filepath.Walk(b.path, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				add(info, b)
+			}
+			return nil
+		})
+	}
+	filepath.Walk(filepath.Join(*verDir, "_dedup"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			add(info, nil)
+		}
+		return nil
+	})
+	for _, f := range all {
+		if f.refs == 0 {
+			u.garbage += f.size
+		}
+	}
+	return u
+}
+
+// owned returns the space owned by build b and b's share of space
+// shared with other builds.
+func (u *diskUsage) owned(b *buildInfo) (owned, shared int64) {
+	for _, f := range u.files[b] {
+		if f.refs == 1 {
+			owned += f.size
+		} else {
+			shared += f.size / int64(f.refs)
+		}
+	}
+	return
+}
+
+// lastUsed returns the time build b was last used by "with", or when
+// it was saved if it has never been used.
+func lastUsed(b *buildInfo) time.Time {
+	st, err := os.Stat(filepath.Join(b.path, usedFile))
+	if err != nil {
+		st, err = os.Stat(b.path)
+		if err != nil {
+			return time.Time{}
+		}
+	}
+	return st.ModTime()
+}
+
+// markUsed records that the build at savePath was just used.
+func markUsed(savePath string) {
+	path := filepath.Join(savePath, usedFile)
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		var f *os.File
+		f, err = os.Create(path)
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		// Not fatal.
+		log.Println(err)
+	}
+}
+
+func doDU() {
+	u := getDiskUsage()
+	sort.Slice(u.builds, func(i, j int) bool {
+		return lastUsed(u.builds[i]).After(lastUsed(u.builds[j]))
+	})
+
+	fmt.Printf("%8s %8s %-19s %s\n", "OWNED", "SHARED", "LAST USED", "BUILD")
+	for _, b := range u.builds {
+		owned, shared := u.owned(b)
+		fmt.Printf("%8s %8s %s %s", formatSize(owned), formatSize(shared), lastUsed(b).Local().Format("2006-01-02T15:04:05"), b.shortName())
+		if len(b.names) > 0 {
+			fmt.Printf(" %s", b.names)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("total %s in %d build(s)", formatSize(u.total), len(u.builds))
+	if u.garbage > 0 {
+		fmt.Printf(", %s unused (run gover gc)", formatSize(u.garbage))
+	}
+	if int64(quota) > 0 {
+		fmt.Printf(", quota %s", formatSize(int64(quota)))
+	}
+	fmt.Println()
+}
+
+// enforceQuota removes the least recently used unlabeled builds,
+// other than the builds at keepPaths, until the saved builds fit in
+// the quota. It then cleans the dedup store.
+func enforceQuota(keepPaths ...string) {
+	if int64(quota) <= 0 {
+		return
+	}
+	u := getDiskUsage()
+	if u.total <= int64(quota) {
+		return
+	}
+
+	keep := make(map[string]bool)
+	for _, p := range keepPaths {
+		keep[p] = true
+	}
+	var lru []*buildInfo
+	for _, b := range u.builds {
+		if len(b.names) == 0 && !keep[b.path] {
+			lru = append(lru, b)
+		}
+	}
+	sort.Slice(lru, func(i, j int) bool {
+		return lastUsed(lru[i]).Before(lastUsed(lru[j]))
+	})
+
+	// Garbage in the dedup store is freed regardless.
+	need := u.total - u.garbage
+	rms := 0
+	for _, b := range lru {
+		if need <= int64(quota) {
+			break
+		}
+		if err := os.RemoveAll(b.path); err != nil {
+			// Not fatal.
+			log.Println(err)
+			continue
+		}
+		for _, f := range u.files[b] {
+			if f.refs--; f.refs == 0 {
+				need -= f.size
+			}
+		}
+		rms++
+	}
+	if rms > 0 {
+		fmt.Fprintf(os.Stderr, "evicted %d least recently used unlabeled build(s)\n", rms)
+	}
+	if need > int64(quota) {
+		log.Printf("saved builds use %s, which exceeds quota of %s", formatSize(need), formatSize(int64(quota)))
+	}
+	doGC()
+}
+
+// sizeFlag is a flag.Value for a size in bytes with an optional K,
+// M, G, or T suffix.
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	if *s == 0 {
+		return "0"
+	}
+	return formatSize(int64(*s))
+}
+
+func (s *sizeFlag) Set(x string) error {
+	shift := uint(0)
+	if x != "" {
+		if i := strings.IndexByte("KMGT", x[len(x)-1]); i >= 0 {
+			shift = 10 * uint(i+1)
+			x = x[:len(x)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(x, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("bad size %q", x)
+	}
+	*s = sizeFlag(v * float64(int64(1)<<shift))
+	return nil
+}
+
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	unit := -1
+	for f >= 1024 && unit < len(units)-1 {
+		f /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[unit])
+}
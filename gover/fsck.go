@@ -0,0 +1,387 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Each saved build has a manifest listing the SHA-1 hash of every
+// file in the build. "gover fsck" checks saved builds against their
+// manifests and checks that files in the deduplication cache match
+// the hashes they're named by.
+//
+// Files at the top level of a saved build are metadata written by
+// gover, such as the commit object. Files in subdirectories are the
+// Go tree itself and, unless saved with -no-dedup, are hard links to
+// the deduplication cache.
+
+// manifestFile is the file in a saved build listing its contents.
+const manifestFile = "manifest"
+
+// quarantineDir is the directory under verDir where fsck moves
+// builds it cannot repair.
+const quarantineDir = "_quarantine"
+
+// writeManifest hashes the files in the saved build at savePath and
+// writes its manifest.
+func writeManifest(savePath string) error {
+	m, err := hashTree(savePath, nil)
+	if err != nil {
+		return err
+	}
+	var buf strings.Builder
+	for _, path := range sortedManifest(m) {
+		fmt.Fprintf(&buf, "%s %s\n", m[path], path)
+	}
+	// Write to a new file rather than overwriting in place, in
+	// case the manifest is a hard link.
+	f, err := ioutil.TempFile(savePath, ".tmp-")
+	if err == nil {
+		_, err = f.WriteString(buf.String())
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Chmod(f.Name(), 0644)
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(savePath, manifestFile))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	return err
+}
+
+// readManifest reads the manifest of the saved build at savePath. It
+// returns a map from slash-separated paths to hashes, or nil if the
+// build has no manifest.
+func readManifest(savePath string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(savePath, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fs := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fs) != 2 || len(fs[0]) != 40 {
+			return nil, fmt.Errorf("%s: malformed manifest line %q", savePath, scanner.Text())
+		}
+		m[fs[1]] = fs[0]
+	}
+	return m, scanner.Err()
+}
+
+// hashTree returns the hashes of the files in the saved build at
+// savePath, other than the manifest and usage files. hashes caches
+// file hashes by inode, and may be nil.
+func hashTree(savePath string, hashes map[fileID]string) (map[string]string, error) {
+	m := make(map[string]string)
+	err := filepath.Walk(savePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel := filepath.ToSlash(path[len(savePath)+1:])
+		if rel == manifestFile || rel == usedFile || strings.HasPrefix(rel, ".tmp-") {
+			return nil
+		}
+		hash, err := cachedHash(path, info, hashes)
+		if err != nil {
+			return err
+		}
+		m[rel] = hash
+		return nil
+	})
+	return m, err
+}
+
+func cachedHash(path string, info os.FileInfo, hashes map[fileID]string) (string, error) {
+	var id fileID
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && hashes != nil {
+		id = fileID{uint64(st.Dev), uint64(st.Ino)}
+		if hash, ok := hashes[id]; ok {
+			return hash, nil
+		}
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	if hashes != nil {
+		hashes[id] = hash
+	}
+	return hash, nil
+}
+
+func sortedManifest(m map[string]string) []string {
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// fsckState accumulates the results of "gover fsck".
+type fsckState struct {
+	repair   bool
+	hashes   map[fileID]string // file hashes by inode
+	badDedup map[string]bool   // hashes of corrupt dedup files
+	checked  int               // number of builds checked
+	problems int
+	fixed    int
+}
+
+func (s *fsckState) problem(format string, args ...interface{}) {
+	s.problems++
+	fmt.Printf(format+"\n", args...)
+}
+
+func doFsck(repair bool, names []string) {
+	s, err := fsck(repair, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("checked %d build(s): %d problem(s)", s.checked, s.problems)
+	if s.repair {
+		fmt.Printf(", %d repaired", s.fixed)
+	}
+	fmt.Println()
+	if s.problems > s.fixed {
+		os.Exit(1)
+	}
+}
+
+// fsck checks the dedup cache and the saved builds called names (by
+// default, all of them), reporting problems as it finds them.
+func fsck(repair bool, names []string) (*fsckState, error) {
+	s := &fsckState{repair: repair, hashes: make(map[fileID]string), badDedup: make(map[string]bool)}
+
+	// Check the dedup store first, so build checks can tell
+	// whether a file can be restored from it.
+	s.checkDedup()
+
+	builds, err := listBuilds(listNames)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		var sel []*buildInfo
+		for _, name := range names {
+			savePath, ok := resolveName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown name `%s'", name)
+			}
+			for _, b := range builds {
+				if sameFile(b.path, savePath) {
+					sel = append(sel, b)
+				}
+			}
+		}
+		builds = sel
+	}
+	for _, b := range builds {
+		s.checkBuild(b)
+	}
+	s.checked = len(builds)
+
+	if s.repair && len(s.badDedup) > 0 {
+		// Remove corrupt files from the store so future
+		// saves don't link to them. Any builds using them
+		// have been quarantined.
+		for hash := range s.badDedup {
+			if err := os.Remove(dedupPath(hash)); err != nil {
+				log.Println(err)
+			} else {
+				s.fixed++
+			}
+		}
+	}
+	return s, nil
+}
+
+// checkDedup checks that every file in the dedup store matches its
+// name.
+func (s *fsckState) checkDedup() {
+	dir := filepath.Join(*verDir, "_dedup")
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(filepath.Base(path), ".tmp-") {
+			// Left behind by an interrupted save.
+			s.problem("%s: stale temporary file", path)
+			if s.repair && os.Remove(path) == nil {
+				s.fixed++
+			}
+			return nil
+		}
+		if !goodDedupPath.MatchString(path) {
+			s.problem("%s: unexpected file in dedup cache", path)
+			return nil
+		}
+		want := filepath.Base(filepath.Dir(path)) + filepath.Base(path)
+		hash, err := cachedHash(path, info, s.hashes)
+		if err != nil {
+			s.problem("%s: %s", path, err)
+			return nil
+		}
+		if hash != want {
+			s.problem("%s: corrupt (content hash %s)", path, hash)
+			s.badDedup[want] = true
+		}
+		return nil
+	})
+}
+
+// checkBuild checks saved build b against its manifest and, if
+// repairing, fixes or quarantines it.
+func (s *fsckState) checkBuild(b *buildInfo) {
+	name := b.shortName()
+	want, err := readManifest(b.path)
+	if err != nil {
+		s.problem("%s: %s", name, err)
+		return
+	}
+	if want == nil {
+		s.problem("%s: no manifest", name)
+		if s.repair {
+			// Trust the current contents.
+			if err := writeManifest(b.path); err != nil {
+				log.Println(err)
+			} else {
+				s.fixed++
+			}
+		}
+		return
+	}
+	have, err := hashTree(b.path, s.hashes)
+	if err != nil {
+		s.problem("%s: %s", name, err)
+		return
+	}
+
+	quarantine := false
+	for _, path := range sortedManifest(want) {
+		hash, ok := have[path]
+		file := filepath.Join(b.path, filepath.FromSlash(path))
+		switch {
+		case !ok:
+			s.problem("%s: missing %s", name, path)
+		case hash != want[path]:
+			s.problem("%s: corrupt %s", name, path)
+		case !*noDedup && strings.Contains(path, "/") && !isDeduped(file, hash):
+			// The content is right, but the file isn't
+			// linked to the store, for example because the
+			// tree was copied.
+			s.problem("%s: not linked to dedup cache: %s", name, path)
+			if s.repair && relink(file, hash, true) {
+				s.fixed++
+			}
+			continue
+		default:
+			continue
+		}
+		if s.repair {
+			if relink(file, want[path], false) {
+				s.fixed++
+			} else {
+				quarantine = true
+			}
+		}
+	}
+	for _, path := range sortedManifest(have) {
+		if _, ok := want[path]; ok {
+			continue
+		}
+		s.problem("%s: extra file %s", name, path)
+		if s.repair && os.Remove(filepath.Join(b.path, filepath.FromSlash(path))) == nil {
+			s.fixed++
+		}
+	}
+
+	if quarantine {
+		s.quarantine(b)
+	}
+}
+
+// isDeduped returns whether file is linked to the dedup cache entry
+// for hash.
+func isDeduped(file, hash string) bool {
+	return sameFile(file, dedupPath(hash))
+}
+
+// relink replaces file with a link to the dedup cache entry for hash.
+// If the cache has no good entry for hash and file has the right
+// content (which the caller indicates with fileGood), relink moves
+// file into the cache. It returns whether it succeeded.
+func relink(file, hash string, fileGood bool) bool {
+	xfile := dedupPath(hash)
+	if h, err := hashFile(xfile); err != nil || h != hash {
+		if !fileGood {
+			return false
+		}
+		if err := os.MkdirAll(filepath.Dir(xfile), 0777); err != nil {
+			log.Println(err)
+			return false
+		}
+		if err := os.Rename(file, xfile); err != nil {
+			log.Println(err)
+			return false
+		}
+	} else {
+		os.Remove(file)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		log.Println(err)
+		return false
+	}
+	if err := os.Link(xfile, file); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// quarantine moves build b out of the way, along with its names.
+func (s *fsckState) quarantine(b *buildInfo) {
+	dst := filepath.Join(*verDir, quarantineDir, b.fullName())
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		log.Println(err)
+		return
+	}
+	os.RemoveAll(dst)
+	if err := os.Rename(b.path, dst); err != nil {
+		log.Println(err)
+		return
+	}
+	for _, name := range b.names {
+		os.Remove(filepath.Join(*verDir, name))
+	}
+	if len(b.names) > 0 {
+		data := strings.Join(b.names, "\n") + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dst, "names"), []byte(data), 0666); err != nil {
+			log.Println(err)
+		}
+	}
+	fmt.Printf("%s: quarantined in %s\n", b.shortName(), dst)
+}
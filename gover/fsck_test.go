@@ -0,0 +1,179 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func hashString(data string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(data)))
+}
+
+func TestHashTree(t *testing.T) {
+	defer tempVerDir(t)()
+
+	files := map[string]string{
+		"commit":       "commit",
+		"src/a":        "a",
+		"src/sub/b":    "b",
+		manifestFile:   "manifest",
+		usedFile:       "used",
+		".tmp-123":     "tmp",
+		"src/.tmp-456": "not at top level",
+	}
+	for path, data := range files {
+		p := filepath.Join(*verDir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(*verDir, "src/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := hashTree(*verDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for _, path := range []string{"commit", "src/a", "src/sub/b", "src/.tmp-456"} {
+		want[path] = hashString(files[path])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// saveTestBuild saves a build with files src/a and src/b, named
+// "test", and returns its path.
+func saveTestBuild(t *testing.T) string {
+	t.Helper()
+	savePath := filepath.Join(*verDir, testBuildName)
+	if err := os.MkdirAll(savePath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(savePath, "commit"), []byte("commit"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := saveFile(name, []byte(name), 0644, time.Now(), filepath.Join(savePath, "src", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeManifest(savePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(testBuildName, filepath.Join(*verDir, "test")); err != nil {
+		t.Fatal(err)
+	}
+	return savePath
+}
+
+func TestFsckRepair(t *testing.T) {
+	write := func(path, data string) {
+		os.Remove(path)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		damage func(savePath string)
+	}{
+		{"clean", func(string) {}},
+		{"corrupt", func(p string) { write(filepath.Join(p, "src/a"), "x") }},
+		{"unlinked", func(p string) { write(filepath.Join(p, "src/a"), "a") }},
+		{"missing", func(p string) { os.Remove(filepath.Join(p, "src/a")) }},
+		{"extra", func(p string) { write(filepath.Join(p, "src/c"), "c") }},
+		{"no manifest", func(p string) { os.Remove(filepath.Join(p, manifestFile)) }},
+		{"dedup temp", func(string) { write(filepath.Join(filepath.Dir(dedupPath(hashString("a"))), ".tmp-1"), "") }},
+	} {
+		func() {
+			defer tempVerDir(t)()
+			savePath := saveTestBuild(t)
+			test.damage(savePath)
+
+			s, err := fsck(true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantProblems := 1
+			if test.name == "clean" {
+				wantProblems = 0
+			}
+			if s.checked != 1 || s.problems != wantProblems || s.fixed != s.problems {
+				t.Errorf("%s: checked %d build(s), %d problem(s), %d fixed; want 1, %d, %d", test.name, s.checked, s.problems, s.fixed, wantProblems, wantProblems)
+			}
+
+			// The build should be back to its saved state.
+			for _, name := range []string{"a", "b"} {
+				file := filepath.Join(savePath, "src", name)
+				if !isDeduped(file, hashString(name)) {
+					t.Errorf("%s: src/%s is not linked to the dedup cache", test.name, name)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(savePath, "src/c")); !os.IsNotExist(err) {
+				t.Errorf("%s: extra file not removed", test.name)
+			}
+			if s, err := fsck(false, nil); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if s.problems != 0 {
+				t.Errorf("%s: %d problem(s) after repair", test.name, s.problems)
+			}
+		}()
+	}
+}
+
+func TestFsckQuarantine(t *testing.T) {
+	defer tempVerDir(t)()
+	savePath := saveTestBuild(t)
+
+	// Corrupt src/a through its link, so the build and the dedup
+	// cache are both wrong.
+	if err := ioutil.WriteFile(filepath.Join(savePath, "src/a"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := fsck(true, []string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The corrupt cache entry and build are both problems, but
+	// only removing the cache entry is a fix.
+	if s.problems != 2 || s.fixed != 1 {
+		t.Errorf("got %d problem(s), %d fixed; want 2, 1", s.problems, s.fixed)
+	}
+	if _, err := os.Stat(savePath); !os.IsNotExist(err) {
+		t.Errorf("build was not moved out of the way")
+	}
+	if _, err := os.Lstat(filepath.Join(*verDir, "test")); !os.IsNotExist(err) {
+		t.Errorf("build name was not removed")
+	}
+	names, err := ioutil.ReadFile(filepath.Join(*verDir, quarantineDir, testBuildName, "names"))
+	if err != nil || string(names) != "test\n" {
+		t.Errorf("got quarantined names %q, %v, want %q", names, err, "test\n")
+	}
+	if _, err := os.Stat(dedupPath(hashString("a"))); !os.IsNotExist(err) {
+		t.Errorf("corrupt dedup cache entry was not removed")
+	}
+
+	if s, err := fsck(false, nil); err != nil {
+		t.Error(err)
+	} else if s.checked != 0 || s.problems != 0 {
+		t.Errorf("after quarantine got %d build(s), %d problem(s); want 0, 0", s.checked, s.problems)
+	}
+}
@@ -30,6 +30,14 @@
 //
 // Like "save", but first run make.bash in the current tree.
 //
+//     gover [flags] build [-j N] [-rev] <rev>[=<name>]...
+//
+// Build and save each git revision <rev>, optionally naming it
+// <name>. Each revision is checked out and built in a temporary git
+// worktree, so this does not touch the current tree. With -j, run up
+// to N builds at once. A single argument without "=<name>" is taken
+// as a name for the current tree, as above, unless -rev is given.
+//
 //     gover [flags] <name> <args>...
 //
 // Run "go <args>..." using saved build <name>. <name> may be an
@@ -48,10 +56,65 @@
 //
 // List saved builds.
 //
-//     gover [flags] gc
+// gover distinguishes builds of the same tree with different build
+// configurations, such as GOEXPERIMENT, GOOS, GOARCH, GOAMD64,
+// CGO_ENABLED, or GO_GCFLAGS settings. These builds are saved with a
+// configuration fingerprint suffix, as in "f2e4c8b@1a2b3c4d5e", and
+// "gover list" shows their settings. When a hash name omits the
+// suffix, gover uses the build matching the current environment. The
+// with and env subcommands apply the build's configuration to the
+// environment.
+//
+//     gover [flags] verify <name> [packages]
+//
+// Check that build <name> can build and test packages (by default,
+// std). This is mainly useful for builds saved with -slim, which
+// saves only the source files, testdata directories, and package
+// archives that std and cmd depend on according to "go list".
+//
+//     gover [flags] export <name> [file]
+//
+// Write saved build <name> to file as a compressed archive. The
+// default file name is the build's short hash followed by ".tar.gz".
+//
+//     gover [flags] import <file>
+//
+// Save the build in archive <file>, which was written by "gover
+// export", under its commit hash and its original names. The archive
+// stores each distinct file once, named by its SHA-1 hash; import
+// checks these hashes and shares files with existing saved builds.
+//
+//     gover [flags] du
+//
+// Show the disk space used by each saved build. Since saved builds
+// share identical files, this shows both the space each build owns
+// outright, which removing it would free, and its share of the
+// space used by files it has in common with other builds.
+//
+//     gover [flags] fsck [-repair] [name...]
+//
+// Check saved builds (by default, all of them) for corruption. When
+// gover saves a build, it records the SHA-1 hash of every file in a
+// manifest. fsck re-hashes the files in each build and in the
+// deduplication cache and reports files that are corrupt, missing,
+// extra, or no longer linked to the cache. With -repair, it restores
+// files from the cache where it can, removes extra and corrupt files,
+// and moves builds it cannot repair to the _quarantine directory.
+//
+//     gover [flags] gc [-rm-unlabeled]
 //
 // Clean the deduplication cache. This is useful after removing saved
-// builds to free up space.
+// builds to free up space. With -rm-unlabeled, first remove all saved
+// builds that have no name.
+//
+//
+// Quota
+//
+// If the -quota flag or the GOVER_QUOTA environment variable sets a
+// disk quota, gover treats unlabeled builds as a cache. When save,
+// build, or gc find that the saved builds exceed the quota, they
+// remove the unlabeled builds that were least recently used by
+// "with" (or by running go with a build) until the saved builds fit.
 //
 //
 // Recipies
@@ -62,16 +125,19 @@
 //     for tag in $(git tag | grep '^go[0-9.]*$'); do
 //       git checkout $tag && git clean -df && gover build ${tag##go}
 //     done
+//
+// To build and save the last 20 commits, four at a time, for use
+// with benchmany:
+//
+//     gover build -j 4 $(git rev-list -n 20 HEAD)
 package main
 
-// TODO: Should untagged saved commits be treated like a cache and
-// deleted automatically?
-
 import (
 	"bytes"
 	"crypto/sha1"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -83,6 +149,7 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // TODO: Consider also accepting a path for name, which could let this
@@ -90,14 +157,11 @@ import (
 
 // TODO: Half of these global flags only apply to save and build.
 
-// TODO: The hash and diff hash aren't everything. Environment
-// variables like GOEXPERIMENT also affect the build, but right now
-// goenv save will complain that the hash already exists.
-
 var (
 	verbose    = flag.Bool("v", false, "print commands being run")
 	verDir     = flag.String("dir", defaultVerDir(), "`directory` of saved Go roots")
 	noDedup    = flag.Bool("no-dedup", false, "disable deduplication of saved trees")
+	slim       = flag.Bool("slim", false, "save only the files std and cmd need to build and test")
 	gorootFlag = flag.String("C", defaultGoroot(), "use `dir` as the root of the Go tree for save and build")
 )
 
@@ -150,17 +214,29 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Usage:\n")
 		fmt.Fprintf(os.Stderr, "  %s [flags] save [name] - save Go build tree\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s [flags] build [name] - build and save current tree\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags] build [-j N] [-rev] <rev>[=<name>]... - build and save revisions in temporary worktrees\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s [flags] <name> <args>... - run go <args> using build <name>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s [flags] with <name> <command>... - run <command> using build <name>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s [flags] env <name> - print the environment for build <name> as shell code\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s [flags] list - list saved builds\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags] verify <name> [packages] - check that build <name> can build and test packages\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags] export <name> [file] - write build <name> to an archive\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags] import <file> - save the build in an archive\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags] du - show disk space used by saved builds\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags] fsck [-repair] [name...] - check saved builds for corruption\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s [flags] gc [-rm-unlabeled] - clean the deduplication cache", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\n\n")
-		fmt.Fprintf(os.Stderr, "<name> may be an unambiguous commit hash or a string name.\n\n")
+		fmt.Fprintf(os.Stderr, "<name> may be an unambiguous commit hash, optionally with an @config suffix, or a string name.\n\n")
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
 	}
 
+	if x := os.Getenv("GOVER_QUOTA"); x != "" {
+		if err := quota.Set(x); err != nil {
+			log.Fatalf("GOVER_QUOTA: %s", err)
+		}
+	}
+	flag.Var(&quota, "quota", "evict least recently used unlabeled builds to keep saved builds under `size` (default $GOVER_QUOTA)")
 	flag.Parse()
 	if flag.NArg() < 1 {
 		flag.Usage()
@@ -182,14 +258,32 @@ func main() {
 		// to name it. You have to "gover build x", but you're
 		// not building at all.
 
-		if flag.NArg() > 2 {
+		args := flag.Args()[1:]
+		if flag.Arg(0) == "build" {
+			fs := flag.NewFlagSet("build", flag.ExitOnError)
+			fs.Usage = flag.Usage
+			jobs := fs.Int("j", 1, "build `N` revisions concurrently")
+			revs := fs.Bool("rev", false, "treat a single argument as a revision to build")
+			fs.Parse(args)
+			args = fs.Args()
+			if *revs && len(args) == 0 {
+				flag.Usage()
+				os.Exit(2)
+			}
+			if *revs || len(args) > 1 || len(args) == 1 && strings.Contains(args[0], "=") {
+				doBuildRevs(args, *jobs)
+				break
+			}
+		}
+
+		if len(args) > 1 {
 			flag.Usage()
 			os.Exit(2)
 		}
 		hash, diff := getHash()
 		name := ""
-		if flag.NArg() >= 2 {
-			name = flag.Arg(1)
+		if len(args) >= 1 {
+			name = args[0]
 			if name == hash {
 				name = ""
 			}
@@ -222,7 +316,9 @@ func main() {
 				os.Exit(0)
 			}
 
-			doBuild()
+			if err := doBuild(goroot(), os.Stdout); err != nil {
+				log.Fatal(err)
+			}
 		} else {
 			if hashExists {
 				log.Fatalf("saved build `%s' already exists", hash)
@@ -231,7 +327,7 @@ func main() {
 				log.Fatalf("saved build `%s' already exists", name)
 			}
 		}
-		doSave(hash, diff)
+		doSave(goroot(), hash, diff)
 		if namePath != "" {
 			doLink(hash, namePath)
 		}
@@ -240,6 +336,7 @@ func main() {
 		} else {
 			fmt.Fprintf(os.Stderr, "saved build as `%s' and `%s'\n", hash, name)
 		}
+		enforceQuota(savePath)
 
 	case "list":
 		if flag.NArg() > 1 {
@@ -262,6 +359,50 @@ func main() {
 		}
 		doEnv(flag.Arg(1))
 
+	case "verify":
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		doVerify(flag.Arg(1), flag.Args()[2:])
+
+	case "export":
+		if flag.NArg() != 2 && flag.NArg() != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		doExport(flag.Arg(1), flag.Arg(2))
+
+	case "import":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		doImport(flag.Arg(1))
+
+	case "du":
+		if flag.NArg() > 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		doDU()
+
+	case "fsck":
+		fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+		fs.Usage = flag.Usage
+		repair := fs.Bool("repair", false, "repair or quarantine corrupt builds")
+		// Allow flags after names, too.
+		var names []string
+		for args := flag.Args()[1:]; ; {
+			fs.Parse(args)
+			if fs.NArg() == 0 {
+				break
+			}
+			names = append(names, fs.Arg(0))
+			args = fs.Args()[1:]
+		}
+		doFsck(*repair, names)
+
 	case "gc":
 		if flag.NArg() == 2 && flag.Arg(1) == "-rm-unlabeled" {
 			doRemoveUnlabeled()
@@ -270,6 +411,7 @@ func main() {
 			os.Exit(2)
 		}
 		doGC()
+		enforceQuota()
 
 	default:
 		if flag.NArg() < 2 {
@@ -291,40 +433,69 @@ func goroot() string {
 }
 
 func gitCmd(cmd string, args ...string) string {
+	output, err := gitOutput(cmd, args...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return output
+}
+
+// gitOutput runs git cmd args in GOROOT and returns its output.
+func gitOutput(cmd string, args ...string) (string, error) {
 	args = append([]string{"-C", goroot(), cmd}, args...)
 	c := exec.Command("git", args...)
 	c.Stderr = os.Stderr
 	output, err := c.Output()
 	if err != nil {
-		log.Fatalf("error executing git %s: %s", strings.Join(args, " "), err)
+		return "", fmt.Errorf("error executing git %s: %s", strings.Join(args, " "), err)
 	}
-	return string(output)
+	return string(output), nil
 }
 
+// getHash returns the build name for the current tree and build
+// configuration, and the uncommitted diff, if any.
 func getHash() (string, []byte) {
 	rev := strings.TrimSpace(string(gitCmd("rev-parse", "HEAD")))
 
 	diff := []byte(gitCmd("diff", "HEAD"))
 
+	name := rev
 	if len(bytes.TrimSpace(diff)) > 0 {
 		diffHash := fmt.Sprintf("%x", sha1.Sum(diff))
-		return rev + "+" + diffHash[:10], diff
+		name += "+" + diffHash[:10]
+	} else {
+		diff = nil
+	}
+	if cfgHash := currentConfig().hash(); cfgHash != "" {
+		name += "@" + cfgHash
 	}
-	return rev, nil
+	return name, diff
 }
 
-func doBuild() {
+// doBuild runs make.bash in the Go tree at root, writing its output
+// to w.
+func doBuild(root string, w io.Writer) error {
 	c := exec.Command("./make.bash")
-	c.Dir = filepath.Join(goroot(), "src")
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	c.Dir = filepath.Join(root, "src")
+	c.Stdout = w
+	c.Stderr = w
 	if err := c.Run(); err != nil {
-		log.Fatalf("error executing make.bash: %s", err)
-		os.Exit(1)
+		return fmt.Errorf("error executing make.bash: %s", err)
 	}
+	return nil
 }
 
-func doSave(hash string, diff []byte) {
+// doSave saves the Go tree at root as build hash. root must be a
+// checkout of hash's commit, plus diff.
+func doSave(root, hash string, diff []byte) {
+	if err := saveBuild(root, hash, diff); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// saveBuild is like doSave, but returns any error. It may leave a
+// partial build behind on error.
+func saveBuild(root, hash string, diff []byte) error {
 	// Create a minimal GOROOT at $GOROOT/gover/hash.
 	savePath, _ := resolveName(hash)
 	goos, goarch := runtime.GOOS, runtime.GOARCH
@@ -336,39 +507,59 @@ func doSave(hash string, diff []byte) {
 	}
 	osArch := goos + "_" + goarch
 
-	goroot := goroot()
+	goroot := root
 	for _, binTool := range binTools {
 		src := filepath.Join(goroot, "bin", binTool)
 		if _, err := os.Stat(src); err == nil {
-			cp(src, filepath.Join(savePath, "bin", binTool))
+			if err := cp(src, filepath.Join(savePath, "bin", binTool)); err != nil {
+				return err
+			}
+		}
+	}
+	trees := []string{
+		filepath.Join("pkg", "tool", osArch),
+		filepath.Join("pkg", "include"),
+		// Tracer static resources.
+		filepath.Join("misc", "trace"),
+	}
+	if *slim {
+		if err := saveSlim(goroot, osArch, savePath); err != nil {
+			return err
+		}
+	} else {
+		trees = append(trees, filepath.Join("pkg", osArch), "src")
+	}
+	for _, tree := range trees {
+		if err := cpR(filepath.Join(goroot, tree), filepath.Join(savePath, tree)); err != nil {
+			return err
 		}
 	}
-	cpR(filepath.Join(goroot, "pkg", osArch), filepath.Join(savePath, "pkg", osArch))
-	cpR(filepath.Join(goroot, "pkg", "tool", osArch), filepath.Join(savePath, "pkg", "tool", osArch))
-	cpR(filepath.Join(goroot, "pkg", "include"), filepath.Join(savePath, "pkg", "include"))
-	// TODO: Use "go list" and save only the stuff depended on? Or
-	// maybe just save the types of files go list can return, plus
-	// "testdata" directories?
-	cpR(filepath.Join(goroot, "src"), filepath.Join(savePath, "src"))
-	// Copy tracer static resources.
-	cpR(filepath.Join(goroot, "misc", "trace"), filepath.Join(savePath, "misc", "trace"))
 
 	if diff != nil {
 		if err := ioutil.WriteFile(filepath.Join(savePath, "diff"), diff, 0666); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 
 	// Save commit object.
-	commit := gitCmd("cat-file", "commit", "HEAD")
+	commitHash, _, _ := splitBuildName(hash)
+	commit, err := gitOutput("cat-file", "commit", commitHash)
+	if err != nil {
+		return err
+	}
 	if err := ioutil.WriteFile(filepath.Join(savePath, "commit"), []byte(commit), 0666); err != nil {
-		log.Fatal(err)
+		return err
 	}
+
+	if err := writeConfig(savePath, currentConfig()); err != nil {
+		return err
+	}
+
+	return writeManifest(savePath)
 }
 
 func doLink(hash, namePath string) {
-	err := os.Symlink(hash, namePath)
-	if err != nil {
+	if err := os.Symlink(hash, namePath); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -388,7 +579,7 @@ func (s buildInfoSorter) Swap(i, j int) {
 }
 
 func doList() {
-	builds, err := listBuilds(listNames | listCommit)
+	builds, err := listBuilds(listNames | listCommit | listConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -403,6 +594,12 @@ func doList() {
 		if len(info.names) > 0 {
 			fmt.Printf(" %s", info.names)
 		}
+		if len(info.config) > 0 {
+			fmt.Printf(" (%s)", info.config)
+		}
+		if isSlim(info.path) {
+			fmt.Printf(" slim")
+		}
 		if info.commit.topLine != "" {
 			fmt.Printf(" %s", info.commit.topLine)
 		}
@@ -415,7 +612,8 @@ func doWith(name string, cmd []string) {
 	if !ok {
 		log.Fatalf("unknown name `%s'", name)
 	}
-	goroot, path := getEnv(savePath)
+	env, path := buildEnv(savePath)
+	markUsed(savePath)
 
 	// exec.Command looks up the command in this process' PATH.
 	// Unfortunately, this is a rather complex process and there's
@@ -423,15 +621,7 @@ func doWith(name string, cmd []string) {
 	// PATH.
 	os.Setenv("PATH", path)
 	c := exec.Command(cmd[0], cmd[1:]...)
-
-	// Build the rest of the command environment.
-	for _, env := range os.Environ() {
-		if strings.HasPrefix(env, "GOROOT=") {
-			continue
-		}
-		c.Env = append(c.Env, env)
-	}
-	c.Env = append(c.Env, "GOROOT="+goroot)
+	c.Env = env
 
 	// Run command.
 	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
@@ -447,10 +637,33 @@ func doEnv(name string) {
 		log.Fatalf("unknown name `%s'", name)
 	}
 
+	cfg, err := readConfig(savePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	goroot, path := getEnv(savePath)
 	fmt.Printf("PATH=%s;\n", shellEscape(path))
 	fmt.Printf("GOROOT=%s;\n", shellEscape(goroot))
 	fmt.Printf("export GOROOT;\n")
+	for _, kv := range cfg {
+		i := strings.Index(kv, "=")
+		fmt.Printf("%s=%s;\n", kv[:i], shellEscape(kv[i+1:]))
+		fmt.Printf("export %s;\n", kv[:i])
+	}
+}
+
+// buildEnv returns the complete environment for running commands
+// with the Go tree rooted at savePath, and the PATH in that
+// environment.
+func buildEnv(savePath string) (env []string, path string) {
+	goroot, path := getEnv(savePath)
+	cfg, err := readConfig(savePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	env = environWithout(cfg.env(os.Environ()), "GOROOT=", "PATH=")
+	return append(env, "GOROOT="+goroot, "PATH="+path), path
 }
 
 // getEnv returns the GOROOT and PATH for the Go tree rooted at savePath.
@@ -516,16 +729,25 @@ func doGC() {
 	fmt.Printf("removed %d MB in %d unused file(s)\n", space>>20, removed)
 }
 
-func cp(src, dst string) {
+func cp(src, dst string) error {
 	data, err := ioutil.ReadFile(src)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
 	}
+	return saveFile(src, data, st.Mode(), st.ModTime(), dst)
+}
 
+// saveFile writes data to dst with the given mode and modification
+// time. Unless -no-dedup is set, it stores data in the deduplication
+// cache and links dst to it. src is only used for -v output.
+func saveFile(src string, data []byte, mode os.FileMode, mtime time.Time, dst string) error {
 	writeFile, xdst := true, dst
 	if !*noDedup {
-		hash := fmt.Sprintf("%x", sha1.Sum(data))
-		xdst = filepath.Join(*verDir, "_dedup", hash[:2], hash[2:])
+		xdst = dedupPath(fmt.Sprintf("%x", sha1.Sum(data)))
 		if _, err := os.Stat(xdst); err == nil {
 			writeFile = false
 		}
@@ -534,18 +756,32 @@ func cp(src, dst string) {
 		if *verbose {
 			fmt.Printf("cp %s %s\n", src, xdst)
 		}
-		st, err := os.Stat(src)
+		if err := os.MkdirAll(filepath.Dir(xdst), 0777); err != nil {
+			return err
+		}
+		// Write to a temporary file and rename it into place
+		// so concurrent or interrupted saves never leave a
+		// partial file in the cache.
+		f, err := ioutil.TempFile(filepath.Dir(xdst), ".tmp-")
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		if err := os.MkdirAll(filepath.Dir(xdst), 0777); err != nil {
-			log.Fatal(err)
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Chmod(mode)
 		}
-		if err := ioutil.WriteFile(xdst, data, st.Mode()); err != nil {
-			log.Fatal(err)
+		if err2 := f.Close(); err == nil {
+			err = err2
 		}
-		if err := os.Chtimes(xdst, st.ModTime(), st.ModTime()); err != nil {
-			log.Fatal(err)
+		if err == nil {
+			err = os.Chtimes(f.Name(), mtime, mtime)
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), xdst)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
 		}
 	}
 
@@ -554,16 +790,23 @@ func cp(src, dst string) {
 			fmt.Printf("ln %s %s\n", xdst, dst)
 		}
 		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
-			log.Fatal(err)
+			return err
 		}
 		if err := os.Link(xdst, dst); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
+	return nil
 }
 
-func cpR(src, dst string) {
-	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+// dedupPath returns the path in the deduplication cache of the file
+// with the given SHA-1 hash.
+func dedupPath(hash string) string {
+	return filepath.Join(*verDir, "_dedup", hash[:2], hash[2:])
+}
+
+func cpR(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
 			return nil
 		}
@@ -572,7 +815,6 @@ func cpR(src, dst string) {
 			return nil
 		}
 
-		cp(path, dst+path[len(src):])
-		return nil
+		return cp(path, dst+path[len(src):])
 	})
 }
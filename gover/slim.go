@@ -0,0 +1,274 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A slim save keeps only the parts of src that "go list" reports the
+// standard library and commands need, plus the testdata directories
+// in and above their directories and the module files that make src
+// a valid module tree. It keeps only the installed package archives
+// of those packages.
+
+// slimPackages are the package patterns a slim save keeps.
+var slimPackages = []string{"std", "cmd"}
+
+// slimFile is the file in a saved build that marks it as slim and
+// lists the package patterns it was saved for.
+const slimFile = "slim"
+
+// moduleFiles are the files under src that go list needs to treat
+// std and cmd as modules, if they exist.
+var moduleFiles = []string{
+	"go.mod", "go.sum", "vendor/modules.txt",
+	"cmd/go.mod", "cmd/go.sum", "cmd/vendor/modules.txt",
+}
+
+// listedPackage is the subset of "go list -json" output gover uses.
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	Target     string
+
+	GoFiles, CgoFiles, CFiles, CXXFiles, MFiles, HFiles, FFiles []string
+	SFiles, SwigFiles, SwigCXXFiles, SysoFiles                  []string
+	TestGoFiles, XTestGoFiles                                   []string
+	EmbedFiles, TestEmbedFiles, XTestEmbedFiles                 []string
+
+	Error *struct {
+		Err string
+	}
+	DepsErrors []*struct {
+		Err string
+	}
+}
+
+// files returns the paths of the files in p's directory that are
+// needed to build and test it.
+func (p *listedPackage) files() []string {
+	var out []string
+	for _, list := range [][]string{
+		p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.MFiles, p.HFiles, p.FFiles,
+		p.SFiles, p.SwigFiles, p.SwigCXXFiles, p.SysoFiles,
+		p.TestGoFiles, p.XTestGoFiles,
+		p.EmbedFiles, p.TestEmbedFiles, p.XTestEmbedFiles,
+	} {
+		for _, name := range list {
+			if !filepath.IsAbs(name) {
+				// Generated files, such as test mains,
+				// have absolute paths.
+				name = filepath.Join(p.Dir, name)
+			}
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// goList runs "go list -e -json -deps -test pkgs..." using the Go tree
+// at goroot with environment env, and returns the listed packages.
+func goList(goroot string, env []string, pkgs []string) ([]*listedPackage, error) {
+	args := append([]string{"list", "-e", "-json", "-deps", "-test"}, pkgs...)
+	c := exec.Command(filepath.Join(goroot, "bin", "go"), args...)
+	c.Env = env
+	c.Stderr = os.Stderr
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if *verbose {
+		fmt.Printf("go %s\n", strings.Join(args, " "))
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	var list []*listedPackage
+	dec := json.NewDecoder(out)
+	for {
+		p := new(listedPackage)
+		if err := dec.Decode(p); err == io.EOF {
+			break
+		} else if err != nil {
+			c.Wait()
+			return nil, fmt.Errorf("decoding go list output: %s", err)
+		}
+		list = append(list, p)
+	}
+	if err := c.Wait(); err != nil {
+		return nil, fmt.Errorf("go list failed: %s", err)
+	}
+	return list, nil
+}
+
+// saveSlim saves the parts of goroot's src and pkg/osArch trees that
+// slimPackages depend on to savePath.
+func saveSlim(goroot, osArch, savePath string) error {
+	env := append(environWithout(os.Environ(), "GOROOT="), "GOROOT="+goroot)
+	pkgs, err := goList(goroot, env, slimPackages)
+	if err != nil {
+		return err
+	}
+
+	src := filepath.Join(goroot, "src") + string(filepath.Separator)
+	files := make(map[string]bool)
+	testdata := make(map[string]bool)
+	targets := make(map[string]bool)
+	for _, p := range pkgs {
+		if !strings.HasPrefix(p.Dir, src) {
+			continue
+		}
+		for _, f := range p.files() {
+			if strings.HasPrefix(f, src) {
+				files[f] = true
+			}
+		}
+		// Tests sometimes use testdata directories in parent
+		// directories, so keep all of those, too.
+		for dir := p.Dir; strings.HasPrefix(dir, src); dir = filepath.Dir(dir) {
+			td := filepath.Join(dir, "testdata")
+			if testdata[td] {
+				break
+			}
+			if st, err := os.Stat(td); err == nil && st.IsDir() {
+				testdata[td] = true
+			}
+		}
+		if p.Target != "" {
+			targets[p.Target] = true
+		}
+	}
+	for _, f := range moduleFiles {
+		if _, err := os.Stat(filepath.Join(src, f)); err == nil {
+			files[filepath.Join(src, f)] = true
+		}
+	}
+
+	for _, f := range sortedKeys(files) {
+		if inDirs(f, testdata) {
+			// Copied with the testdata directory below.
+			continue
+		}
+		if err := cp(f, filepath.Join(savePath, f[len(goroot):])); err != nil {
+			return err
+		}
+	}
+	for _, dir := range sortedKeys(testdata) {
+		if err := cpR(dir, filepath.Join(savePath, dir[len(goroot):])); err != nil {
+			return err
+		}
+	}
+	pkgDir := filepath.Join(goroot, "pkg", osArch) + string(filepath.Separator)
+	for _, t := range sortedKeys(targets) {
+		if !strings.HasPrefix(t, pkgDir) {
+			continue
+		}
+		if _, err := os.Stat(t); err == nil {
+			if err := cp(t, filepath.Join(savePath, t[len(goroot):])); err != nil {
+				return err
+			}
+		}
+	}
+
+	marker := strings.Join(slimPackages, " ") + "\n"
+	return ioutil.WriteFile(filepath.Join(savePath, slimFile), []byte(marker), 0666)
+}
+
+// isSlim returns whether the saved build at savePath is slim.
+func isSlim(savePath string) bool {
+	_, err := os.Stat(filepath.Join(savePath, slimFile))
+	return err == nil
+}
+
+// doVerify checks that saved build name can build and test pkgs.
+func doVerify(name string, pkgs []string) {
+	savePath, ok := resolveName(name)
+	if !ok {
+		log.Fatalf("unknown name `%s'", name)
+	}
+	if len(pkgs) == 0 {
+		pkgs = []string{"std"}
+	}
+	env, _ := buildEnv(savePath)
+
+	// Check that go list can find every package and its
+	// dependencies.
+	list, err := goList(savePath, env, pkgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bad := 0
+	for _, p := range list {
+		if p.Error != nil {
+			fmt.Printf("%s: %s\n", p.ImportPath, p.Error.Err)
+			bad++
+		}
+		for _, e := range p.DepsErrors {
+			fmt.Printf("%s: %s\n", p.ImportPath, e.Err)
+			bad++
+		}
+	}
+	if bad > 0 {
+		log.Fatalf("build `%s' is missing files for %s", name, strings.Join(pkgs, " "))
+	}
+
+	// Build and test the packages.
+	args := append([]string{"test", "-short"}, pkgs...)
+	if *verbose {
+		fmt.Printf("go %s\n", strings.Join(args, " "))
+	}
+	c := exec.Command(filepath.Join(savePath, "bin", "go"), args...)
+	c.Env = env
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		log.Fatalf("build `%s' failed to test %s: %s", name, strings.Join(pkgs, " "), err)
+	}
+	fmt.Fprintf(os.Stderr, "verified build `%s' with %d package(s)\n", name, len(list))
+}
+
+// inDirs returns whether path is in any of the directories in dirs.
+func inDirs(path string, dirs map[string]bool) bool {
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if dirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// environWithout returns environ without variables starting with
+// any of prefixes.
+func environWithout(environ []string, prefixes ...string) []string {
+	var out []string
+outer:
+	for _, kv := range environ {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(kv, prefix) {
+				continue outer
+			}
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
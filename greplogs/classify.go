@@ -0,0 +1,155 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-misc/internal/loganal"
+)
+
+// A pathFailure is a failure extracted from the log at path.
+type pathFailure struct {
+	path    string
+	url     string // build log URL, if known
+	builder string // builder name, if known
+	failure *loganal.Failure
+}
+
+// collected accumulates matched failures in -classify and -count
+// modes, in search order.
+var collected []pathFailure
+
+// jsonFailure is the JSON form of a matched failure.
+type jsonFailure struct {
+	Path    string
+	URL     string `json:",omitempty"`
+	Builder string `json:",omitempty"`
+	*loganal.Failure
+	Context string `json:",omitempty"` // log context for -C
+}
+
+// printJSON prints v to w as a single line of JSON.
+func printJSON(w io.Writer, v interface{}) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+}
+
+// classify groups the failures in collected into failure classes.
+// It returns the classes sorted by decreasing size, the indexes in
+// collected of the failures in each class, and any fuzzy merges
+// that produced each class.
+func classify() ([]loganal.Failure, map[loganal.Failure][]int, map[loganal.Failure][]loganal.Merge) {
+	fs := make([]*loganal.Failure, len(collected))
+	for i, pf := range collected {
+		fs[i] = pf.failure
+	}
+
+	var classes map[loganal.Failure][]int
+	mergesByClass := map[loganal.Failure][]loganal.Merge{}
+	if *flagFuzzy > 0 {
+		var merges []loganal.Merge
+		classes, merges = loganal.FuzzyClassify(fs, *flagFuzzy)
+		for _, m := range merges {
+			mergesByClass[m.Class] = append(mergesByClass[m.Class], m)
+		}
+	} else {
+		classes = loganal.Classify(fs)
+	}
+
+	// Sort classes by decreasing size.
+	keys := make([]loganal.Failure, 0, len(classes))
+	for class := range classes {
+		keys = append(keys, class)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(classes[keys[i]]) != len(classes[keys[j]]) {
+			return len(classes[keys[i]]) > len(classes[keys[j]])
+		}
+		return keys[i].String() < keys[j].String()
+	})
+	return keys, classes, mergesByClass
+}
+
+// printClasses classifies the failures in collected and prints each
+// class along with the logs it appears in.
+func printClasses() {
+	keys, classes, mergesByClass := classify()
+
+	for _, class := range keys {
+		idxs := classes[class]
+		if *flagJSON {
+			type jsonClass struct {
+				Class  loganal.Failure
+				Count  int
+				Paths  []string
+				Merges []loganal.Merge `json:",omitempty"`
+			}
+			jc := jsonClass{Class: class, Count: len(idxs), Merges: mergesByClass[class]}
+			for _, i := range idxs {
+				jc.Paths = append(jc.Paths, collected[i].path)
+			}
+			printJSON(os.Stdout, jc)
+			continue
+		}
+
+		fmt.Printf("%s (%d)\n", color.color(class.String(), colorMatch), len(idxs))
+		for _, m := range mergesByClass[class] {
+			fmt.Printf("  combined %s\n", strings.Replace(m.String(), "\n", "\n  ", -1))
+		}
+		for _, i := range idxs {
+			fmt.Printf("  %s\n", color.color(collected[i].path, colorPath))
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// printCounts prints to w the number of failures in collected for
+// each value of key, which is either "class" or a query field name.
+func printCounts(w io.Writer, key string) {
+	type count struct {
+		Key   string
+		Count int
+	}
+	var counts []count
+	if key == "class" {
+		keys, classes, _ := classify()
+		for _, class := range keys {
+			counts = append(counts, count{class.String(), len(classes[class])})
+		}
+	} else {
+		field := failureFields[key]
+		byKey := map[string]int{}
+		for i := range collected {
+			byKey[field(&collected[i])]++
+		}
+		for k, n := range byKey {
+			counts = append(counts, count{k, n})
+		}
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].Count != counts[j].Count {
+				return counts[i].Count > counts[j].Count
+			}
+			return counts[i].Key < counts[j].Key
+		})
+	}
+
+	for _, c := range counts {
+		if *flagJSON {
+			printJSON(w, c)
+		} else {
+			fmt.Fprintf(w, "%7d %s\n", c.Count, c.Key)
+		}
+	}
+}
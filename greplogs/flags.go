@@ -4,7 +4,11 @@
 
 package main
 
-import "regexp"
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
 
 type regexpList []*regexp.Regexp
 
@@ -49,3 +53,28 @@ func (x *regexpList) Matches(data []byte) [][]int {
 	}
 	return matches
 }
+
+// globList is a list of filepath.Match patterns. A name matches the
+// list if it matches any pattern.
+type globList []string
+
+func (x *globList) String() string {
+	return strings.Join(*x, ",")
+}
+
+func (x *globList) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return err
+	}
+	*x = append(*x, s)
+	return nil
+}
+
+func (x globList) AnyMatch(name string) bool {
+	for _, pat := range x {
+		if ok, _ := filepath.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
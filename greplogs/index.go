@@ -0,0 +1,306 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"sync"
+)
+
+// The trigram index records, for each searched log, a Bloom filter of
+// the byte trigrams that appear in that log. Before reading a log,
+// greplogs checks that every trigram required by the -e and -E
+// regexps may appear in it. Bloom filters have no false negatives,
+// so this never changes the search results; it only skips logs that
+// can't match.
+//
+// The index is stored under $XDG_CACHE_HOME/greplogs/index with one
+// file per log directory. Entries are keyed by file name, size, and
+// modification time, so the index is updated incrementally as
+// fetchlogs adds logs.
+
+// logIndex is the trigram index, or nil if -index is not set.
+var logIndex *trigramIndex
+
+type trigramIndex struct {
+	dir string
+
+	// need is the set of trigrams a log must contain to match.
+	need []uint32
+
+	mu   sync.Mutex
+	dirs map[string]*dirIndex
+}
+
+// dirIndex is the index of the files in a single directory.
+type dirIndex struct {
+	mu      sync.Mutex
+	path    string // index file path
+	Entries map[string]*indexEntry
+	dirty   bool
+}
+
+type indexEntry struct {
+	Size    int64
+	ModTime int64
+	Version int // indexVersion when the entry was written
+	Bloom   []uint64
+}
+
+// indexVersion is the version of the Bloom filter layout. Entries
+// with other versions are treated as missing.
+const indexVersion = 1
+
+// current returns whether ent is an up-to-date index of the file
+// described by fi.
+func (ent *indexEntry) current(fi os.FileInfo) bool {
+	return ent != nil && ent.Version == indexVersion && ent.Size == fi.Size() && ent.ModTime == fi.ModTime().UnixNano()
+}
+
+func openIndex() (*trigramIndex, error) {
+	dir := filepath.Join(xdgCacheDir(), "greplogs", "index")
+	if err := xdgCreateDir(dir); err != nil {
+		return nil, err
+	}
+
+	// Collect the trigrams required by the regexps.
+	var need []uint32
+	for _, list := range []regexpList{fileRegexps, failRegexps} {
+		for _, re := range list {
+			parsed, err := syntax.Parse(re.String(), syntax.Perl)
+			if err != nil {
+				return nil, err
+			}
+			for _, lit := range requiredLiterals(parsed.Simplify()) {
+				need = append(need, trigrams([]byte(lit))...)
+			}
+		}
+	}
+
+	return &trigramIndex{dir: dir, need: need, dirs: make(map[string]*dirIndex)}, nil
+}
+
+// mayMatch returns whether the log at path may contain all of the
+// required trigrams. If path is not in the index, it returns true and
+// the caller should call add once it has read the log.
+func (x *trigramIndex) mayMatch(path string) (bool, error) {
+	if len(x.need) == 0 {
+		return true, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	di, err := x.dirIndex(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	di.mu.Lock()
+	ent := di.Entries[filepath.Base(path)]
+	di.mu.Unlock()
+	if !ent.current(fi) {
+		return true, nil
+	}
+
+	for _, t := range x.need {
+		if !bloomHas(ent.Bloom, t) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// add adds the log at path with contents data to the index, if it
+// isn't already indexed.
+func (x *trigramIndex) add(path string, data []byte) error {
+	if len(x.need) == 0 {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	di, err := x.dirIndex(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	di.mu.Lock()
+	defer di.mu.Unlock()
+	if di.Entries[name].current(fi) {
+		return nil
+	}
+	di.Entries[name] = &indexEntry{fi.Size(), fi.ModTime().UnixNano(), indexVersion, newBloom(data)}
+	di.dirty = true
+	return nil
+}
+
+// dirIndex returns the index of directory dir, loading it if
+// necessary.
+func (x *trigramIndex) dirIndex(dir string) (*dirIndex, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if di := x.dirs[dir]; di != nil {
+		return di, nil
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	di := &dirIndex{
+		path:    filepath.Join(x.dir, fmt.Sprintf("%x", sha1.Sum([]byte(abs)))),
+		Entries: make(map[string]*indexEntry),
+	}
+	f, err := os.Open(di.path)
+	if err == nil {
+		err = gob.NewDecoder(f).Decode(&di.Entries)
+		f.Close()
+		if err != nil {
+			// Start over with an empty index.
+			di.Entries = make(map[string]*indexEntry)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	x.dirs[dir] = di
+	return di, nil
+}
+
+// flush writes out any modified directory indexes.
+func (x *trigramIndex) flush() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, di := range x.dirs {
+		if !di.dirty {
+			continue
+		}
+		f, err := ioutil.TempFile(x.dir, "tmp-")
+		if err != nil {
+			return err
+		}
+		err = gob.NewEncoder(f).Encode(di.Entries)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), di.path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		di.dirty = false
+	}
+	return nil
+}
+
+// requiredLiterals returns literal strings that must appear in any
+// text matched by re. It is conservative: it may omit literals, but
+// every literal it returns is required.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+
+	case syntax.OpConcat:
+		// Join adjacent literals so we get trigrams that span
+		// them.
+		var lits []string
+		run := ""
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run += string(sub.Rune)
+				continue
+			}
+			if run != "" {
+				lits = append(lits, run)
+				run = ""
+			}
+			lits = append(lits, requiredLiterals(sub)...)
+		}
+		if run != "" {
+			lits = append(lits, run)
+		}
+		return lits
+	}
+	return nil
+}
+
+func trigrams(data []byte) []uint32 {
+	var ts []uint32
+	for i := 0; i+2 < len(data); i++ {
+		ts = append(ts, uint32(data[i])<<16|uint32(data[i+1])<<8|uint32(data[i+2]))
+	}
+	return ts
+}
+
+// Bloom filters use two hash functions and bloomBits bits per
+// distinct trigram, which gives a false positive rate of about 5% per
+// trigram. A filter is never smaller than bloomMinWords or larger than
+// bloomMaxWords; past that, the false positive rate rises.
+//
+// Thus, the index of a log takes about one byte per distinct trigram
+// in the log, and at most 64 KB. Logs repeat themselves heavily:
+// builder logs of 40 KB to 400 KB have 4,000 to 6,000 distinct
+// trigrams, so their index entries take 1% to 10% of their size.
+const (
+	bloomBits     = 8
+	bloomMinWords = 2
+	bloomMaxWords = 1 << 13
+)
+
+func newBloom(data []byte) []uint64 {
+	set := make(map[uint32]struct{})
+	for i := 0; i+2 < len(data); i++ {
+		set[uint32(data[i])<<16|uint32(data[i+1])<<8|uint32(data[i+2])] = struct{}{}
+	}
+	words := (len(set)*bloomBits + 63) / 64
+	if words < bloomMinWords {
+		words = bloomMinWords
+	} else if words > bloomMaxWords {
+		words = bloomMaxWords
+	}
+	bloom := make([]uint64, words)
+	for t := range set {
+		h1, h2 := bloomHashes(t, len(bloom))
+		bloom[h1/64] |= 1 << (h1 % 64)
+		bloom[h2/64] |= 1 << (h2 % 64)
+	}
+	return bloom
+}
+
+func bloomHas(bloom []uint64, t uint32) bool {
+	h1, h2 := bloomHashes(t, len(bloom))
+	return bloom[h1/64]&(1<<(h1%64)) != 0 && bloom[h2/64]&(1<<(h2%64)) != 0
+}
+
+// bloomHashes returns two bit indexes for trigram t in a Bloom filter
+// of the given number of words.
+func bloomHashes(t uint32, words int) (uint, uint) {
+	// Map the 32-bit hashes onto [0, bits) by taking the high bits
+	// of their product with bits.
+	bits := uint64(words * 64)
+	h1 := uint64(t * 0x9E3779B1)
+	h2 := uint64((t ^ 0x5bd1e995) * 0x85EBCA6B)
+	return uint(h1 * bits >> 32), uint(h2 * bits >> 32)
+}
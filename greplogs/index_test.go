@@ -0,0 +1,73 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"regexp/syntax"
+	"testing"
+)
+
+func TestRequiredLiterals(t *testing.T) {
+	for _, test := range []struct {
+		re   string
+		want []string
+	}{
+		{`fatal error: (.*)`, []string{"fatal error: "}},
+		{`(?m)^--- FAIL: Test\w+`, []string{"--- FAIL: Test"}},
+		{`timed? out`, []string{"time", " out"}},
+		{`(foo|bar)baz`, []string{"baz"}},
+		{`(?i)panic`, nil},
+		{`(abc)+x{2}`, []string{"abc", "xx"}},
+	} {
+		re, err := syntax.Parse(test.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := requiredLiterals(re.Simplify())
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %q, got %q", test.re, test.want, got)
+		}
+	}
+}
+
+func TestBloom(t *testing.T) {
+	data := []byte("panic: runtime error: index out of range\n")
+	bloom := newBloom(data)
+	for _, tg := range trigrams(data) {
+		if !bloomHas(bloom, tg) {
+			t.Fatalf("trigram %06x missing from Bloom filter", tg)
+		}
+	}
+
+	// With so few trigrams, the filter should reject most others.
+	misses := 0
+	for _, tg := range trigrams([]byte("all goroutines are asleep - deadlock!")) {
+		if !bloomHas(bloom, tg) {
+			misses++
+		}
+	}
+	if misses < 20 {
+		t.Errorf("Bloom filter rejected only %d unrelated trigrams", misses)
+	}
+}
+
+func TestIndexEntryCurrent(t *testing.T) {
+	fi, err := os.Stat("index.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent := &indexEntry{fi.Size(), fi.ModTime().UnixNano(), indexVersion, nil}
+	if !ent.current(fi) {
+		t.Errorf("up-to-date entry is not current")
+	}
+	// Entries written with a different Bloom filter layout must
+	// not be used.
+	ent.Version = 0
+	if ent.current(fi) {
+		t.Errorf("entry from old version is current")
+	}
+}
@@ -9,21 +9,52 @@
 //
 // greplogs finds builder logs matching a given set of regular
 // expressions in Go syntax (godoc.org/regexp/syntax) and extracts
-// failures from them.
+// failures from them. The -q flag further filters the extracted
+// failures by their fields; for example,
+//
+//     greplogs -dashboard -e . -q 'pkg=runtime test=~TestGC os=linux'
+//
+// finds failures in runtime tests matching TestGC on Linux builders.
+// Query fields are pkg, test, msg, full, func, file, line, sig, os,
+// arch, builder, and path.
 //
 // greplogs can search an arbitrary set of files just like grep.
 // Alternatively, the -dashboard flag causes it to search the logs
 // saved locally by fetchlogs (golang.org/x/build/cmd/fetchlogs).
+// greplogs searches logs concurrently. With -index, it also maintains
+// a trigram index of the searched logs, which it uses to skip logs
+// that can't match the -e and -E regexps.
+//
+// With -dashboard, the -since and -until flags limit the search to
+// revisions committed within a date range, -rev A..B limits it to the
+// revisions after A up to and including B, and -builder limits it to
+// builders matching a glob pattern. For example,
+//
+//     greplogs -dashboard -since 2019-01-01 -builder 'linux-*' -e 'fatal error'
+//
+// By default, greplogs prints the full message of each failure. With
+// -C N, it instead prints the lines of the log around the failure,
+// including N lines of context before and after.
+//
+// With -classify, greplogs groups the extracted failures into failure
+// classes and prints each class with the logs it appears in. With
+// -count, it prints only the number of failures in each class or
+// with each value of a query field, such as builder. Adding -fuzzy
+// also groups classes that are similar but not identical. The -json
+// flag prints any of these as JSON instead of text.
 package main
 
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/aclements/go-misc/internal/loganal"
 )
@@ -33,19 +64,28 @@ import (
 
 // TODO: Optionally extract failures and show only those.
 
-// TODO: Optionally classify matched logs by failure (and show either
-// file name or extracted failure).
-
 // TODO: Option to print failure summary versus full failure message.
 
 var (
 	fileRegexps regexpList
 	failRegexps regexpList
+	failQuery   query
+	builders    globList
 
 	flagDashboard = flag.Bool("dashboard", false, "search dashboard logs from fetchlogs")
 	flagMD        = flag.Bool("md", false, "output in Markdown")
 	flagFilesOnly = flag.Bool("l", false, "print only names of matching files")
 	flagColor     = flag.String("color", "auto", "highlight output in color: `mode` is never, always, or auto")
+	flagClassify  = flag.Bool("classify", false, "group matched failures by failure class")
+	flagCount     = flag.String("count", "", "print the number of matched failures grouped by `key`, which is class or a query field")
+	flagFuzzy     = flag.Float64("fuzzy", 0, "with -classify or -count class, also group failures that are at least `similarity` (0 to 1) alike")
+	flagJSON      = flag.Bool("json", false, "output in JSON")
+	flagIndex     = flag.Bool("index", false, "use and update a trigram index of searched logs to skip logs that can't match -e and -E")
+	flagJobs      = flag.Int("j", runtime.NumCPU(), "search `N` logs concurrently")
+	flagSince     = flag.String("since", "", "with -dashboard, search only revisions committed on or after `date`")
+	flagUntil     = flag.String("until", "", "with -dashboard, search only revisions committed on or before `date`")
+	flagRev       = flag.String("rev", "", "with -dashboard, search only revisions in `range` A..B, after A up to and including B")
+	flagContext   = flag.Int("C", 0, "print `N` lines of log context around each failure")
 
 	color *colorizer
 )
@@ -61,6 +101,8 @@ func main() {
 	// logs and have it extract the failures.
 	flag.Var(&fileRegexps, "e", "show files matching `regexp`; if provided multiple times, files must match all regexps")
 	flag.Var(&failRegexps, "E", "show only errors matching `regexp`; if provided multiple times, an error must match all regexps")
+	flag.Var(&builders, "builder", "with -dashboard, search only logs from builders matching `glob`; if provided multiple times, a builder may match any glob")
+	flag.Var(&failQuery, "q", "show only errors matching `query`, such as \"pkg=runtime test=~TestGC\"; if provided multiple times, an error must match all queries")
 	flag.Parse()
 
 	// Validate flags.
@@ -68,13 +110,78 @@ func main() {
 		fmt.Fprintf(os.Stderr, "-dashboard and paths are incompatible\n")
 		os.Exit(2)
 	}
+	if *flagClassify && *flagCount != "" {
+		fmt.Fprintf(os.Stderr, "-classify and -count are incompatible\n")
+		os.Exit(2)
+	}
+	if (*flagClassify || *flagCount != "") && *flagFilesOnly {
+		fmt.Fprintf(os.Stderr, "-classify and -count are incompatible with -l\n")
+		os.Exit(2)
+	}
+	if *flagCount != "" && *flagCount != "class" {
+		if _, ok := failureFields[*flagCount]; !ok {
+			fmt.Fprintf(os.Stderr, "-count must be class or one of %s\n", fieldNames())
+			os.Exit(2)
+		}
+	}
+	if *flagFuzzy != 0 && !*flagClassify && *flagCount != "class" {
+		fmt.Fprintf(os.Stderr, "-fuzzy requires -classify or -count class\n")
+		os.Exit(2)
+	}
+	if *flagFuzzy < 0 || *flagFuzzy > 1 {
+		fmt.Fprintf(os.Stderr, "-fuzzy must be between 0 and 1\n")
+		os.Exit(2)
+	}
+	if *flagJobs < 1 {
+		fmt.Fprintf(os.Stderr, "-j must be at least 1\n")
+		os.Exit(2)
+	}
+	if *flagJSON && *flagMD {
+		fmt.Fprintf(os.Stderr, "-json and -md are incompatible\n")
+		os.Exit(2)
+	}
+	if (*flagSince != "" || *flagUntil != "" || *flagRev != "" || len(builders) > 0) && !*flagDashboard {
+		fmt.Fprintf(os.Stderr, "-since, -until, -rev, and -builder require -dashboard\n")
+		os.Exit(2)
+	}
+	var since, until time.Time
+	var revs *revRange
+	var err error
+	if *flagSince != "" {
+		if since, err = parseDate(*flagSince, false); err != nil {
+			fmt.Fprintf(os.Stderr, "-since: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *flagUntil != "" {
+		if until, err = parseDate(*flagUntil, true); err != nil {
+			fmt.Fprintf(os.Stderr, "-until: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *flagRev != "" {
+		r, err := parseRevRange(*flagRev)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-rev: %v\n", err)
+			os.Exit(2)
+		}
+		revs = &r
+	}
+	if *flagContext < 0 {
+		fmt.Fprintf(os.Stderr, "-C must not be negative\n")
+		os.Exit(2)
+	}
+	if *flagContext > 0 && (*flagFilesOnly || *flagClassify || *flagCount != "") {
+		fmt.Fprintf(os.Stderr, "-C is incompatible with -l, -classify, and -count\n")
+		os.Exit(2)
+	}
 	switch *flagColor {
 	case "never":
 		color = newColorizer(false)
 	case "always":
 		color = newColorizer(true)
 	case "auto":
-		color = newColorizer(canColor())
+		color = newColorizer(canColor() && !*flagJSON)
 	default:
 		fmt.Fprintf(os.Stderr, "-color must be one of never, always, or auto")
 		os.Exit(2)
@@ -85,68 +192,70 @@ func main() {
 	var stripDir string
 	if *flagDashboard {
 		revDir := filepath.Join(xdgCacheDir(), "fetchlogs", "rev")
-		fis, err := ioutil.ReadDir(revDir)
+		paths, err = selectRevs(revDir, since, until, revs)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: %s\n", revDir, err)
 			os.Exit(1)
 		}
-		for _, fi := range fis {
-			if !fi.IsDir() {
-				continue
-			}
-			paths = append(paths, filepath.Join(revDir, fi.Name()))
-		}
-		sort.Sort(sort.Reverse(sort.StringSlice(paths)))
 		stripDir = revDir + "/"
 	} else {
 		paths = flag.Args()
 	}
 
-	// Process files
-	status := 1
-	for _, path := range paths {
-		filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				status = 2
-				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
-				return nil
-			}
-			if info.IsDir() || strings.HasPrefix(filepath.Base(path), ".") {
-				return nil
-			}
-
-			nicePath := path
-			if stripDir != "" && strings.HasPrefix(path, stripDir) {
-				nicePath = path[len(stripDir):]
-			}
-
-			found, err := process(path, nicePath)
-			if err != nil {
-				status = 2
-				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
-			} else if found && status == 1 {
-				status = 0
-			}
-			return nil
-		})
+	// Process files.
+	if *flagIndex {
+		if logIndex, err = openIndex(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+	}
+	status := search(os.Stdout, paths, stripDir)
+	if logIndex != nil {
+		if err := logIndex.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 2
+		}
+	}
+	if *flagClassify {
+		printClasses()
+	} else if *flagCount != "" {
+		printCounts(os.Stdout, *flagCount)
 	}
 	os.Exit(status)
 }
 
-func process(path, nicePath string) (found bool, err error) {
+// process searches the log at path and writes the results to w. It
+// returns the failures to collect for -classify or -count.
+func process(w io.Writer, path, nicePath string) (found bool, pfs []pathFailure, err error) {
+	// Consult the index to skip files that can't match.
+	if logIndex != nil {
+		maybe, err := logIndex.mayMatch(path)
+		if err != nil {
+			return false, nil, err
+		}
+		if !maybe {
+			return false, nil, nil
+		}
+	}
+
 	// TODO: Use streaming if possible.
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return false, err
+		return false, nil, err
+	}
+	if logIndex != nil {
+		if err := logIndex.add(path, data); err != nil {
+			return false, nil, err
+		}
 	}
 
 	// Check regexp match.
 	if !fileRegexps.AllMatch(data) || !failRegexps.AllMatch(data) {
-		return false, nil
+		return false, nil, nil
 	}
 
 	// If this is from the dashboard, get the builder URL.
-	var logURL string
+	var logURL, builder string
 	if _, err := os.Stat(filepath.Join(filepath.Dir(path), ".rev.json")); err == nil {
 		// TODO: Get the URL from the rev.json metadata
 		link, err := os.Readlink(path)
@@ -154,6 +263,7 @@ func process(path, nicePath string) (found bool, err error) {
 			hash := filepath.Base(link)
 			logURL = "https://build.golang.org/log/" + hash
 		}
+		builder = filepath.Base(path)
 	}
 
 	printPath := nicePath
@@ -161,18 +271,26 @@ func process(path, nicePath string) (found bool, err error) {
 		printPath = fmt.Sprintf("[%s](%s)", nicePath, logURL)
 	}
 
-	if *flagFilesOnly {
-		fmt.Printf("%s\n", color.color(printPath, colorPath))
-		return true, nil
+	if *flagFilesOnly && len(failQuery) == 0 {
+		printFile(w, nicePath, printPath, logURL, builder)
+		return true, nil, nil
 	}
 
 	// Extract failures.
-	failures, err := loganal.Extract(string(data), "", "")
+	goos, goarch := builderOSArch(builder)
+	failures, err := loganal.Extract(string(data), goos, goarch)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
-	// Print failures.
+	// Print failures. Without a query, a file matching the regexps
+	// counts as found even if none of its failures match.
+	found = len(failQuery) == 0
+	var canon string
+	var canonPos int // End of the last failure found in canon
+	if *flagContext > 0 {
+		canon = loganal.CanonLines(string(data))
+	}
 	for _, failure := range failures {
 		var msg []byte
 		if failure.FullMessage != "" {
@@ -184,30 +302,120 @@ func process(path, nicePath string) (found bool, err error) {
 		if len(failRegexps) > 0 && !failRegexps.AllMatch(msg) {
 			continue
 		}
+		if *flagContext > 0 {
+			if ctx, end, ok := logContext(canon, string(msg), canonPos, *flagContext); ok {
+				msg, canonPos = []byte(ctx), end
+			}
+		}
+		pf := pathFailure{nicePath, logURL, builder, failure}
+		if !failQuery.match(&pf) {
+			continue
+		}
+		found = true
 
-		fmt.Printf("%s%s\n", color.color(printPath, colorPath), color.color(":", colorPathColon))
+		if *flagFilesOnly {
+			printFile(w, nicePath, printPath, logURL, builder)
+			break
+		}
+		if *flagClassify || *flagCount != "" {
+			pfs = append(pfs, pf)
+			continue
+		}
+		if *flagJSON {
+			jf := jsonFailure{Path: nicePath, URL: logURL, Builder: builder, Failure: failure}
+			if *flagContext > 0 {
+				jf.Context = string(msg)
+			}
+			printJSON(w, jf)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s%s\n", color.color(printPath, colorPath), color.color(":", colorPathColon))
 		if *flagMD {
-			fmt.Printf("```\n")
+			fmt.Fprintf(w, "```\n")
 		}
 		if !color.enabled {
-			fmt.Printf("%s", msg)
+			fmt.Fprintf(w, "%s", msg)
 		} else {
 			// Find specific matches and highlight them.
 			matches := mergeMatches(append(fileRegexps.Matches(msg),
 				failRegexps.Matches(msg)...))
 			printed := 0
 			for _, m := range matches {
-				fmt.Printf("%s%s", msg[printed:m[0]], color.color(string(msg[m[0]:m[1]]), colorMatch))
+				fmt.Fprintf(w, "%s%s", msg[printed:m[0]], color.color(string(msg[m[0]:m[1]]), colorMatch))
 				printed = m[1]
 			}
-			fmt.Printf("%s", msg[printed:])
+			fmt.Fprintf(w, "%s", msg[printed:])
 		}
 		if *flagMD {
-			fmt.Printf("\n```")
+			fmt.Fprintf(w, "\n```")
+		}
+		fmt.Fprintf(w, "\n\n")
+	}
+	return found, pfs, nil
+}
+
+// printFile prints the name of a matching file for -l.
+func printFile(w io.Writer, nicePath, printPath, logURL, builder string) {
+	if *flagJSON {
+		printJSON(w, jsonFailure{Path: nicePath, URL: logURL, Builder: builder})
+		return
+	}
+	fmt.Fprintf(w, "%s\n", color.color(printPath, colorPath))
+}
+
+// logContext returns the lines of log containing msg plus n lines
+// before and after, and the offset in log of the end of msg. log must
+// have canonical line endings. Since failures are extracted in order
+// and the same message may appear several times, logContext looks for
+// msg starting at offset from, and only looks earlier if that fails.
+// If msg does not appear verbatim in log, as happens for failures
+// extracted from JSON test output, it returns "", 0, false.
+func logContext(log, msg string, from, n int) (string, int, bool) {
+	if msg == "" {
+		return "", 0, false
+	}
+	i := strings.Index(log[from:], msg)
+	if i >= 0 {
+		i += from
+	} else if i = strings.Index(log, msg); i < 0 {
+		return "", 0, false
+	}
+
+	// Back up to the start of the line, then n more lines.
+	start := strings.LastIndex(log[:i], "\n") + 1
+	for k := 0; k < n && start > 0; k++ {
+		start = strings.LastIndex(log[:start-1], "\n") + 1
+	}
+
+	// Advance to the end of the line, then n more lines.
+	msgEnd := i + len(msg)
+	end := msgEnd
+	if end > 0 && log[end-1] == '\n' {
+		end--
+	}
+	eol := func(i int) int {
+		if j := strings.IndexByte(log[i:], '\n'); j >= 0 {
+			return i + j
 		}
-		fmt.Printf("\n\n")
+		return len(log)
+	}
+	end = eol(end)
+	for k := 0; k < n && end+1 < len(log); k++ {
+		end = eol(end + 1)
+	}
+	return log[start:end], msgEnd, true
+}
+
+// builderOSArch returns the GOOS and GOARCH of a dashboard builder
+// name like "linux-amd64-race", or "", "" if builder is not of this
+// form.
+func builderOSArch(builder string) (goos, goarch string) {
+	parts := strings.SplitN(builder, "-", 3)
+	if len(parts) < 2 {
+		return "", ""
 	}
-	return true, nil
+	return parts[0], parts[1]
 }
 
 func mergeMatches(matches [][]int) [][]int {
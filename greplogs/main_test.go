@@ -0,0 +1,42 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestLogContext(t *testing.T) {
+	log := "a\nb\nc\nd\ne\nf\n"
+	for _, test := range []struct {
+		msg  string
+		n    int
+		want string
+	}{
+		{"c", 0, "c"},
+		{"c", 1, "b\nc\nd"},
+		{"c\nd\n", 1, "b\nc\nd\ne"},
+		{"a", 2, "a\nb\nc"},
+		{"f", 2, "d\ne\nf"},
+		{"b\nc", 10, "a\nb\nc\nd\ne\nf"},
+	} {
+		got, _, ok := logContext(log, test.msg, 0, test.n)
+		if !ok || got != test.want {
+			t.Errorf("logContext(%q, %d): want %q, got %q, %v", test.msg, test.n, test.want, got, ok)
+		}
+	}
+	if _, _, ok := logContext(log, "x", 0, 1); ok {
+		t.Errorf("logContext found missing message")
+	}
+
+	// Repeated messages each get their own context.
+	log = "a\nFAIL\nb\nFAIL\nc\n"
+	from := 0
+	for _, want := range []string{"a\nFAIL\nb", "b\nFAIL\nc"} {
+		got, end, ok := logContext(log, "FAIL\n", from, 1)
+		if !ok || got != want {
+			t.Errorf("logContext(FAIL, from %d): want %q, got %q, %v", from, want, got, ok)
+		}
+		from = end
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A query is a conjunction of conditions on the fields of extracted
+// failures, such as
+//
+//	pkg=runtime test=~TestGC os=linux func=runtime.throw
+//
+// Each term has the form field op value, where op is one of
+//
+//	=   field equals value
+//	!=  field does not equal value
+//	=~  field matches regexp value
+//	!~  field does not match regexp value
+//
+// Values may be double-quoted Go strings to include spaces.
+type query []queryTerm
+
+type queryTerm struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// failureFields maps from query field names to functions that
+// retrieve those fields. These are also the keys accepted by -count.
+var failureFields = map[string]func(pf *pathFailure) string{
+	"pkg":     func(pf *pathFailure) string { return pf.failure.Package },
+	"test":    func(pf *pathFailure) string { return pf.failure.Test },
+	"msg":     func(pf *pathFailure) string { return pf.failure.Message },
+	"full":    func(pf *pathFailure) string { return pf.failure.FullMessage },
+	"func":    func(pf *pathFailure) string { return pf.failure.Function },
+	"file":    func(pf *pathFailure) string { return pf.failure.File },
+	"line":    func(pf *pathFailure) string { return strconv.Itoa(pf.failure.Line) },
+	"sig":     func(pf *pathFailure) string { return pf.failure.Signature },
+	"os":      func(pf *pathFailure) string { return pf.failure.OS },
+	"arch":    func(pf *pathFailure) string { return pf.failure.Arch },
+	"builder": func(pf *pathFailure) string { return pf.builder },
+	"path":    func(pf *pathFailure) string { return pf.path },
+}
+
+// fieldNames returns the sorted names of failureFields.
+func fieldNames() string {
+	var names []string
+	for name := range failureFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (q *query) String() string {
+	var terms []string
+	for _, t := range *q {
+		terms = append(terms, t.field+t.op+strconv.Quote(t.value))
+	}
+	return strings.Join(terms, " ")
+}
+
+// Set parses s and adds its terms to q.
+func (q *query) Set(s string) error {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return nil
+		}
+
+		// Parse the field name.
+		i := strings.IndexAny(s, "=!")
+		if i <= 0 {
+			return fmt.Errorf("query term %q: expected field=value", s)
+		}
+		t := queryTerm{field: s[:i]}
+		if _, ok := failureFields[t.field]; !ok {
+			return fmt.Errorf("unknown query field %q; expected one of %s", t.field, fieldNames())
+		}
+		s = s[i:]
+
+		// Parse the operator.
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(s, op) {
+				t.op = op
+				break
+			}
+		}
+		if t.op == "" {
+			return fmt.Errorf("query term %s%q: bad operator", t.field, s)
+		}
+		s = s[len(t.op):]
+
+		// Parse the value.
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return fmt.Errorf("query term %s%s%s: unterminated string", t.field, t.op, s)
+			}
+			v, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return fmt.Errorf("query term %s%s%s: %v", t.field, t.op, s[:end+1], err)
+			}
+			t.value, s = v, s[end+1:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			t.value, s = s[:end], s[end:]
+		}
+
+		if t.op == "=~" || t.op == "!~" {
+			re, err := regexp.Compile(t.value)
+			if err != nil {
+				return fmt.Errorf("query term %s%s%s: %v", t.field, t.op, t.value, err)
+			}
+			t.re = re
+		}
+		*q = append(*q, t)
+	}
+}
+
+// match returns whether pf satisfies all of the terms of q.
+func (q query) match(pf *pathFailure) bool {
+	for _, t := range q {
+		v := failureFields[t.field](pf)
+		var ok bool
+		switch t.op {
+		case "=":
+			ok = v == t.value
+		case "!=":
+			ok = v != t.value
+		case "=~":
+			ok = t.re.MatchString(v)
+		case "!~":
+			ok = !t.re.MatchString(v)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aclements/go-misc/internal/loganal"
+)
+
+func TestQuery(t *testing.T) {
+	pf := &pathFailure{
+		path:    "rev/linux-amd64",
+		builder: "linux-amd64",
+		failure: &loganal.Failure{
+			Package: "runtime",
+			Test:    "TestGCSys",
+			Message: "bad heap size",
+			Line:    42,
+		},
+	}
+	for _, test := range []struct {
+		q     string
+		match bool
+		err   string // error substring, if Set fails
+	}{
+		{"", true, ""},
+		{"pkg=runtime", true, ""},
+		{"pkg=run", false, ""},
+		{"pkg!=runtime", false, ""},
+		{"pkg!=sync", true, ""},
+		{"test=~^TestGC", true, ""},
+		{"test=~TestMalloc", false, ""},
+		{"test!~TestMalloc", true, ""},
+		{"test!~GC", false, ""},
+		{"line=42", true, ""},
+		{"pkg=runtime builder=linux-amd64", true, ""},
+		{"  pkg=runtime \t builder=linux-386 ", false, ""},
+		{`msg="bad heap size"`, true, ""},
+		{`msg="bad heap"`, false, ""},
+		{`msg=~"heap s\\w+"`, true, ""},
+		{`msg="a \"quoted\" value"`, false, ""},
+		{"os=", true, ""},
+
+		{"pkg", false, "expected field=value"},
+		{"=runtime", false, "expected field=value"},
+		{"package=runtime", false, "unknown query field"},
+		{"pkg!runtime", false, "bad operator"},
+		{`msg="bad`, false, "unterminated string"},
+		{`msg="bad\"`, false, "unterminated string"},
+		{`msg="\q"`, false, "invalid syntax"},
+		{"test=~(", false, "missing closing )"},
+	} {
+		var q query
+		err := q.Set(test.q)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.q, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.q, err)
+			continue
+		}
+		if got := q.match(pf); got != test.match {
+			t.Errorf("%s: match = %v, want %v", test.q, got, test.match)
+		}
+	}
+
+	// Multiple -q flags are a conjunction.
+	var q query
+	for _, s := range []string{"pkg=runtime", "os=linux"} {
+		if err := q.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.match(pf) {
+		t.Errorf("%s: matched failure with empty os", q.String())
+	}
+}
+
+func TestCount(t *testing.T) {
+	defer func() { collected = nil }()
+	collected = nil
+	for _, b := range []string{"linux-amd64", "linux-386", "linux-amd64", "darwin-amd64", "linux-386", "linux-amd64"} {
+		collected = append(collected, pathFailure{builder: b, failure: &loganal.Failure{Package: "runtime"}})
+	}
+
+	for _, test := range []struct {
+		key  string
+		want string
+	}{
+		// Ties are broken by key.
+		{"builder", "      3 linux-amd64\n      2 linux-386\n      1 darwin-amd64\n"},
+		{"pkg", "      6 runtime\n"},
+		{"class", "      6 runtime: \n"},
+	} {
+		var buf bytes.Buffer
+		printCounts(&buf, test.key)
+		if buf.String() != test.want {
+			t.Errorf("-count %s: got:\n%s\nwant:\n%s", test.key, buf.String(), test.want)
+		}
+	}
+}
+
+func TestProcessFound(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "greplogs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "log")
+	log := "building pkg/a\n--- FAIL: TestA (0.01s)\n    a_test.go:10: bad thing\nFAIL\nFAIL\tpkg/a\t0.1s\n"
+	if err := ioutil.WriteFile(path, []byte(log), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { failRegexps, failQuery = nil, nil }()
+	color = newColorizer(false)
+	if err := failRegexps.Set("building"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log matches -E, but its failure doesn't. The log is still
+	// found, unless there's a query, which only failures can
+	// satisfy.
+	for _, test := range []struct {
+		q     string
+		found bool
+	}{
+		{"", true},
+		{"pkg!=x", false},
+	} {
+		failQuery = nil
+		if test.q != "" {
+			if err := failQuery.Set(test.q); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		found, _, err := process(&buf, path, "log")
+		if err != nil || found != test.found || buf.Len() != 0 {
+			t.Errorf("-q %q: got found %v, %v, output %q, want %v and no output", test.q, found, err, buf.String(), test.found)
+		}
+	}
+}
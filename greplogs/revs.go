@@ -0,0 +1,156 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// revMeta is the subset of the .rev.json metadata written by
+// fetchlogs that greplogs uses.
+type revMeta struct {
+	Revision string
+	Date     string
+}
+
+// A revRange is a revision range A..B. It includes the revisions
+// after A up to and including B. Either end may be empty to leave
+// that end of the range open.
+type revRange struct {
+	from, to string
+}
+
+func parseRevRange(s string) (revRange, error) {
+	i := strings.Index(s, "..")
+	if i < 0 {
+		return revRange{}, fmt.Errorf("revision range %q: expected A..B", s)
+	}
+	r := revRange{s[:i], s[i+2:]}
+	if r.from == "" && r.to == "" {
+		return revRange{}, fmt.Errorf("revision range %q: empty range", s)
+	}
+	return r, nil
+}
+
+// parseDate parses a -since or -until date, which is either a
+// YYYY-MM-DD day or an RFC 3339 time. If end is true and s is a day,
+// parseDate returns the end of that day so that -until includes it.
+func parseDate(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if end {
+			t = t.Add(24*time.Hour - 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad date %q: want YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// selectRevs returns the revision directories in revDir to search,
+// newest first, filtered by the commit date bounds since and until
+// (which may be zero) and revision range revs (which may be nil).
+func selectRevs(revDir string, since, until time.Time, revs *revRange) ([]string, error) {
+	fis, err := ioutil.ReadDir(revDir)
+	if err != nil {
+		return nil, err
+	}
+	type rev struct {
+		path string
+		meta revMeta
+		date time.Time
+	}
+	var all []rev
+	filter := !since.IsZero() || !until.IsZero() || revs != nil
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		r := rev{path: filepath.Join(revDir, fi.Name())}
+		if filter {
+			// Only load the metadata if we need it.
+			data, err := ioutil.ReadFile(filepath.Join(r.path, ".rev.json"))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(data, &r.meta); err != nil {
+				return nil, fmt.Errorf("%s: %v", r.path, err)
+			}
+			if r.date, err = time.Parse(time.RFC3339, r.meta.Date); err != nil {
+				return nil, fmt.Errorf("%s: %v", r.path, err)
+			}
+		}
+		all = append(all, r)
+	}
+	// Directory names start with the commit date, so this sorts
+	// from oldest to newest.
+	sort.Slice(all, func(i, j int) bool { return all[i].path < all[j].path })
+
+	// Limit to the revision range.
+	if revs != nil {
+		find := func(prefix string) (int, error) {
+			found := -1
+			for i, r := range all {
+				if strings.HasPrefix(r.meta.Revision, prefix) {
+					if found >= 0 {
+						return 0, fmt.Errorf("revision %s is ambiguous", prefix)
+					}
+					found = i
+				}
+			}
+			if found < 0 {
+				return 0, fmt.Errorf("revision %s not found in %s", prefix, revDir)
+			}
+			return found, nil
+		}
+		lo, hi := 0, len(all)
+		if revs.from != "" {
+			i, err := find(revs.from)
+			if err != nil {
+				return nil, err
+			}
+			lo = i + 1
+		}
+		if revs.to != "" {
+			i, err := find(revs.to)
+			if err != nil {
+				return nil, err
+			}
+			hi = i + 1
+		}
+		if lo > hi {
+			lo = hi
+		}
+		all = all[lo:hi]
+	}
+
+	var paths []string
+	for _, r := range all {
+		if !since.IsZero() && r.date.Before(since) {
+			continue
+		}
+		if !until.IsZero() && r.date.After(until) {
+			continue
+		}
+		paths = append(paths, r.path)
+	}
+
+	// Search newest revisions first.
+	for i, j := 0, len(paths)-1; i < j; i, j = i+1, j-1 {
+		paths[i], paths[j] = paths[j], paths[i]
+	}
+	return paths, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRevRange(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want revRange
+		err  string
+	}{
+		{"abc..def", revRange{"abc", "def"}, ""},
+		{"abc..", revRange{"abc", ""}, ""},
+		{"..def", revRange{"", "def"}, ""},
+		{"..", revRange{}, "empty range"},
+		{"", revRange{}, "expected A..B"},
+		{"abc", revRange{}, "expected A..B"},
+		{"abc.def", revRange{}, "expected A..B"},
+	} {
+		got, err := parseRevRange(test.s)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseRevRange(%q): got error %v, want %q", test.s, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseRevRange(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		end  bool
+		want string // RFC 3339 with nanoseconds, or "" for error
+	}{
+		{"2019-03-04", false, "2019-03-04T00:00:00Z"},
+		{"2019-03-04", true, "2019-03-04T23:59:59.999999999Z"},
+		{"2019-03-04T10:00:00-05:00", false, "2019-03-04T10:00:00-05:00"},
+		{"2019-03-04T10:00:00-05:00", true, "2019-03-04T10:00:00-05:00"},
+		{"2019-3-4", false, ""},
+		{"yesterday", false, ""},
+	} {
+		got, err := parseDate(test.s, test.end)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("parseDate(%q) = %v, want error", test.s, got)
+			}
+			continue
+		}
+		if err != nil || got.Format(time.RFC3339Nano) != test.want {
+			t.Errorf("parseDate(%q, %v) = %v, %v, want %s", test.s, test.end, got.Format(time.RFC3339Nano), err, test.want)
+		}
+	}
+}
+
+func TestSelectRevs(t *testing.T) {
+	revDir, err := ioutil.TempDir("", "greplogs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(revDir)
+
+	// Revisions, oldest first. Like fetchlogs, name each directory
+	// after its commit date and revision.
+	revs := []revMeta{
+		{"aaaa111", "2019-03-01T12:00:00Z"},
+		{"bbbb222", "2019-03-02T00:00:00Z"},
+		{"bbbb333", "2019-03-02T23:30:00Z"},
+		{"cccc444", "2019-03-03T08:00:00Z"},
+	}
+	for _, r := range revs {
+		dir := filepath.Join(revDir, r.Date+"-"+r.Revision)
+		if err := os.Mkdir(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, ".rev.json"), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	date := func(s string, end bool) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+		d, err := parseDate(s, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for _, test := range []struct {
+		since, until string
+		rev          string
+		want         []string // revisions, newest first
+		err          string
+	}{
+		{"", "", "", []string{"cccc444", "bbbb333", "bbbb222", "aaaa111"}, ""},
+		// -until includes the whole day.
+		{"", "2019-03-02", "", []string{"bbbb333", "bbbb222", "aaaa111"}, ""},
+		{"2019-03-02", "2019-03-02", "", []string{"bbbb333", "bbbb222"}, ""},
+		{"2019-03-02T12:00:00Z", "", "", []string{"cccc444", "bbbb333"}, ""},
+		{"2019-03-04", "", "", nil, ""},
+
+		// A..B excludes A and includes B.
+		{"", "", "aaaa..bbbb3", []string{"bbbb333", "bbbb222"}, ""},
+		{"", "", "bbbb2..", []string{"cccc444", "bbbb333"}, ""},
+		{"", "", "..bbbb2", []string{"bbbb222", "aaaa111"}, ""},
+		{"", "", "bbbb3..bbbb3", nil, ""},
+		{"", "", "cccc..aaaa", nil, ""},
+		{"2019-03-02", "", "..bbbb3", []string{"bbbb333", "bbbb222"}, ""},
+
+		{"", "", "bbbb..", nil, "ambiguous"},
+		{"", "", "..dddd", nil, "not found"},
+	} {
+		var r *revRange
+		if test.rev != "" {
+			rr, err := parseRevRange(test.rev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = &rr
+		}
+		name := test.since + "|" + test.until + "|" + test.rev
+		paths, err := selectRevs(revDir, date(test.since, false), date(test.until, true), r)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var got []string
+		for _, p := range paths {
+			name := filepath.Base(p)
+			got = append(got, name[strings.LastIndex(name, "-")+1:])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A searchResult is the result of processing one file. Results are
+// printed in the order the files were found, regardless of the order
+// they finish.
+type searchResult struct {
+	path, nicePath string
+
+	found bool
+	pfs   []pathFailure
+	out   bytes.Buffer
+	err   error
+
+	done chan struct{}
+}
+
+// search processes all files under paths using *flagJobs concurrent
+// workers and prints the results to w in walk order. It returns the
+// exit status.
+func search(w io.Writer, paths []string, stripDir string) int {
+	// order carries results in walk order. Its buffer limits how
+	// far the workers can get ahead of the printer.
+	order := make(chan *searchResult, 4**flagJobs)
+	work := make(chan *searchResult)
+
+	// Walk paths.
+	go func() {
+		for _, path := range paths {
+			filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					r := &searchResult{path: path, err: err, done: make(chan struct{})}
+					close(r.done)
+					order <- r
+					return nil
+				}
+				if info.IsDir() || strings.HasPrefix(filepath.Base(path), ".") {
+					return nil
+				}
+				if len(builders) > 0 && !builders.AnyMatch(filepath.Base(path)) {
+					// Dashboard logs are named after their builder.
+					return nil
+				}
+
+				nicePath := path
+				if stripDir != "" && strings.HasPrefix(path, stripDir) {
+					nicePath = path[len(stripDir):]
+				}
+
+				r := &searchResult{path: path, nicePath: nicePath, done: make(chan struct{})}
+				order <- r
+				work <- r
+				return nil
+			})
+		}
+		close(order)
+		close(work)
+	}()
+
+	// Process files.
+	var wg sync.WaitGroup
+	for i := 0; i < *flagJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				r.found, r.pfs, r.err = process(&r.out, r.path, r.nicePath)
+				close(r.done)
+			}
+		}()
+	}
+
+	// Print results.
+	status := 1
+	for r := range order {
+		<-r.done
+		if r.err != nil {
+			status = 2
+			fmt.Fprintf(os.Stderr, "%s: %v\n", r.path, r.err)
+			continue
+		}
+		w.Write(r.out.Bytes())
+		collected = append(collected, r.pfs...)
+		if r.found && status == 1 {
+			status = 0
+		}
+	}
+	wg.Wait()
+	return status
+}
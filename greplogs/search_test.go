@@ -0,0 +1,127 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testLogs = []string{
+	"ok  \tpkg/a\t0.1s\n",
+	"--- FAIL: TestA (0.01s)\n    a_test.go:10: bad thing\nFAIL\nFAIL\tpkg/a\t0.1s\n",
+	"panic: runtime error: index out of range\n\ngoroutine 1 [running]:\nmain.main()\n\t/x/main.go:5 +0x1\nexit status 2\nFAIL\tpkg/b\t0.1s\n",
+	"panic: test timed out after 3m0s\n\ngoroutine 1 [running]:\nmain.main()\n\t/x/main.go:5 +0x1\nFAIL\tpkg/c\t180.0s\n",
+	"--- FAIL: TestB (0.01s)\n    b_test.go:20: Index Out of Bounds\nFAIL\nFAIL\tpkg/b\t0.1s\n",
+}
+
+// writeTestLogs writes a tree of logs under dir.
+func writeTestLogs(t *testing.T, dir string) {
+	t.Helper()
+	for i := 0; i < 40; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("rev%d", i/8), fmt.Sprintf("builder-%d", i%8))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		data := fmt.Sprintf("building rev %d\n%s", i, testLogs[(i*3)%len(testLogs)])
+		if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestSearchIndex checks that searching with -index and with any
+// number of workers prints the same results as a sequential search
+// without an index.
+func TestSearchIndex(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "greplogs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	logDir := filepath.Join(tmp, "logs")
+	writeTestLogs(t, logDir)
+
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(tmp, "cache"))
+	defer func(jobs int) {
+		*flagJobs = jobs
+		fileRegexps, failRegexps, logIndex, collected = nil, nil, nil, nil
+	}(*flagJobs)
+	color = newColorizer(false)
+
+	// run searches logDir and returns the output and exit status.
+	run := func(jobs int, index bool) (string, int) {
+		t.Helper()
+		*flagJobs = jobs
+		logIndex, collected = nil, nil
+		if index {
+			if logIndex, err = openIndex(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		status := search(&buf, []string{logDir}, logDir+"/")
+		if logIndex != nil {
+			if err := logIndex.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.String(), status
+	}
+
+	for _, test := range []struct {
+		e, E []string
+		// prune is a log that the index should skip, or "".
+		prune string
+	}{
+		{e: []string{"index out of range"}, prune: "rev0/builder-0"},
+		{e: []string{"timed out|index out"}},
+		{e: []string{"(?i)index out"}},
+		{e: []string{"(?i)INDEX"}, E: []string{"Bounds"}},
+		{e: []string{"^FAIL"}, E: []string{"bad thing"}, prune: "rev0/builder-0"},
+		{e: []string{"no such failure"}, prune: "rev0/builder-0"},
+	} {
+		fileRegexps, failRegexps = nil, nil
+		for _, re := range test.e {
+			if err := fileRegexps.Set(re); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, re := range test.E {
+			if err := failRegexps.Set(re); err != nil {
+				t.Fatal(err)
+			}
+		}
+		name := fmt.Sprintf("-e %q -E %q", test.e, test.E)
+		os.RemoveAll(filepath.Join(tmp, "cache"))
+
+		want, wantStatus := run(1, false)
+		if want == "" && wantStatus != 1 {
+			t.Errorf("%s: no output, but exit status %d", name, wantStatus)
+		}
+		// Run with the index twice: once to build it and once
+		// to use it.
+		for _, index := range []bool{false, true, true} {
+			for _, jobs := range []int{1, 4} {
+				got, status := run(jobs, index)
+				if got != want || status != wantStatus {
+					t.Errorf("%s with -j %d, index %v: got status %d, output:\n%s\nwant status %d, output:\n%s", name, jobs, index, status, got, wantStatus, want)
+				}
+			}
+		}
+
+		// Make sure the index is actually used.
+		if test.prune != "" {
+			if maybe, err := logIndex.mayMatch(filepath.Join(logDir, test.prune)); err != nil || maybe {
+				t.Errorf("%s: index did not skip %s (%v)", name, test.prune, err)
+			}
+		}
+	}
+}
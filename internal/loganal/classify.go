@@ -66,11 +66,12 @@ func Classify(fs []*Failure) map[Failure][]int {
 	for i, f := range fs {
 		// TODO: Match up nearby line numbers?
 		key := Failure{
-			Package:  f.Package,
-			Test:     f.Test,
-			Message:  f.canonicalMessage(),
-			Function: f.Function,
-			File:     f.File,
+			Package:   f.Package,
+			Test:      f.Test,
+			Message:   f.canonicalMessage(),
+			Function:  f.Function,
+			File:      f.File,
+			Signature: f.Signature,
 		}
 
 		canon[key] = append(canon[key], i)
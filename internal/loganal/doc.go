@@ -3,5 +3,6 @@
 // license that can be found in the LICENSE file.
 
 // Package loganal contains functions for analyzing build and test
-// logs produced by all.bash.
+// logs produced by all.bash and go test, including go test -json
+// event streams.
 package loganal
@@ -0,0 +1,303 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loganal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// An Extractor recognizes failures in a log.
+//
+// Extraction proceeds line by line. At the beginning of each line,
+// the extractors in a Registry are tried in order and the first one
+// that consumes any text wins. If no extractor consumes the line, it
+// is added to ExtractState.Unknown and extraction moves on to the
+// next line.
+type Extractor interface {
+	// Extract attempts to recognize a failure at st.Pos, which
+	// is always the beginning of a line in st.Log. It returns
+	// the failures it found and the number of bytes of st.Log
+	// (starting at st.Pos) that make up those failures.
+	//
+	// If n is 0, the extractor did not recognize this line and
+	// fs must be empty. An extractor may consume text without
+	// returning any failures to indicate that the text is known
+	// to be uninteresting. If n does not end at a line boundary,
+	// the rest of that line is also consumed.
+	Extract(st *ExtractState) (fs []*Failure, n int)
+}
+
+// ExtractorFunc adapts an ordinary function to an Extractor.
+type ExtractorFunc func(st *ExtractState) (fs []*Failure, n int)
+
+func (f ExtractorFunc) Extract(st *ExtractState) ([]*Failure, int) {
+	return f(st)
+}
+
+// ExtractState is the state of an in-progress extraction. Extractors
+// must treat all fields as read-only.
+type ExtractState struct {
+	// Log is the log being extracted, with line endings
+	// canonicalized to "\n".
+	Log string
+
+	// Pos is the byte offset in Log of the current line.
+	Pos int
+
+	// Section is the name of the current go tool dist test
+	// section, or "" if no section header has been seen.
+	Section string
+
+	// Unknown lists the lines since the last recognized line
+	// that no extractor recognized, not including their line
+	// terminators.
+	Unknown []string
+
+	// Failures lists the failures extracted so far.
+	Failures []*Failure
+
+	m       *matcher
+	cache   *extractCache
+	entries []registryEntry
+
+	// json is the state of the go test -json stream, if any.
+	json *testJSONState
+
+	testingStarted        bool
+	sectionHeaderFailures int // # failures at section start
+}
+
+// Rest returns the unconsumed part of the log, starting at the
+// current line.
+func (st *ExtractState) Rest() string {
+	return st.Log[st.Pos:]
+}
+
+// Line returns the current line, not including the line terminator.
+func (st *ExtractState) Line() string {
+	line, _ := st.m.peekLine()
+	return line
+}
+
+// consume searches for r in the remaining text. If found, it consumes
+// up to the end of the match and the rest of that line and returns
+// the match groups. Otherwise, it returns nil.
+func (st *ExtractState) consume(r *regexp.Regexp) []string {
+	if !st.m.consume(r) {
+		return nil
+	}
+	s := st.m.groups
+	if !strings.HasSuffix(s[0], "\n") {
+		// Consume the rest of the line.
+		st.m.line()
+	}
+	return s
+}
+
+// consumed returns the number of bytes consumed from st.Pos.
+func (st *ExtractState) consumed() int {
+	return st.m.pos - st.Pos
+}
+
+// firstBadLine returns the first non-empty unknown line.
+func (st *ExtractState) firstBadLine() string {
+	for _, u := range st.Unknown {
+		if len(u) > 0 {
+			return u
+		}
+	}
+	return ""
+}
+
+// A Registry is an ordered list of named extractors. It is safe to
+// register extractors while other goroutines are extracting logs
+// using the Registry; in-progress extractions will not observe the
+// new extractor.
+//
+// The zero Registry is empty and ready to use.
+type Registry struct {
+	mu      sync.Mutex
+	entries []registryEntry
+
+	// cachePool is a pool of *extractCache. Since the cached
+	// results depend on the set of extractors, this is reset
+	// whenever the registry changes. It is created lazily by
+	// Extract.
+	cachePool *sync.Pool
+}
+
+type registryEntry struct {
+	name string
+	e    Extractor
+}
+
+// DefaultRegistry is the Registry used by Extract. It is initialized
+// with the extractors for all.bash logs.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns a new Registry containing the extractors for
+// all.bash logs. Callers can add to these using Register and
+// RegisterBefore.
+func NewRegistry() *Registry {
+	r := new(Registry)
+	for _, b := range builtinExtractors {
+		r.Register(b.name, b.e)
+	}
+	return r
+}
+
+// Register adds extractor e under name to the end of r. It panics if
+// r already has an extractor named name.
+func (r *Registry) Register(name string, e Extractor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.insert(len(r.entries), name, e)
+}
+
+// RegisterBefore adds extractor e under name to r immediately before
+// the extractor named before. It panics if r already has an
+// extractor named name or does not have one named before.
+//
+// This is useful for extractors that must take precedence over the
+// catch-all extractors at the end of the default registry, such as
+// "goodLine", which ignores all lines starting with "#".
+func (r *Registry) RegisterBefore(before, name string, e Extractor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(before)
+	if i < 0 {
+		panic(fmt.Sprintf("loganal: no extractor named %q", before))
+	}
+	r.insert(i, name, e)
+}
+
+// insert adds e to r at index i. r.mu must be held.
+func (r *Registry) insert(i int, name string, e Extractor) {
+	if r.index(name) >= 0 {
+		panic(fmt.Sprintf("loganal: duplicate extractor named %q", name))
+	}
+
+	// Copy entries so in-progress extractions aren't affected.
+	entries := make([]registryEntry, 0, len(r.entries)+1)
+	entries = append(entries, r.entries[:i]...)
+	entries = append(entries, registryEntry{name, e})
+	entries = append(entries, r.entries[i:]...)
+	r.entries = entries
+
+	r.cachePool = nil
+}
+
+func (r *Registry) index(name string) int {
+	for i, ent := range r.entries {
+		if ent.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Names returns the names of the extractors in r, in the order they
+// are tried.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, len(r.entries))
+	for i, ent := range r.entries {
+		names[i] = ent.name
+	}
+	return names
+}
+
+// Extract parses the failures from log m using the extractors in r.
+func (r *Registry) Extract(m string, os, arch string) ([]*Failure, error) {
+	r.mu.Lock()
+	if r.cachePool == nil {
+		r.cachePool = &sync.Pool{New: func() interface{} {
+			return &extractCache{make(map[string]bool)}
+		}}
+	}
+	entries, cachePool := r.entries, r.cachePool
+	r.mu.Unlock()
+
+	cache := cachePool.Get().(*extractCache)
+	defer cachePool.Put(cache)
+
+	m = CanonLines(m)
+
+	st := extract(entries, cache, m)
+	return finishFailures(m, st.Failures, st.testingStarted, os, arch), nil
+}
+
+// extract runs the extractors in entries over log m, which must
+// already have canonical line endings, and returns the final
+// extraction state.
+func extract(entries []registryEntry, cache *extractCache, m string) *ExtractState {
+	st := &ExtractState{
+		Log:      m,
+		Unknown:  []string{},
+		Failures: []*Failure{},
+		m:        newMatcher(m),
+		cache:    cache,
+		entries:  entries,
+	}
+	matcher := st.m
+
+	for !matcher.done() {
+		// Check for a cached result.
+		line, nextLinePos := matcher.peekLine()
+		isGoodLine, cached := cache.boringLines[line]
+
+		// Process the line.
+		isKnown := true
+		if cached {
+			matcher.pos = nextLinePos
+			if !isGoodLine {
+				// This line is known to not match any
+				// extractor. Follow the default case.
+				isKnown = false
+				st.Unknown = append(st.Unknown, line)
+			}
+		} else {
+			isKnown = false
+			for _, ent := range entries {
+				matcher.pos = st.Pos
+				fs, n := ent.e.Extract(st)
+				if n == 0 {
+					if len(fs) != 0 {
+						panic(fmt.Sprintf("loganal: extractor %q returned failures without consuming input", ent.name))
+					}
+					continue
+				}
+				if n < 0 || st.Pos+n > len(m) {
+					panic(fmt.Sprintf("loganal: extractor %q consumed %d bytes with %d remaining", ent.name, n, len(m)-st.Pos))
+				}
+				matcher.pos = st.Pos + n
+				if !strings.HasSuffix(m[:matcher.pos], "\n") {
+					// Consume the rest of the line.
+					matcher.line()
+				}
+				st.Failures = append(st.Failures, fs...)
+				isKnown = true
+				break
+			}
+			if !isKnown {
+				st.Unknown = append(st.Unknown, line)
+				cache.boringLines[line] = false
+				matcher.pos = nextLinePos
+			}
+		}
+
+		// Clear unknown lines on any known line.
+		if isKnown {
+			st.Unknown = st.Unknown[:0]
+		}
+		st.Pos = matcher.pos
+	}
+
+	return st
+}
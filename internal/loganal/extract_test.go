@@ -0,0 +1,146 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loganal
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testLog = `##### Testing packages.
+ok  	archive/tar	0.1s
+--- FAIL: TestFoo (0.00s)
+	foo_test.go:12: got 3, want 4
+FAIL
+FAIL	bytes	0.2s
+# vet: sync
+sync/mutex.go:10: call of fmt.Printf copies lock value
+FAIL	net/http [build failed]
+`
+
+func TestExtract(t *testing.T) {
+	fs, err := Extract(testLog, "linux", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fs {
+		got = append(got, f.String())
+	}
+	want := []string{
+		"bytes.TestFoo at foo_test.go:12: got 3, want 4",
+		"net/http: build failed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+var vetRe = regexp.MustCompile(`^# vet: (.*)\n(.*)\n`)
+
+func extractVet(st *ExtractState) ([]*Failure, int) {
+	s := vetRe.FindStringSubmatch(st.Rest())
+	if s == nil {
+		return nil, 0
+	}
+	return []*Failure{{
+		Package:     s[1],
+		Message:     s[2],
+		FullMessage: s[0],
+	}}, len(s[0])
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterBefore("goodLine", "vet", ExtractorFunc(extractVet))
+
+	names := r.Names()
+	if len(names) != len(builtinExtractors)+1 {
+		t.Fatalf("want %d extractors, got %v", len(builtinExtractors)+1, names)
+	}
+	if i := r.index("vet"); names[i+1] != "goodLine" {
+		t.Errorf("vet extractor not registered before goodLine: %v", names)
+	}
+
+	fs, err := r.Extract(testLog, "linux", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 3 {
+		t.Fatalf("want 3 failures, got %v", fs)
+	}
+	f := fs[1]
+	if f.Package != "sync" || f.Message != "sync/mutex.go:10: call of fmt.Printf copies lock value" || f.OS != "linux" {
+		t.Errorf("bad vet failure %+v", f)
+	}
+
+	// The default registry should be unaffected.
+	if fs, _ := Extract(testLog, "", ""); len(fs) != 2 {
+		t.Errorf("want 2 failures from default registry, got %v", fs)
+	}
+}
+
+func TestRegistryZero(t *testing.T) {
+	var r Registry
+	if _, err := r.Extract(testLog, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	r.Register("vet", ExtractorFunc(extractVet))
+	if _, err := r.Extract(testLog, "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering duplicate extractor did not panic")
+		}
+	}()
+	NewRegistry().Register("goodLine", ExtractorFunc(extractVet))
+}
+
+const testJSONLog = `{"Action":"start","Package":"a"}
+{"Action":"run","Package":"a","Test":"TestSub"}
+{"Action":"output","Package":"a","Test":"TestSub","Output":"=== RUN   TestSub\n"}
+{"Action":"run","Package":"a","Test":"TestSub/y"}
+{"Action":"output","Package":"a","Test":"TestSub/y","Output":"=== RUN   TestSub/y\n"}
+{"Action":"output","Package":"a","Test":"TestSub/y","Output":"    a_test.go:9: bad y\n"}
+{"Action":"output","Package":"a","Test":"TestSub/y","Output":"--- FAIL: TestSub/y (0.00s)\n"}
+{"Action":"fail","Package":"a","Test":"TestSub/y","Elapsed":0}
+{"Action":"output","Package":"a","Test":"TestSub","Output":"--- FAIL: TestSub (0.00s)\n"}
+{"Action":"fail","Package":"a","Test":"TestSub","Elapsed":0}
+{"Action":"output","Package":"a","Output":"FAIL\n"}
+{"Action":"output","Package":"a","Output":"FAIL\ta\t0.002s\n"}
+{"Action":"fail","Package":"a","Elapsed":0.002}
+{"Action":"start","Package":"b"}
+{"Action":"output","Package":"b","Output":"panic: oops\n"}
+{"Action":"output","Package":"b","Output":"\n"}
+{"Action":"output","Package":"b","Output":"goroutine 1 [running]:\n"}
+{"Action":"output","Package":"b","Output":"b.init.0()\n"}
+{"Action":"output","Package":"b","Output":"\t/src/b/b_test.go:5 +0x25\n"}
+{"Action":"output","Package":"b","Output":"FAIL\tb\t0.001s\n"}
+{"Action":"fail","Package":"b","Elapsed":0.001}
+`
+
+func TestExtractTestJSON(t *testing.T) {
+	fs, err := Extract(testJSONLog, "linux", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fs {
+		got = append(got, f.String())
+	}
+	want := []string{
+		"a.TestSub/y at a_test.go:9: bad y",
+		"b at b.init.0: oops",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 )
 
 // Failure records a failure extracted from an all.bash log.
@@ -44,6 +43,11 @@ type Failure struct {
 	// known.
 	Line int
 
+	// Signature identifies the blocked goroutines of a deadlock
+	// or test timeout, as computed by Traceback.Signature. For
+	// other failures, it is "".
+	Signature string
+
 	// OS and Arch are the GOOS and GOARCH of this failure.
 	OS, Arch string
 }
@@ -70,6 +74,9 @@ func (f Failure) String() string {
 		s += ": "
 	}
 	s += f.Message
+	if f.Signature != "" {
+		s += " [" + f.Signature + "]"
+	}
 	return s
 }
 
@@ -152,191 +159,234 @@ var (
 )
 
 // An extractCache speeds up failure extraction from multiple logs by
-// caching known lines. It is *not* thread-safe, so we track it in a
-// sync.Pool.
+// caching known lines. It is *not* thread-safe, so each Registry
+// tracks them in a sync.Pool.
 type extractCache struct {
 	boringLines map[string]bool
 }
 
-var extractCachePool sync.Pool
+// Extract parses the failures from all.bash log m using
+// DefaultRegistry. m may also contain go test -json output.
+func Extract(m string, os, arch string) ([]*Failure, error) {
+	return DefaultRegistry.Extract(m, os, arch)
+}
+
+// CanonLines returns log m with the line endings canonicalized to
+// "\n", as Extract does before extracting failures. The FullMessage
+// of a failure extracted from m is a substring of CanonLines(m),
+// except for failures extracted from go test -json output.
+func CanonLines(m string) string {
+	// Note that some logs have a mix of line endings and some
+	// somehow have multiple \r's.
+	return canonLine.ReplaceAllString(m, "\n")
+}
+
+// builtinExtractors is the initial contents of every Registry, in
+// order.
+var builtinExtractors = []struct {
+	name string
+	e    Extractor
+}{
+	{"testJSON", ExtractorFunc(extractTestJSON)},
+	{"testingHeader", ExtractorFunc(extractTestingHeader)},
+	{"sectionHeader", ExtractorFunc(extractSectionHeader)},
+	{"testingFailed", ExtractorFunc(extractTestingFailed)},
+	{"gotestFailed", ExtractorFunc(extractGotestFailed)},
+	{"buildFailed", ExtractorFunc(extractBuildFailed)},
+	{"timeoutPanic1", ExtractorFunc(extractTimeoutPanic1)},
+	{"timeoutPanic2", ExtractorFunc(extractTimeoutPanic2)},
+	{"runtimeFailed", ExtractorFunc(extractRuntimeFailed)},
+	{"apiCheckerFailed", ExtractorFunc(extractAPICheckerFailed)},
+	{"goodLine", ExtractorFunc(extractGoodLine)},
+	{"testingUnknownFailed", ExtractorFunc(extractTestingUnknownFailed)},
+	{"miscFailed", ExtractorFunc(extractMiscFailed)},
+}
 
-func init() {
-	extractCachePool.New = func() interface{} {
-		return &extractCache{make(map[string]bool)}
+func extractTestingHeader(st *ExtractState) ([]*Failure, int) {
+	if st.consume(testingHeader) == nil {
+		return nil, 0
 	}
+	st.testingStarted = true
+	return nil, st.consumed()
 }
 
-// Extract parses the failures from all.bash log m.
-func Extract(m string, os, arch string) ([]*Failure, error) {
-	fs := []*Failure{}
-	testingStarted := false
-	section := ""
-	sectionHeaderFailures := 0 // # failures at section start
-	unknown := []string{}
-	cache := extractCachePool.Get().(*extractCache)
-	defer extractCachePool.Put(cache)
-
-	// Canonicalize line endings. Note that some logs have a mix
-	// of line endings and some somehow have multiple \r's.
-	m = canonLine.ReplaceAllString(m, "\n")
-
-	var s []string
-	matcher := newMatcher(m)
-	consume := func(r *regexp.Regexp) bool {
-		matched := matcher.consume(r)
-		s = matcher.groups
-		if matched && !strings.HasSuffix(s[0], "\n") {
-			// Consume the rest of the line.
-			matcher.line()
-		}
-		return matched
+func extractSectionHeader(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(sectionHeader)
+	if s == nil {
+		return nil, 0
 	}
-	firstBadLine := func() string {
-		for _, u := range unknown {
-			if len(u) > 0 {
-				return u
-			}
-		}
-		return ""
+	st.Section = s[1]
+	st.sectionHeaderFailures = len(st.Failures)
+	return nil, st.consumed()
+}
+
+func extractTestingFailed(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(testingFailed)
+	if s == nil {
+		return nil, 0
+	}
+	f := &Failure{
+		Test:        s[1],
+		Package:     s[3],
+		FullMessage: s[0],
+		Message:     "unknown testing.T failure",
 	}
 
-	for !matcher.done() {
-		// Check for a cached result.
-		line, nextLinePos := matcher.peekLine()
-		isGoodLine, cached := cache.boringLines[line]
+	// TODO: Can have multiple errors per FAIL:
+	// ../fetchlogs/rev/2015-03-24T19:51:21-41f9c43/linux-arm64-canonical
 
-		// Process the line.
-		isKnown := true
-		switch {
-		case cached:
-			matcher.pos = nextLinePos
-			if !isGoodLine {
-				// This line is known to not match any
-				// regexps. Follow the default case.
-				isKnown = false
-				unknown = append(unknown, line)
-			}
+	sError := testingError.FindStringSubmatch(s[2])
+	sPanic := testingPanic.FindStringSubmatch(s[2])
+	if sError != nil {
+		f.File, f.Line, f.Message = sError[1], atoi(sError[2]), sError[3]
+	} else if sPanic != nil {
+		f.Function, f.File, f.Line = panicWhere(s[2])
+		f.Message = sPanic[1]
+	}
 
-		case consume(testingHeader):
-			testingStarted = true
+	return []*Failure{f}, st.consumed()
+}
 
-		case consume(sectionHeader):
-			section = s[1]
-			sectionHeaderFailures = len(fs)
+func extractGotestFailed(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(gotestFailed)
+	if s == nil {
+		return nil, 0
+	}
+	return []*Failure{{
+		Package:     "test/" + s[2],
+		FullMessage: s[0],
+		Message:     firstLine(s[1]),
+	}}, st.consumed()
+}
 
-		case consume(testingFailed):
-			f := &Failure{
-				Test:        s[1],
-				Package:     s[3],
-				FullMessage: s[0],
-				Message:     "unknown testing.T failure",
-			}
+func extractBuildFailed(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(buildFailed)
+	if s == nil {
+		return nil, 0
+	}
+	// This may have an accompanying compiler crash, but it's
+	// interleaved with other "ok" lines, so it's hard to find.
+	return []*Failure{{
+		FullMessage: s[0],
+		Message:     "build failed",
+		Package:     s[1],
+	}}, st.consumed()
+}
 
-			// TODO: Can have multiple errors per FAIL:
-			// ../fetchlogs/rev/2015-03-24T19:51:21-41f9c43/linux-arm64-canonical
+func extractTimeoutPanic1(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(timeoutPanic1)
+	if s == nil {
+		return nil, 0
+	}
+	return []*Failure{{
+		Test:        testFromTraceback(s[1]),
+		FullMessage: s[0],
+		Message:     "test timed out",
+		Package:     s[2],
+		Signature:   ParseTraceback(s[1]).Signature(),
+	}}, st.consumed()
+}
 
-			sError := testingError.FindStringSubmatch(s[2])
-			sPanic := testingPanic.FindStringSubmatch(s[2])
-			if sError != nil {
-				f.File, f.Line, f.Message = sError[1], atoi(sError[2]), sError[3]
-			} else if sPanic != nil {
-				f.Function, f.File, f.Line = panicWhere(s[2])
-				f.Message = sPanic[1]
-			}
+func extractTimeoutPanic2(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(timeoutPanic2)
+	if s == nil {
+		return nil, 0
+	}
+	tb := strings.Join(st.Unknown, "\n")
+	return []*Failure{{
+		Test:        testFromTraceback(tb),
+		FullMessage: tb + "\n" + s[0],
+		Message:     "test timed out",
+		Package:     s[1],
+		Signature:   ParseTraceback(tb).Signature(),
+	}}, st.consumed()
+}
 
-			fs = append(fs, f)
-
-		case consume(gotestFailed):
-			fs = append(fs, &Failure{
-				Package:     "test/" + s[2],
-				FullMessage: s[0],
-				Message:     firstLine(s[1]),
-			})
-
-		case consume(buildFailed):
-			// This may have an accompanying compiler
-			// crash, but it's interleaved with other "ok"
-			// lines, so it's hard to find.
-			fs = append(fs, &Failure{
-				FullMessage: s[0],
-				Message:     "build failed",
-				Package:     s[1],
-			})
-
-		case consume(timeoutPanic1):
-			fs = append(fs, &Failure{
-				Test:        testFromTraceback(s[1]),
-				FullMessage: s[0],
-				Message:     "test timed out",
-				Package:     s[2],
-			})
-
-		case consume(timeoutPanic2):
-			tb := strings.Join(unknown, "\n")
-			fs = append(fs, &Failure{
-				Test:        testFromTraceback(tb),
-				FullMessage: tb + "\n" + s[0],
-				Message:     "test timed out",
-				Package:     s[1],
-			})
-
-		case matcher.lineHasLiteral(runtimeLiterals...) && consume(runtimeFailed):
-			start := matcher.matchPos
-			msg := s[1]
-			pkg := "testing"
-			if strings.Contains(s[0], "fatal error:") {
-				pkg = "runtime"
-			}
-			traceback := consumeTraceback(matcher)
-			matcher.consume(runtimeFailedTrailer)
-			fn, file, line := panicWhere(traceback)
-			fs = append(fs, &Failure{
-				Package:     pkg,
-				FullMessage: matcher.str[start:matcher.pos],
-				Message:     msg,
-				Function:    fn,
-				File:        file,
-				Line:        line,
-			})
-
-		case consume(apiCheckerFailed):
-			fs = append(fs, &Failure{
-				Package:     "API checker",
-				FullMessage: s[0],
-				Message:     s[1],
-			})
-
-		case consume(goodLine):
-			// Ignore. Just cache and clear unknown.
-			cache.boringLines[line] = true
-
-		case consume(testingUnknownFailed):
-			fs = append(fs, &Failure{
-				Package:     s[1],
-				FullMessage: s[0],
-				Message:     "unknown failure: " + firstBadLine(),
-			})
-
-		case len(fs) == sectionHeaderFailures && consume(miscFailed):
-			fs = append(fs, &Failure{
-				Package:     section,
-				FullMessage: s[0],
-				Message:     "unknown failure: " + firstBadLine(),
-			})
+func extractRuntimeFailed(st *ExtractState) ([]*Failure, int) {
+	matcher := st.m
+	if !matcher.lineHasLiteral(runtimeLiterals...) {
+		return nil, 0
+	}
+	s := st.consume(runtimeFailed)
+	if s == nil {
+		return nil, 0
+	}
+	start := matcher.matchPos
+	msg := s[1]
+	pkg := "testing"
+	if strings.Contains(s[0], "fatal error:") {
+		pkg = "runtime"
+	}
+	traceback := consumeTraceback(matcher)
+	matcher.consume(runtimeFailedTrailer)
+	fn, file, line := panicWhere(traceback)
+	sig := ""
+	if msg == "all goroutines are asleep - deadlock!" {
+		sig = ParseTraceback(traceback).Signature()
+	}
+	return []*Failure{{
+		Package:     pkg,
+		FullMessage: matcher.str[start:matcher.pos],
+		Message:     msg,
+		Function:    fn,
+		File:        file,
+		Line:        line,
+		Signature:   sig,
+	}}, st.consumed()
+}
 
-		default:
-			isKnown = false
-			unknown = append(unknown, line)
-			cache.boringLines[line] = false
-			matcher.pos = nextLinePos
-		}
+func extractAPICheckerFailed(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(apiCheckerFailed)
+	if s == nil {
+		return nil, 0
+	}
+	return []*Failure{{
+		Package:     "API checker",
+		FullMessage: s[0],
+		Message:     s[1],
+	}}, st.consumed()
+}
 
-		// Clear unknown lines on any known line.
-		if isKnown {
-			unknown = unknown[:0]
-		}
+func extractGoodLine(st *ExtractState) ([]*Failure, int) {
+	line := st.Line()
+	if st.consume(goodLine) == nil {
+		return nil, 0
+	}
+	// Ignore. Just cache and clear unknown.
+	st.cache.boringLines[line] = true
+	return nil, st.consumed()
+}
+
+func extractTestingUnknownFailed(st *ExtractState) ([]*Failure, int) {
+	s := st.consume(testingUnknownFailed)
+	if s == nil {
+		return nil, 0
 	}
+	return []*Failure{{
+		Package:     s[1],
+		FullMessage: s[0],
+		Message:     "unknown failure: " + st.firstBadLine(),
+	}}, st.consumed()
+}
 
+func extractMiscFailed(st *ExtractState) ([]*Failure, int) {
+	if len(st.Failures) != st.sectionHeaderFailures {
+		return nil, 0
+	}
+	s := st.consume(miscFailed)
+	if s == nil {
+		return nil, 0
+	}
+	return []*Failure{{
+		Package:     st.Section,
+		FullMessage: s[0],
+		Message:     "unknown failure: " + st.firstBadLine(),
+	}}, st.consumed()
+}
+
+// finishFailures performs whole-log processing of the failures fs
+// extracted from log m.
+func finishFailures(m string, fs []*Failure, testingStarted bool, os, arch string) []*Failure {
 	// TODO: FullMessages for these.
 	if len(fs) == 0 && strings.Contains(m, "no space left on device") {
 		fs = append(fs, &Failure{
@@ -373,10 +423,11 @@ func Extract(m string, os, arch string) ([]*Failure, error) {
 	maxCount := 0
 	for _, f := range fs {
 		key := Failure{
-			Message:  f.canonicalMessage(),
-			Function: f.Function,
-			File:     f.File,
-			Line:     f.Line,
+			Message:   f.canonicalMessage(),
+			Function:  f.Function,
+			File:      f.File,
+			Line:      f.Line,
+			Signature: f.Signature,
 		}
 
 		d := msgDedup[key]
@@ -428,7 +479,7 @@ func Extract(m string, os, arch string) ([]*Failure, error) {
 		// Trim trailing newlines from FullMessage.
 		f.FullMessage = strings.TrimRight(f.FullMessage, "\n")
 	}
-	return fs, nil
+	return fs
 }
 
 func atoi(s string) int {
@@ -479,14 +530,10 @@ loop:
 	return m.str[start:m.pos]
 }
 
-var (
-	// testFromTracebackRe matches a traceback entry from a
-	// function named Test* in a file named *_test.go. It ignores
-	// "created by" lines.
-	testFromTracebackRe = regexp.MustCompile(`\.(Test[^(\n]+)\(.*\n.*_test\.go`)
-
-	panicWhereRe = regexp.MustCompile(`(?m:^)` + tbEntry)
-)
+// testFromTracebackRe matches a traceback entry from a function
+// named Test* in a file named *_test.go. It ignores "created by"
+// lines.
+var testFromTracebackRe = regexp.MustCompile(`\.(Test[^(\n]+)\(.*\n.*_test\.go`)
 
 // testFromTraceback attempts to return the test name from a
 // traceback.
@@ -501,15 +548,10 @@ func testFromTraceback(tb string) string {
 // panicWhere attempts to return the fully qualified name, source
 // file, and line number of the panicking function in traceback tb.
 func panicWhere(tb string) (fn string, file string, line int) {
-	m := matcher{str: tb}
-	for m.consume(panicWhereRe) {
-		fn := m.groups[1]
-
-		// Ignore functions involved in panic handling.
-		if strings.HasPrefix(fn, "runtime.panic") || fn == "runtime.throw" || fn == "runtime.sigpanic" {
-			continue
+	for _, g := range ParseTraceback(tb).Goroutines {
+		if f := g.PanicFrame(); f != nil {
+			return f.Func, f.File, f.Line
 		}
-		return fn, m.groups[2], atoi(m.groups[3])
 	}
 	return "", "", 0
 }
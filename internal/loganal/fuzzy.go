@@ -0,0 +1,367 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loganal
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A Merge explains why FuzzyClassify combined two failure classes.
+type Merge struct {
+	// Class is the combined failure class that resulted from
+	// this and any other merges.
+	Class Failure
+
+	// A and B are the exact failure classes (as returned by
+	// Classify) that were found to be similar.
+	A, B Failure
+
+	// Similarity is the similarity of A and B, from 0 to 1.
+	Similarity float64
+
+	// Edits lists the token-level edits that transform A into
+	// B, such as `"x" → "y"`, `+"y"`, or `-"x"`.
+	Edits []string
+}
+
+func (m Merge) String() string {
+	return fmt.Sprintf("%s\n  ~ %s\n  (%.0f%% similar: %s)", m.A, m.B, 100*m.Similarity, strings.Join(m.Edits, ", "))
+}
+
+// FuzzyClassify is like Classify, but additionally combines failure
+// classes that are similar but not identical. This catches failures
+// whose messages changed slightly over time, or whose stacks moved
+// between functions or files.
+//
+// Two classes are similar if they have the same Package and Test and
+// the token-level edit distance between their messages and stacks
+// is at most 1-threshold of the length of the longer one. Similarity
+// is transitive, so a chain of similar classes will be combined into
+// one class.
+//
+// FuzzyClassify returns the combined failure classes and, for each
+// combination it performed, an explanation of why.
+func FuzzyClassify(fs []*Failure, threshold float64) (map[Failure][]int, []Merge) {
+	exact := Classify(fs)
+
+	// Bucket exact classes that are candidates for merging.
+	type bucketKey struct{ pkg, test string }
+	buckets := map[bucketKey][]Failure{}
+	for class := range exact {
+		k := bucketKey{class.Package, class.Test}
+		buckets[k] = append(buckets[k], class)
+	}
+
+	out := make(map[Failure][]int, len(exact))
+	var merges []Merge
+	for _, classes := range buckets {
+		if len(classes) == 1 {
+			out[classes[0]] = exact[classes[0]]
+			continue
+		}
+		bucketMerges := len(merges)
+		var mergeFrom []int // index in classes of each Merge.A
+
+		// Sort for determinism.
+		sort.Slice(classes, func(i, j int) bool {
+			return classes[i].String() < classes[j].String()
+		})
+		toks := make([][]token, len(classes))
+		for i := range classes {
+			toks[i] = failureTokens(&classes[i])
+		}
+
+		// Union similar classes.
+		parent := make([]int, len(classes))
+		for i := range parent {
+			parent[i] = i
+		}
+		var find func(i int) int
+		find = func(i int) int {
+			if parent[i] != i {
+				parent[i] = find(parent[i])
+			}
+			return parent[i]
+		}
+		for i := range classes {
+			for j := i + 1; j < len(classes); j++ {
+				sim, ops := similarity(toks[i], toks[j])
+				if sim < threshold {
+					continue
+				}
+				ri, rj := find(i), find(j)
+				if ri == rj {
+					continue
+				}
+				parent[rj] = ri
+				mergeFrom = append(mergeFrom, i)
+				merges = append(merges, Merge{
+					A:          classes[i],
+					B:          classes[j],
+					Similarity: sim,
+					Edits:      describeEdits(toks[i], toks[j], ops),
+				})
+			}
+		}
+
+		// Combine each group.
+		keys := map[int]Failure{}
+		groups := map[int][]int{}
+		for i := range classes {
+			r := find(i)
+			groups[r] = append(groups[r], i)
+		}
+		for _, group := range groups {
+			if len(group) == 1 {
+				class := classes[group[0]]
+				out[class] = append(out[class], exact[class]...)
+				continue
+			}
+			key, idxs := combineClasses(classes, toks, group, exact)
+			out[key] = append(out[key], idxs...)
+			keys[find(group[0])] = key
+		}
+		for k, i := range mergeFrom {
+			merges[bucketMerges+k].Class = keys[find(i)]
+		}
+	}
+	sort.SliceStable(merges, func(i, j int) bool {
+		return merges[i].Class.String() < merges[j].Class.String()
+	})
+	return out, merges
+}
+
+// combineClasses returns the common features and the combined input
+// indexes of the exact classes listed in group.
+func combineClasses(classes []Failure, toks [][]token, group []int, exact map[Failure][]int) (Failure, []int) {
+	// Use the largest class as the representative.
+	rep := group[0]
+	for _, i := range group[1:] {
+		if len(exact[classes[i]]) > len(exact[classes[rep]]) {
+			rep = i
+		}
+	}
+	key := classes[rep]
+
+	// Generalize the parts of the representative message that
+	// differ in any other class.
+	var msgToks []token
+	for _, t := range toks[rep] {
+		if t.kind == "" {
+			msgToks = append(msgToks, t)
+		}
+	}
+	wild := make([]bool, len(msgToks))
+	insert := make([]bool, len(msgToks)+1)
+	var idxs []int
+	for _, i := range group {
+		class := classes[i]
+		idxs = append(idxs, exact[class]...)
+		if i == rep {
+			continue
+		}
+		var other []token
+		for _, t := range toks[i] {
+			if t.kind == "" {
+				other = append(other, t)
+			}
+		}
+		_, ops := similarity(msgToks, other)
+		for _, op := range ops {
+			switch op.op {
+			case '=':
+			case '+':
+				insert[op.a] = true
+			default:
+				wild[op.a] = true
+			}
+		}
+
+		if class.Function != key.Function {
+			key.Function = ""
+		}
+		if class.File != key.File {
+			key.File = ""
+		}
+		if class.Line != key.Line {
+			key.Line = 0
+		}
+		if class.Signature != key.Signature {
+			key.Signature = ""
+		}
+		if class.OS != key.OS {
+			key.OS = ""
+		}
+		if class.Arch != key.Arch {
+			key.Arch = ""
+		}
+	}
+	if key.Function == "" && key.File == "" {
+		key.Line = 0
+	}
+
+	var msg strings.Builder
+	lastWild := false
+	for i := 0; i <= len(msgToks); i++ {
+		if insert[i] && !lastWild {
+			if msg.Len() > 0 {
+				msg.WriteString(" ")
+			}
+			msg.WriteString("…")
+			lastWild = true
+		}
+		if i == len(msgToks) {
+			break
+		}
+		t := msgToks[i]
+		if wild[i] || t.text == "…" {
+			if !lastWild {
+				msg.WriteString(t.sep + "…")
+			}
+			lastWild = true
+		} else {
+			msg.WriteString(t.sep + t.text)
+			lastWild = false
+		}
+	}
+	key.Message = msg.String()
+
+	sort.Ints(idxs)
+	return key, idxs
+}
+
+// A token is one word or punctuation mark of a failure's message, or
+// one element of its stack.
+type token struct {
+	// kind is "" for message tokens, or the name of the Failure
+	// field this token came from.
+	kind string
+	text string
+	sep  string // whitespace preceding this token in the message
+}
+
+var messageToken = regexp.MustCompile(`[\pL\pN_…]+|[^\s\pL\pN_…]`)
+
+// failureTokens returns the tokens of f's message followed by the
+// tokens of its stack.
+func failureTokens(f *Failure) []token {
+	msg := f.Message
+	var toks []token
+	prev := 0
+	for _, m := range messageToken.FindAllStringIndex(msg, -1) {
+		toks = append(toks, token{text: msg[m[0]:m[1]], sep: msg[prev:m[0]]})
+		prev = m[1]
+	}
+	if f.Function != "" {
+		toks = append(toks, token{kind: "func", text: f.Function})
+	}
+	if f.File != "" {
+		toks = append(toks, token{kind: "file", text: path.Base(f.File)})
+	}
+	if f.Signature != "" {
+		for _, sig := range strings.Split(f.Signature, "; ") {
+			toks = append(toks, token{kind: "blocked", text: sig})
+		}
+	}
+	return toks
+}
+
+// An editOp is one step in transforming one token sequence into
+// another. op is '=' (keep a[a]), '~' (replace a[a] with b[b]), '-'
+// (delete a[a]), or '+' (insert b[b] before a[a]).
+type editOp struct {
+	op   byte
+	a, b int
+}
+
+// similarity returns the similarity of token sequences a and b, from
+// 0 to 1, and the edits that transform a into b.
+func similarity(a, b []token) (float64, []editOp) {
+	// Compute the Levenshtein distance table.
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1].kind == b[j-1].kind && a[i-1].text == b[j-1].text {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j-1]+cost, d[i-1][j]+1, d[i][j-1]+1)
+		}
+	}
+
+	// Trace back the edits.
+	var ops []editOp
+	for i, j := len(a), len(b); i > 0 || j > 0; {
+		switch {
+		case i > 0 && j > 0 && d[i][j] == d[i-1][j-1] && a[i-1].kind == b[j-1].kind && a[i-1].text == b[j-1].text:
+			i, j = i-1, j-1
+			ops = append(ops, editOp{'=', i, j})
+		case i > 0 && d[i][j] == d[i-1][j]+1:
+			i--
+			ops = append(ops, editOp{'-', i, j})
+		case j > 0 && d[i][j] == d[i][j-1]+1:
+			j--
+			ops = append(ops, editOp{'+', i, j})
+		default:
+			i, j = i-1, j-1
+			ops = append(ops, editOp{'~', i, j})
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 1, ops
+	}
+	return 1 - float64(d[len(a)][len(b)])/float64(longest), ops
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// describeEdits returns a description of each non-trivial edit in ops.
+func describeEdits(a, b []token, ops []editOp) []string {
+	desc := func(t token) string {
+		if t.kind == "" {
+			return fmt.Sprintf("%q", t.text)
+		}
+		return fmt.Sprintf("%s %q", t.kind, t.text)
+	}
+	var out []string
+	for _, op := range ops {
+		switch op.op {
+		case '~':
+			out = append(out, desc(a[op.a])+" → "+desc(b[op.b]))
+		case '-':
+			out = append(out, "-"+desc(a[op.a]))
+		case '+':
+			out = append(out, "+"+desc(b[op.b]))
+		}
+	}
+	return out
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loganal
+
+import "testing"
+
+func TestFuzzyClassify(t *testing.T) {
+	fs := []*Failure{
+		{Package: "net", Test: "TestDial", Message: "dial tcp: connection refused", Function: "net.TestDial"},
+		{Package: "net", Test: "TestDial", Message: "dial tcp: connection refused", Function: "net.TestDial"},
+		{Package: "net", Test: "TestDial", Message: "dial tcp: connection reset by peer", Function: "net.TestDial"},
+		{Package: "net", Test: "TestDial", Message: "unexpected EOF while reading response", Function: "net.TestDial"},
+		{Package: "os", Test: "TestDial", Message: "dial tcp: connection refused", Function: "net.TestDial"},
+	}
+
+	classes, merges := FuzzyClassify(fs, 0.6)
+	if len(classes) != 3 {
+		t.Fatalf("want 3 classes, got %v", classes)
+	}
+	want := Failure{Package: "net", Test: "TestDial", Message: "dial tcp: connection …", Function: "net.TestDial"}
+	idxs, ok := classes[want]
+	if !ok {
+		t.Fatalf("missing class %v in %v", want, classes)
+	}
+	if len(idxs) != 3 || idxs[0] != 0 || idxs[1] != 1 || idxs[2] != 2 {
+		t.Errorf("want class %v to have failures [0 1 2], got %v", want, idxs)
+	}
+
+	if len(merges) != 1 {
+		t.Fatalf("want 1 merge, got %v", merges)
+	}
+	m := merges[0]
+	if m.Class != want {
+		t.Errorf("want merge into %v, got %v", want, m.Class)
+	}
+	if len(m.Edits) != 3 || m.Edits[0] != `"refused" → "reset"` {
+		t.Errorf("unexpected merge explanation %v", m)
+	}
+
+	// At a high threshold, FuzzyClassify should match Classify.
+	classes, merges = FuzzyClassify(fs, 0.9)
+	if len(classes) != len(Classify(fs)) || len(merges) != 0 {
+		t.Errorf("want no merges at high threshold, got %v", merges)
+	}
+}
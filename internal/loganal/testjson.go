@@ -0,0 +1,225 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loganal
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// testEvent is a go test -json event, as produced by test2json.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Output  string
+
+	// FailedBuild is the import path of the package that failed
+	// to build, for a package "fail" event.
+	FailedBuild string
+
+	// ImportPath is the package being built, for "build-output"
+	// and "build-fail" events.
+	ImportPath string
+}
+
+type testKey struct {
+	pkg, test string
+}
+
+// testJSONState tracks the go test -json stream in a log across
+// calls to extractTestJSON.
+type testJSONState struct {
+	// output is the output so far of each running test. The
+	// output of package pkg, including all of its tests, is
+	// output[testKey{pkg, ""}].
+	output map[testKey]*strings.Builder
+
+	// buildOutput is the build output of each import path.
+	buildOutput map[string]*strings.Builder
+
+	// failedTests counts the failures reported so far for each
+	// package.
+	failedTests map[string]int
+
+	// failedSubtests records tests that have failed subtests.
+	failedSubtests map[testKey]bool
+}
+
+var (
+	// testJSONFraming matches the lines test2json uses to frame
+	// test output. These are not part of any failure message.
+	testJSONFraming = regexp.MustCompile(`(?m)^=== (?:RUN|PAUSE|CONT|NAME) .*\n`)
+
+	// testJSONError matches the file name and message of the
+	// last T.Error in a test's output. Unlike testingError, this
+	// accepts the space indentation used by newer versions of
+	// the testing package.
+	testJSONError = regexp.MustCompile(`(?:.*\n)*[ \t]+([^:\s]+):([0-9]+): (.*)\n`)
+
+	// testJSONPanic matches a panic or throw in a test's output.
+	// Newer versions of the testing package annotate recovered
+	// panics with "[recovered, repanicked]".
+	testJSONPanic = regexp.MustCompile(`(?m)^(?:panic: |fatal error: )(.*?)(?: \[recovered.*\])?$`)
+)
+
+// extractTestJSON extracts failures from a go test -json event
+// stream. Each event is consumed individually, so the stream may be
+// interleaved with other output.
+func extractTestJSON(st *ExtractState) ([]*Failure, int) {
+	line := st.Line()
+	if !strings.HasPrefix(line, "{") {
+		return nil, 0
+	}
+	var ev testEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Action == "" {
+		return nil, 0
+	}
+	st.testingStarted = true
+
+	js := st.json
+	if js == nil {
+		js = &testJSONState{
+			output:         make(map[testKey]*strings.Builder),
+			buildOutput:    make(map[string]*strings.Builder),
+			failedTests:    make(map[string]int),
+			failedSubtests: make(map[testKey]bool),
+		}
+		st.json = js
+	}
+
+	key := testKey{ev.Package, ev.Test}
+	var fs []*Failure
+	switch ev.Action {
+	case "output":
+		js.appendOutput(key, ev.Output)
+		if ev.Test != "" {
+			js.appendOutput(testKey{ev.Package, ""}, ev.Output)
+		}
+
+	case "build-output":
+		b := js.buildOutput[ev.ImportPath]
+		if b == nil {
+			b = new(strings.Builder)
+			js.buildOutput[ev.ImportPath] = b
+		}
+		b.WriteString(ev.Output)
+
+	case "pass", "skip":
+		js.finish(key)
+
+	case "fail":
+		if ev.Test != "" {
+			// Report only the innermost failed subtests.
+			if !js.failedSubtests[key] {
+				fs = append(fs, testJSONFailure(ev.Package, ev.Test, js.outputOf(key)))
+			}
+			if i := strings.LastIndex(ev.Test, "/"); i >= 0 {
+				js.failedSubtests[testKey{ev.Package, ev.Test[:i]}] = true
+			}
+			js.failedTests[ev.Package]++
+		} else if ev.FailedBuild != "" {
+			full := ""
+			if b := js.buildOutput[ev.FailedBuild]; b != nil {
+				full = b.String()
+			}
+			fs = append(fs, &Failure{
+				Package:     ev.Package,
+				FullMessage: full,
+				Message:     "build failed",
+			})
+		} else if js.failedTests[ev.Package] == 0 {
+			// The package failed outside of any test. Fall
+			// back to extracting the textual output.
+			fs = append(fs, st.packageFailures(ev.Package, js.outputOf(key))...)
+		}
+		js.finish(key)
+	}
+	return fs, len(line)
+}
+
+func (js *testJSONState) appendOutput(key testKey, out string) {
+	b := js.output[key]
+	if b == nil {
+		b = new(strings.Builder)
+		js.output[key] = b
+	}
+	b.WriteString(out)
+}
+
+func (js *testJSONState) outputOf(key testKey) string {
+	if b := js.output[key]; b != nil {
+		return CanonLines(b.String())
+	}
+	return ""
+}
+
+// finish discards the state of the test or package key.
+func (js *testJSONState) finish(key testKey) {
+	delete(js.output, key)
+	delete(js.failedSubtests, key)
+	if key.test == "" {
+		delete(js.failedTests, key.pkg)
+	}
+}
+
+// testJSONFailure returns the failure of test in pkg given the
+// test's output.
+func testJSONFailure(pkg, test, out string) *Failure {
+	out = testJSONFraming.ReplaceAllString(out, "")
+	f := &Failure{
+		Package:     pkg,
+		Test:        test,
+		FullMessage: strings.TrimRight(out, "\n"),
+		Message:     "unknown testing.T failure",
+	}
+
+	if strings.HasPrefix(out, "panic: test timed out") || strings.Contains(out, "\npanic: test timed out") {
+		f.Message = "test timed out"
+		f.Signature = ParseTraceback(out).Signature()
+		return f
+	}
+
+	sError := testJSONError.FindStringSubmatch(out)
+	sPanic := testingPanic.FindStringSubmatch(out)
+	if sPanic == nil {
+		sPanic = testJSONPanic.FindStringSubmatch(out)
+	}
+	if sError != nil {
+		f.File, f.Line, f.Message = sError[1], atoi(sError[2]), sError[3]
+	} else if sPanic != nil {
+		f.Function, f.File, f.Line = panicWhere(out)
+		f.Message = sPanic[1]
+	}
+	return f
+}
+
+// packageFailures extracts the failures of pkg from its textual
+// output using the extractors of st. The failures are attributed to
+// pkg, whatever package the extractors found in the output.
+func (st *ExtractState) packageFailures(pkg, out string) []*Failure {
+	fs := extract(st.entries, st.cache, out).Failures
+	if len(fs) > 0 {
+		for _, f := range fs {
+			f.Package = pkg
+		}
+		return fs
+	}
+
+	// Nothing recognized the failure.
+	msg := ""
+	for _, line := range strings.Split(testJSONFraming.ReplaceAllString(out, ""), "\n") {
+		if line != "" && !goodLine.MatchString(line) {
+			msg = line
+			break
+		}
+	}
+	return []*Failure{{
+		Package:     pkg,
+		FullMessage: out,
+		Message:     "unknown failure: " + msg,
+	}}
+}
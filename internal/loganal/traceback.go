@@ -0,0 +1,234 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loganal
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Traceback is a parsed Go traceback dump, such as printed by a
+// panic, a throw, or a test timeout.
+type Traceback struct {
+	// Goroutines lists the goroutine stacks in the dump, in the
+	// order they were printed.
+	Goroutines []*Goroutine
+}
+
+// A Goroutine is one goroutine's stack in a traceback.
+type Goroutine struct {
+	// ID is the goroutine ID. For a system stack (printed as
+	// "runtime stack:"), this is 0.
+	ID int
+
+	// State is the goroutine's wait reason or status, such as
+	// "running" or "chan receive". It is "" for a system stack.
+	State string
+
+	// Wait is how long the goroutine has been blocked, if known.
+	// The runtime reports this in whole minutes.
+	Wait time.Duration
+
+	// Locked indicates the goroutine is locked to its thread.
+	Locked bool
+
+	// Frames lists the goroutine's stack, innermost frame first.
+	Frames []Frame
+
+	// Elided indicates that the runtime omitted some frames of
+	// this stack.
+	Elided bool
+
+	// CreatedBy is the go statement that created this goroutine,
+	// if known. Only Func, File, and Line are filled in.
+	CreatedBy *Frame
+
+	// Creator is the ID of the goroutine that created this
+	// goroutine, or 0 if not known.
+	Creator int
+}
+
+// A Frame is one function call in a goroutine stack.
+type Frame struct {
+	// Func is the fully qualified function name.
+	Func string
+
+	// Args is the raw argument list of the call, not including
+	// the parentheses.
+	Args string
+
+	// File and Line are the source location of the call.
+	File string
+	Line int
+}
+
+var (
+	tbGoroutine = regexp.MustCompile(`^goroutine ([0-9]+)(?: gp=\S+ m=\S+(?: mp=\S+)?)? \[(.*)\]:$`)
+	tbCall      = regexp.MustCompile(`^(\S+)\((.*)\)$`)
+	tbPos       = regexp.MustCompile(`^\t(.*):([0-9]+)(?: .*)?$`)
+	tbCreatedBy = regexp.MustCompile(`^created by (\S+)(?: in goroutine ([0-9]+))?$`)
+	tbElided    = regexp.MustCompile(`^\.\.\.(?:additional|[0-9]+) frames elided\.\.\.$`)
+	tbWait      = regexp.MustCompile(`^([0-9]+) minutes$`)
+)
+
+// ParseTraceback parses the goroutine stacks in tb. Lines that are not
+// part of a goroutine stack are ignored, so tb may contain other text.
+func ParseTraceback(tb string) *Traceback {
+	t := &Traceback{}
+	lines := strings.Split(tb, "\n")
+	var g *Goroutine
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+
+		// Start of a goroutine?
+		if s := tbGoroutine.FindStringSubmatch(line); s != nil {
+			g = &Goroutine{ID: atoi(s[1])}
+			g.parseStatus(s[2])
+			t.Goroutines = append(t.Goroutines, g)
+			continue
+		}
+		if line == "runtime stack:" {
+			g = &Goroutine{}
+			t.Goroutines = append(t.Goroutines, g)
+			continue
+		}
+		if g == nil {
+			continue
+		}
+
+		// Parts of a goroutine.
+		var pos []string
+		if i+1 < len(lines) {
+			pos = tbPos.FindStringSubmatch(strings.TrimRight(lines[i+1], "\r"))
+		}
+		if s := tbCreatedBy.FindStringSubmatch(line); s != nil {
+			g.CreatedBy = &Frame{Func: s[1]}
+			if s[2] != "" {
+				g.Creator = atoi(s[2])
+			}
+			if pos != nil {
+				g.CreatedBy.File, g.CreatedBy.Line = pos[1], atoi(pos[2])
+				i++
+			}
+		} else if s := tbCall.FindStringSubmatch(line); s != nil && pos != nil {
+			g.Frames = append(g.Frames, Frame{s[1], s[2], pos[1], atoi(pos[2])})
+			i++
+		} else if tbElided.MatchString(line) {
+			g.Elided = true
+		} else if strings.TrimSpace(line) == "goroutine running on other thread; stack unavailable" {
+			// Nothing to record.
+		} else {
+			// End of this goroutine.
+			g = nil
+		}
+	}
+	return t
+}
+
+func (g *Goroutine) parseStatus(status string) {
+	for i, part := range strings.Split(status, ", ") {
+		if i == 0 {
+			g.State = part
+		} else if s := tbWait.FindStringSubmatch(part); s != nil {
+			g.Wait = time.Duration(atoi(s[1])) * time.Minute
+		} else if part == "locked to thread" {
+			g.Locked = true
+		}
+	}
+}
+
+// isPanicking returns whether fn is part of the runtime's panic or
+// throw machinery.
+func isPanicking(fn string) bool {
+	return fn == "panic" || strings.HasPrefix(fn, "runtime.panic") ||
+		strings.HasPrefix(fn, "runtime.gopanic") || strings.HasPrefix(fn, "runtime.goPanic") ||
+		fn == "runtime.throw" || fn == "runtime.fatalthrow" || fn == "runtime.fatalpanic" ||
+		fn == "runtime.sigpanic"
+}
+
+// PanicFrame returns the innermost frame of g that is not part of the
+// runtime's panic or throw machinery, or nil if there is no such
+// frame. If g panicked while running deferred calls (for example,
+// the testing package re-panicking a recovered panic), this skips
+// over the deferred calls to the frame that originally panicked.
+func (g *Goroutine) PanicFrame() *Frame {
+	// Frames above the last call to panic are deferred calls.
+	start := 0
+	for i, f := range g.Frames {
+		if f.Func == "panic" || f.Func == "runtime.gopanic" {
+			start = i + 1
+		}
+	}
+	for i := start; i < len(g.Frames); i++ {
+		if !isPanicking(g.Frames[i].Func) {
+			return &g.Frames[i]
+		}
+	}
+	return nil
+}
+
+// blockingPackages are packages whose functions are part of the
+// mechanism of blocking rather than the reason for it.
+var blockingPackages = []string{"runtime", "sync", "sync/atomic", "internal/", "time", "os/signal"}
+
+func isBlockingFunc(fn string) bool {
+	for _, pkg := range blockingPackages {
+		if strings.HasSuffix(pkg, "/") {
+			if strings.HasPrefix(fn, pkg) {
+				return true
+			}
+		} else if strings.HasPrefix(fn, pkg+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedIn returns the function where g is blocked, or "" if g is
+// not blocked. This is the innermost function outside of the
+// runtime and standard synchronization packages. Goroutines that
+// are running and goroutines blocked by the testing package itself
+// (for example, waiting for subtests or running the test timeout
+// alarm) are not considered blocked.
+func (g *Goroutine) BlockedIn() string {
+	switch g.State {
+	case "", "running", "runnable", "syscall", "idle":
+		return ""
+	}
+	for _, f := range g.Frames {
+		if isBlockingFunc(f.Func) {
+			continue
+		}
+		if strings.HasPrefix(f.Func, "testing.") {
+			return ""
+		}
+		return f.Func
+	}
+	return ""
+}
+
+// Signature returns a string identifying the set of blocked
+// goroutines in t. Deadlocks and timeouts with the same blocked
+// stacks have the same signature, even if the number of blocked
+// goroutines, their IDs, or their wait times differ. The signature
+// is a sorted, "; "-separated list of "function (state)" for each
+// distinct blocked goroutine. If no goroutines are blocked, it
+// returns "".
+func (t *Traceback) Signature() string {
+	set := map[string]bool{}
+	for _, g := range t.Goroutines {
+		if fn := g.BlockedIn(); fn != "" {
+			set[fn+" ("+g.State+")"] = true
+		}
+	}
+	sigs := make([]string, 0, len(set))
+	for sig := range set {
+		sigs = append(sigs, sig)
+	}
+	sort.Strings(sigs)
+	return strings.Join(sigs, "; ")
+}
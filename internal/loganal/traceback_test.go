@@ -0,0 +1,116 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loganal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testTraceback = `panic: test timed out after 10m0s
+
+goroutine 7 [running]:
+testing.(*M).startAlarm.func1()
+	/go/src/testing/testing.go:1377 +0xdf
+created by time.goFunc
+	/go/src/time/sleep.go:168 +0x44
+
+goroutine 1 [chan receive, 9 minutes]:
+testing.(*T).Run(0xc0000c2100, {0x5b8a3e, 0x8}, 0x5c1d30)
+	/go/src/testing/testing.go:1239 +0x37a
+
+goroutine 19 [semacquire, 9 minutes, locked to thread]:
+sync.runtime_SemacquireMutex(0xc0000a6024, 0x0, 0x1)
+	/go/src/runtime/sema.go:71 +0x25
+sync.(*Mutex).lockSlow(0xc0000a6020)
+	/go/src/sync/mutex.go:138 +0x165
+sync.(*Mutex).Lock(...)
+	/go/src/sync/mutex.go:81
+example.com/p.(*Cache).Get(0xc0000a6020)
+	/src/p/cache.go:42 +0x5d
+...additional frames elided...
+created by example.com/p.TestCache in goroutine 18
+	/src/p/cache_test.go:20 +0x85
+
+goroutine 20 [semacquire, 9 minutes]:
+sync.(*Mutex).Lock(...)
+	/go/src/sync/mutex.go:81
+example.com/p.(*Cache).Get(0xc0000a6020)
+	/src/p/cache.go:42 +0x5d
+
+goroutine 22 [running]:
+	goroutine running on other thread; stack unavailable
+created by example.com/p.TestCache in goroutine 18
+	/src/p/cache_test.go:21 +0x85
+
+goroutine 21 [chan send]:
+example.com/p.fill(0xc0000a6020)
+	/src/p/cache.go:60 +0x33
+exit status 2
+`
+
+func TestParseTraceback(t *testing.T) {
+	tb := ParseTraceback(testTraceback)
+	if len(tb.Goroutines) != 6 {
+		t.Fatalf("want 6 goroutines, got %d", len(tb.Goroutines))
+	}
+
+	g := tb.Goroutines[2]
+	want := &Goroutine{
+		ID:     19,
+		State:  "semacquire",
+		Wait:   9 * time.Minute,
+		Locked: true,
+		Frames: []Frame{
+			{"sync.runtime_SemacquireMutex", "0xc0000a6024, 0x0, 0x1", "/go/src/runtime/sema.go", 71},
+			{"sync.(*Mutex).lockSlow", "0xc0000a6020", "/go/src/sync/mutex.go", 138},
+			{"sync.(*Mutex).Lock", "...", "/go/src/sync/mutex.go", 81},
+			{"example.com/p.(*Cache).Get", "0xc0000a6020", "/src/p/cache.go", 42},
+		},
+		Elided:    true,
+		CreatedBy: &Frame{Func: "example.com/p.TestCache", File: "/src/p/cache_test.go", Line: 20},
+		Creator:   18,
+	}
+	if !reflect.DeepEqual(g, want) {
+		t.Errorf("want:\n%+v\ngot:\n%+v", want, g)
+	}
+
+	// A goroutine running on another thread has no frames, but
+	// still has its creator.
+	if g := tb.Goroutines[4]; len(g.Frames) != 0 || g.CreatedBy == nil || g.Creator != 18 {
+		t.Errorf("want goroutine %d with no frames created by goroutine 18, got %+v", g.ID, g)
+	}
+
+	// The last goroutine should end at "exit status".
+	if g := tb.Goroutines[5]; len(g.Frames) != 1 {
+		t.Errorf("want 1 frame in goroutine %d, got %+v", g.ID, g.Frames)
+	}
+}
+
+func TestTracebackSignature(t *testing.T) {
+	got := ParseTraceback(testTraceback).Signature()
+	want := "example.com/p.(*Cache).Get (semacquire); example.com/p.fill (chan send)"
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPanicFrame(t *testing.T) {
+	tb := ParseTraceback(`goroutine 6 [running]:
+testing.tRunner.func1.2({0x6b6d20, 0x6ee0e0})
+	/go/src/testing/testing.go:1734 +0x21c
+panic({0x6b6d20?, 0x6ee0e0?})
+	/go/src/runtime/panic.go:859 +0x125
+example.com/b.helper(...)
+	/src/b/b_test.go:5
+example.com/b.TestPanic(0xc000007180)
+	/src/b/b_test.go:6 +0x28
+`)
+	f := tb.Goroutines[0].PanicFrame()
+	if f == nil || f.Func != "example.com/b.helper" || f.Line != 5 {
+		t.Errorf("want example.com/b.helper at line 5, got %+v", f)
+	}
+}